@@ -12,9 +12,11 @@ Flags:
 	-chain=<chain name>
 	-table=<table name>
 	-filter=<bpf path | tcpdump-style filter string | socket file descriptor>
+	-verdict=<drop (default) | accept | reject>
 
 The command will load the filter in whatever format specified into a XT BPF Match
-rule in the nftables table and chain specified.
+rule in the nftables table and chain specified. Reject answers matching traffic with an
+ICMP port unreachable message instead of silently dropping it.
 */
 package main
 
@@ -38,7 +40,7 @@ func main() {
 	table := flag.String("table", "", "nftables table name")
 	chain := flag.String("chain", "", "nftables chain name")
 	filter := flag.String("filter", "", "tcpdump-style bpf filter, pinned bpf program path or socket fd")
-	verdict := flag.String("verdict", "drop", "nftables verdict (drop, accept, etc")
+	verdict := flag.String("verdict", "drop", "nftables verdict (drop, accept or reject)")
 	flag.Parse()
 
 	exists := []bool{}
@@ -75,20 +77,12 @@ func main() {
 		logger.Default.Fatalf("nftables flush failed: %v", err)
 	}
 
-	nfVerdict, err := getVerdict(*verdict)
-	if err != nil {
-		logger.Default.Fatal(err)
-	}
-
 	xtBpfInfoBytes, err := getXtBpfInfoBytes(*filter)
 	if err != nil {
 		logger.Default.Fatal(err)
 	}
 
-	exprs, err := rule.Build(
-		nfVerdict,
-		rule.Any(expressions.MatchBpf(xtBpfInfoBytes)),
-	)
+	exprs, err := buildRule(*verdict, xtBpfInfoBytes)
 	if err != nil {
 		logger.Default.Fatal(err)
 	}
@@ -122,6 +116,31 @@ func getVerdict(verdict string) (expr.VerdictKind, error) {
 	}
 }
 
+// getTerminal returns the terminal for a verdict and any matches it needs, reject answers with an icmp port
+// unreachable which needs the family even though the table is ipv4
+func getTerminal(verdict string) (rule.Terminal, []rule.Match, error) {
+	if verdict == "reject" {
+		return rule.RejectICMP(expressions.ICMPPortUnreachable), []rule.Match{rule.AddressFamily(expressions.IPv4)}, nil
+	}
+
+	nfVerdict, err := getVerdict(verdict)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rule.Verdict(nfVerdict), nil, nil
+}
+
+// buildRule returns the expressions of the rule that applies the verdict to packets matching the bpf filter
+func buildRule(verdict string, xtBpfInfoBytes []byte) ([]expr.Any, error) {
+	terminal, matches, err := getTerminal(verdict)
+	if err != nil {
+		return nil, err
+	}
+
+	return rule.BuildTerminal(terminal, append(matches, rule.Any(expressions.MatchBpf(xtBpfInfoBytes)))...)
+}
+
 func getXtBpfInfoBytes(filter string) ([]byte, error) {
 	fd, err := strconv.ParseInt(filter, 10, 32)
 	if err == nil {
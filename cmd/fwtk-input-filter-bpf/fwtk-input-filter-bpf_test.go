@@ -8,6 +8,10 @@ import (
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/ngrok/firewall_toolkit/pkg/expressions"
+	"github.com/ngrok/firewall_toolkit/pkg/rule"
 )
 
 func TestGetXtBpfInfoBytesBytecode(t *testing.T) {
@@ -48,3 +52,40 @@ func TestGetVerdictBad(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, expr.VerdictKind(-99), e)
 }
+
+func TestGetTerminal(t *testing.T) {
+	terminal, matches, err := getTerminal("reject")
+	assert.Nil(t, err)
+	exprs, err := rule.BuildTerminal(terminal, matches...)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: expressions.ICMPPortUnreachable}, exprs[len(exprs)-1])
+
+	terminal, matches, err = getTerminal("drop")
+	assert.Nil(t, err)
+	assert.Nil(t, matches)
+	exprs, err = rule.BuildTerminal(terminal)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}, exprs)
+
+	terminal, matches, err = getTerminal("bad")
+	assert.Error(t, err)
+	assert.Nil(t, terminal)
+	assert.Nil(t, matches)
+
+	b, err := getXtBpfInfoBytes("src 198.51.100.200")
+	assert.Nil(t, err)
+
+	// drop and accept rules are unchanged, only reject matches the family
+	exprs, err = buildRule("drop", b)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{expressions.MatchBpf(b), &expr.Verdict{Kind: expr.VerdictDrop}}, exprs)
+
+	exprs, err = buildRule("reject", b)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+		expressions.MatchBpf(b),
+		&expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: expressions.ICMPPortUnreachable},
+	}, exprs)
+}
@@ -14,10 +14,19 @@ Flags:
 	-mode=<oneshot (default) | manager>
 	-iplist=<path>
 	-portlist=<path>
+	-verdict=<drop (default) | reject>
+	-log=<none (default) | log | nflog>
+	-loggroup=<nflog group>
+	-lograte=<logged packets per second>
 
 This command will create a inet table, chain and sets using the names and files specified by the flags above.
 The files can contain IPs, CIDRs, ports and ranges, see tests/*.list for examples.
 Manager mode will run continuously re-reading the files on a timer.
+With -verdict=reject blocked traffic is answered with a TCP reset so clients fail fast instead of timing out.
+With -log blocked packets are logged to the kernel log, or sent to an NFLOG group with -log=nflog, before being dropped
+or rejected. Each rule logs with its own prefix, like "fwtk-input-filter-sets drop ipv4: ", so events can be traced
+back to the rule.
+Logging is rate limited by -lograte so a flood of blocked traffic doesn't flood the log too.
 */
 package main
 
@@ -25,6 +34,7 @@ import (
 	"bufio"
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"time"
 
@@ -40,6 +50,7 @@ import (
 
 const (
 	RefreshInterval = 1000 * time.Millisecond
+	LogPrefix       = "fwtk-input-filter-sets"
 )
 
 func main() {
@@ -48,21 +59,28 @@ func main() {
 	mode := flag.String("mode", "oneshot", "oneshot or manager")
 	ipFile := flag.String("iplist", "./ip.list", "file containing list of ips")
 	portFile := flag.String("portlist", "./port.list", "file containing list of ports")
+	verdict := flag.String("verdict", "drop", "drop or reject")
+	logMode := flag.String("log", "none", "none, log or nflog")
+	logGroup := flag.Uint("loggroup", 0, "nflog group to send dropped packets to")
+	logRate := flag.Uint64("lograte", 10, "maximum number of dropped packets logged per second")
 
 	flag.Parse()
 
-	exists := []bool{}
-	flag.VisitAll(func(f *flag.Flag) {
-		if len(f.Value.String()) > 0 {
-			exists = append(exists, true)
-		}
-	})
-
-	if len(exists) != 5 {
+	if *table == "" || *chain == "" || *mode == "" || *ipFile == "" || *portFile == "" {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	terminal, err := getTerminal(*verdict)
+	if err != nil {
+		logger.Default.Fatalf("invalid verdict flag: %v", err)
+	}
+
+	logging, err := newLogging(*logMode, *verdict, *logGroup, *logRate)
+	if err != nil {
+		logger.Default.Fatalf("invalid logging flags: %v", err)
+	}
+
 	c, err := nftables.New()
 	if err != nil {
 		logger.Default.Fatalf("nftables connection failed: %v", err)
@@ -133,7 +151,7 @@ func main() {
 
 	ruleTarget := rule.NewRuleTarget(nfTable, nfChain)
 
-	ruleInfo := newRuleInfo(portSet.Set(), ipv4Set.Set(), ipv6Set.Set())
+	ruleInfo := newRuleInfo(portSet.Set(), ipv4Set.Set(), ipv6Set.Set(), terminal, logging)
 
 	ruleData, err := ruleInfo.createRuleData()
 	if err != nil {
@@ -299,48 +317,126 @@ func readFile(path string) ([]string, error) {
 	return list, nil
 }
 
+// getTerminal returns the terminal for blocked traffic, the rules only match tcp so reject answers with a reset
+func getTerminal(verdict string) (rule.Terminal, error) {
+	switch verdict {
+	case "drop":
+		return rule.Verdict(expr.VerdictDrop), nil
+	case "reject":
+		return rule.RejectTCPReset(), nil
+	default:
+		return nil, fmt.Errorf("unsupported verdict %v", verdict)
+	}
+}
+
+// how blocked packets are logged
+type logging struct {
+	mode    string
+	verdict string
+	group   uint16
+	rate    uint64
+}
+
+func newLogging(mode string, verdict string, group uint, rate uint64) (logging, error) {
+	switch mode {
+	case "none", "log", "nflog":
+	default:
+		return logging{}, fmt.Errorf("unknown log mode %v", mode)
+	}
+
+	if group > 0xffff {
+		return logging{}, fmt.Errorf("nflog group %v is out of range", group)
+	}
+
+	if mode != "none" && rate == 0 {
+		return logging{}, fmt.Errorf("log rate was 0")
+	}
+
+	return logging{mode: mode, verdict: verdict, group: uint16(group), rate: rate}, nil
+}
+
+// match returns the match that logs packets of the family, or nil if logging is off
+func (l logging) match(family expressions.AddrFamily) rule.Match {
+	switch l.mode {
+	case "log":
+		return rule.Log(l.prefix(family), expr.LogLevelWarning)
+	case "nflog":
+		return rule.NFLog(l.group, 0, l.prefix(family))
+	default:
+		return nil
+	}
+}
+
+// prefix returns the log prefix for packets of the family, each rule needs its own so nflog events can be correlated
+func (l logging) prefix(family expressions.AddrFamily) string {
+	name := "ipv4"
+	if family == expressions.IPv6 {
+		name = "ipv6"
+	}
+
+	return fmt.Sprintf("%v %v %v: ", LogPrefix, l.verdict, name)
+}
+
 type ruleInfo struct {
-	PortSet *nftables.Set
-	IPv4Set *nftables.Set
-	IPv6Set *nftables.Set
+	PortSet  *nftables.Set
+	IPv4Set  *nftables.Set
+	IPv6Set  *nftables.Set
+	Terminal rule.Terminal
+	Logging  logging
 }
 
-func newRuleInfo(portSet *nftables.Set, ipv4Set *nftables.Set, ipv6Set *nftables.Set) ruleInfo {
+func newRuleInfo(portSet *nftables.Set, ipv4Set *nftables.Set, ipv6Set *nftables.Set, terminal rule.Terminal, logging logging) ruleInfo {
 	return ruleInfo{
-		PortSet: portSet,
-		IPv4Set: ipv4Set,
-		IPv6Set: ipv6Set,
+		PortSet:  portSet,
+		IPv4Set:  ipv4Set,
+		IPv6Set:  ipv6Set,
+		Terminal: terminal,
+		Logging:  logging,
 	}
 }
 
 func (s *ruleInfo) createRuleData() ([]rule.RuleData, error) {
-	ipv6Exprs, err := rule.Build(
-		expr.VerdictDrop,
-		rule.AddressFamily(expressions.IPv6),
-		rule.TransportProtocol(expressions.TCP),
-		rule.SourceAddressSet(s.IPv6Set),
-		rule.DestinationPortSet(s.PortSet),
-		rule.Any(expressions.Counter()),
-	)
+	// give each rule a unique id so we can track it's existence
+	ipv4Rules, err := s.dropRules([]byte{0xd, 0xe, 0xa, 0xd}, expressions.IPv4, s.IPv4Set)
 	if err != nil {
 		return nil, err
 	}
 
-	ipv4Exprs, err := rule.Build(
-		expr.VerdictDrop,
-		rule.AddressFamily(expressions.IPv4),
+	ipv6Rules, err := s.dropRules([]byte{0xc, 0xa, 0xf, 0xe}, expressions.IPv6, s.IPv6Set)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ipv4Rules, ipv6Rules...), nil
+}
+
+// dropRules returns the rule that drops or rejects traffic from the addresses in ipSet to the ports in the port set,
+// preceded by a rule that logs it if logging is on. The log rule is separate so its rate limit doesn't also limit the
+// drop.
+func (s *ruleInfo) dropRules(id []byte, family expressions.AddrFamily, ipSet *nftables.Set) ([]rule.RuleData, error) {
+	matches := []rule.Match{
+		rule.AddressFamily(family),
 		rule.TransportProtocol(expressions.TCP),
-		rule.SourceAddressSet(s.IPv4Set),
+		rule.SourceAddressSet(ipSet),
 		rule.DestinationPortSet(s.PortSet),
-		rule.Any(expressions.Counter()),
-	)
+	}
+
+	dropExprs, err := rule.BuildTerminal(s.Terminal, append(matches, rule.Any(expressions.Counter()))...)
 	if err != nil {
 		return nil, err
 	}
+	dropRule := rule.NewRuleData(id, dropExprs)
 
-	// give each rule a unique id so we can track it's existence
-	ipv4Rule := rule.NewRuleData([]byte{0xd, 0xe, 0xa, 0xd}, ipv4Exprs)
-	ipv6Rule := rule.NewRuleData([]byte{0xc, 0xa, 0xf, 0xe}, ipv6Exprs)
+	log := s.Logging.match(family)
+	if log == nil {
+		return []rule.RuleData{dropRule}, nil
+	}
+
+	logExprs, err := rule.Build(expr.VerdictContinue, append(matches, rule.Limit(s.Logging.rate, expr.LimitTimeSecond, 0, false), log)...)
+	if err != nil {
+		return nil, err
+	}
+	logRule := rule.NewRuleData(append([]byte("log-"), id...), logExprs)
 
-	return []rule.RuleData{ipv4Rule, ipv6Rule}, nil
+	return []rule.RuleData{logRule, dropRule}, nil
 }
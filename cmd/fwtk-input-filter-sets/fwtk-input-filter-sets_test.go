@@ -7,9 +7,14 @@ import (
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
 	"github.com/ngrok/firewall_toolkit/pkg/expressions"
+	"github.com/ngrok/firewall_toolkit/pkg/logger"
+	"github.com/ngrok/firewall_toolkit/pkg/nflog"
 	"github.com/ngrok/firewall_toolkit/pkg/rule"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func TestGenerateIPv4Rule(t *testing.T) {
@@ -85,10 +90,100 @@ func TestCreateRuleData(t *testing.T) {
 	ipv4Set := &nftables.Set{Name: "testipv4set", KeyType: nftables.TypeIPAddr}
 	ipv6Set := &nftables.Set{Name: "testipv6set", KeyType: nftables.TypeIP6Addr}
 
-	ruleInfo := newRuleInfo(portSet, ipv4Set, ipv6Set)
+	ruleInfo := newRuleInfo(portSet, ipv4Set, ipv6Set, rule.Verdict(expr.VerdictDrop), logging{mode: "none"})
 	ruleData, err := ruleInfo.createRuleData()
 	assert.Nil(t, err)
 
 	assert.Equal(t, ruleData[0].ID, []byte{0xd, 0xe, 0xa, 0xd})
 	assert.Equal(t, ruleData[1].ID, []byte{0xc, 0xa, 0xf, 0xe})
 }
+
+func TestCreateRuleDataWithLogging(t *testing.T) {
+	portSet := &nftables.Set{Name: "testportset", KeyType: nftables.TypeInetService}
+	ipv4Set := &nftables.Set{Name: "testipv4set", KeyType: nftables.TypeIPAddr}
+	ipv6Set := &nftables.Set{Name: "testipv6set", KeyType: nftables.TypeIP6Addr}
+
+	logging, err := newLogging("nflog", "drop", 3, 5)
+	assert.Nil(t, err)
+
+	ruleInfo := newRuleInfo(portSet, ipv4Set, ipv6Set, rule.Verdict(expr.VerdictDrop), logging)
+	ruleData, err := ruleInfo.createRuleData()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(ruleData))
+
+	// each drop rule is preceded by a rate limited log rule
+	assert.Equal(t, []byte("log-\x0d\x0e\x0a\x0d"), ruleData[0].ID)
+	assert.Equal(t, []byte{0xd, 0xe, 0xa, 0xd}, ruleData[1].ID)
+	assert.Equal(t, []byte("log-\x0c\x0a\x0f\x0e"), ruleData[2].ID)
+	assert.Equal(t, []byte{0xc, 0xa, 0xf, 0xe}, ruleData[3].ID)
+
+	logExprs := ruleData[0].Expressions
+	assert.Equal(t, &expr.Limit{Type: expr.LimitTypePkts, Rate: 5, Unit: expr.LimitTimeSecond}, logExprs[len(logExprs)-3])
+	assert.IsType(t, &expr.Log{}, logExprs[len(logExprs)-2])
+	assert.Equal(t, uint16(3), logExprs[len(logExprs)-2].(*expr.Log).Group)
+	assert.Equal(t, []byte("fwtk-input-filter-sets drop ipv4: "), logExprs[len(logExprs)-2].(*expr.Log).Data)
+	assert.Equal(t, &expr.Verdict{Kind: expr.VerdictContinue}, logExprs[len(logExprs)-1])
+	assert.Equal(t, &expr.Verdict{Kind: expr.VerdictDrop}, ruleData[1].Expressions[len(ruleData[1].Expressions)-1])
+}
+
+func TestNewLogging(t *testing.T) {
+	_, err := newLogging("syslog", "drop", 0, 10)
+	assert.Error(t, err)
+
+	_, err = newLogging("nflog", "drop", 70000, 10)
+	assert.Error(t, err)
+
+	_, err = newLogging("log", "drop", 0, 0)
+	assert.Error(t, err)
+
+	l, err := newLogging("none", "drop", 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, l.match(expressions.IPv4))
+}
+
+func TestCreateRuleDataReject(t *testing.T) {
+	portSet := &nftables.Set{Name: "testportset", KeyType: nftables.TypeInetService}
+	ipv4Set := &nftables.Set{Name: "testipv4set", KeyType: nftables.TypeIPAddr}
+	ipv6Set := &nftables.Set{Name: "testipv6set", KeyType: nftables.TypeIP6Addr}
+
+	terminal, err := getTerminal("reject")
+	assert.Nil(t, err)
+
+	ruleInfo := newRuleInfo(portSet, ipv4Set, ipv6Set, terminal, logging{mode: "none"})
+	ruleData, err := ruleInfo.createRuleData()
+	assert.Nil(t, err)
+
+	for _, rD := range ruleData {
+		assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_TCP_RST}, rD.Expressions[len(rD.Expressions)-1])
+	}
+
+	_, err = getTerminal("accept")
+	assert.Error(t, err)
+}
+
+func TestCreateRuleDataCorrelate(t *testing.T) {
+	portSet := &nftables.Set{Name: "testportset", KeyType: nftables.TypeInetService}
+	ipv4Set := &nftables.Set{Name: "testipv4set", KeyType: nftables.TypeIPAddr}
+	ipv6Set := &nftables.Set{Name: "testipv6set", KeyType: nftables.TypeIP6Addr}
+
+	terminal, err := getTerminal("reject")
+	assert.Nil(t, err)
+	logging, err := newLogging("nflog", "reject", 3, 5)
+	assert.Nil(t, err)
+
+	ruleInfo := newRuleInfo(portSet, ipv4Set, ipv6Set, terminal, logging)
+	ruleData, err := ruleInfo.createRuleData()
+	assert.Nil(t, err)
+
+	c := nltest.Dial(func(req []netlink.Message) ([]netlink.Message, error) {
+		return req, nil
+	})
+	conn, err := nflog.NewConn(c, 3, logger.Default, nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// every log rule has its own prefix so events from either family can be traced back to it
+	conn.Correlate(ruleData)
+	assert.Equal(t, []byte("log-\x0d\x0e\x0a\x0d"), conn.RuleID("fwtk-input-filter-sets reject ipv4: "))
+	assert.Equal(t, []byte("log-\x0c\x0a\x0f\x0e"), conn.RuleID("fwtk-input-filter-sets reject ipv6: "))
+}
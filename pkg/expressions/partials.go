@@ -7,7 +7,10 @@ package expressions
 
 import (
 	"fmt"
+	"math"
 	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
@@ -32,6 +35,95 @@ const (
 	AnyTransport TransportProto = -1
 	TCP          TransportProto = unix.IPPROTO_TCP
 	UDP          TransportProto = unix.IPPROTO_UDP
+	ICMP         TransportProto = unix.IPPROTO_ICMP
+	ICMPv6       TransportProto = unix.IPPROTO_ICMPV6
+)
+
+// TCP lengths and offsets
+const (
+	TCPFlagsOffset = 13
+	TCPFlagsLen    = 1
+)
+
+// TCP MSS option kind, the offset of its value within the option and the value length
+const (
+	TCPOptionMSS       = unix.TCPOPT_MAXSEG
+	TCPOptionMSSOffset = 2
+	TCPOptionMSSLen    = 2
+)
+
+// TCP flag bits
+const (
+	TCPFlagFIN uint8 = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+)
+
+// ICMP and ICMPv6 lengths and offsets
+const (
+	ICMPTypeOffset = 0
+	ICMPCodeOffset = 1
+	ICMPTypeLen    = 1
+	ICMPCodeLen    = 1
+)
+
+// Common ICMP types
+const (
+	ICMPEchoReply              uint8 = 0
+	ICMPDestinationUnreachable uint8 = 3
+	ICMPRedirect               uint8 = 5
+	ICMPEchoRequest            uint8 = 8
+	ICMPTimeExceeded           uint8 = 11
+	ICMPParameterProblem       uint8 = 12
+)
+
+// Common ICMPv6 types, including the ones neighbor discovery needs
+const (
+	ICMPv6DestinationUnreachable uint8 = 1
+	ICMPv6PacketTooBig           uint8 = 2
+	ICMPv6TimeExceeded           uint8 = 3
+	ICMPv6ParameterProblem       uint8 = 4
+	ICMPv6EchoRequest            uint8 = 128
+	ICMPv6EchoReply              uint8 = 129
+	ICMPv6RouterSolicitation     uint8 = 133
+	ICMPv6RouterAdvertisement    uint8 = 134
+	ICMPv6NeighborSolicitation   uint8 = 135
+	ICMPv6NeighborAdvertisement  uint8 = 136
+	ICMPv6Redirect               uint8 = 137
+)
+
+// Common ICMP destination unreachable codes, for reject
+const (
+	ICMPNetUnreachable      uint8 = 0
+	ICMPHostUnreachable     uint8 = 1
+	ICMPProtUnreachable     uint8 = 2
+	ICMPPortUnreachable     uint8 = 3
+	ICMPNetProhibited       uint8 = 9
+	ICMPHostProhibited      uint8 = 10
+	ICMPAdminProhibited     uint8 = 13
+	ICMPUnreachableCodesMax uint8 = 15
+)
+
+// Common ICMPv6 destination unreachable codes, for reject
+const (
+	ICMPv6NoRoute             uint8 = 0
+	ICMPv6AdminProhibited     uint8 = 1
+	ICMPv6AddrUnreachable     uint8 = 3
+	ICMPv6PortUnreachable     uint8 = 4
+	ICMPv6UnreachableCodesMax uint8 = 6
+)
+
+// Family independent ICMPx codes for reject in inet tables, the kernel picks the matching ICMP or ICMPv6 code
+const (
+	ICMPxNoRoute         uint8 = unix.NFT_REJECT_ICMPX_NO_ROUTE
+	ICMPxPortUnreachable uint8 = unix.NFT_REJECT_ICMPX_PORT_UNREACH
+	ICMPxHostUnreachable uint8 = unix.NFT_REJECT_ICMPX_HOST_UNREACH
+	ICMPxAdminProhibited uint8 = unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED
 )
 
 // Transport protocol lengths and offsets
@@ -46,13 +138,69 @@ const (
 	IPv4SrcOffset = 12
 	IPv4DstOffset = 16
 	IPv4AddrLen   = 4
+
+	IPv4TOSOffset        = 1
+	IPv4TOSLen           = 1
+	IPv4LengthOffset     = 2
+	IPv4LengthLen        = 2
+	IPv4FragOffsetOffset = 6
+	IPv4FragOffsetLen    = 2
+	IPv4TTLOffset        = 8
+	IPv4TTLLen           = 1
+	IPv4ChecksumOffset   = 10
 )
 
-// IPv6 lengths and offsets
+// IPv6 lengths and offsets, the traffic class spans the first two bytes along with the version and flow label
 const (
 	IPv6SrcOffest = 8
 	IPv6DstOffset = 24
 	IPv6AddrLen   = 16
+
+	IPv6TrafficClassOffset  = 0
+	IPv6TrafficClassLen     = 2
+	IPv6PayloadLengthOffset = 4
+	IPv6PayloadLengthLen    = 2
+	IPv6HopLimitOffset      = 7
+	IPv6HopLimitLen         = 1
+)
+
+// Masks of header fields that share their bytes with others, the DSCP is the top six bits of the IPv4 TOS and the
+// IPv6 traffic class
+const (
+	IPv4DSCPMask       uint8  = 0xfc
+	IPv4FragOffsetMask uint16 = 0x1fff
+	IPv6DSCPMask       uint16 = 0x0fc0
+)
+
+// UDP lengths and offsets
+const (
+	UDPHeaderLen = 8
+)
+
+// Fib lookup flags, the fields of the packet the route is looked up with. One of the addresses is required
+const (
+	FibSourceAddress      uint32 = unix.NFTA_FIB_F_SADDR
+	FibDestinationAddress uint32 = unix.NFTA_FIB_F_DADDR
+	FibMark               uint32 = unix.NFTA_FIB_F_MARK
+	FibInputInterface     uint32 = unix.NFTA_FIB_F_IIF
+	FibOutputInterface    uint32 = unix.NFTA_FIB_F_OIF
+)
+
+// Fib results, what the route lookup loads into the register
+const (
+	FibResultOutputInterface     uint32 = unix.NFT_FIB_RESULT_OIF
+	FibResultOutputInterfaceName uint32 = unix.NFT_FIB_RESULT_OIFNAME
+	FibResultAddressType         uint32 = unix.NFT_FIB_RESULT_ADDRTYPE
+)
+
+// Common address types of a fib address type lookup
+const (
+	FibAddressTypeUnicast   uint32 = unix.RTN_UNICAST
+	FibAddressTypeLocal     uint32 = unix.RTN_LOCAL
+	FibAddressTypeBroadcast uint32 = unix.RTN_BROADCAST
+	FibAddressTypeAnycast   uint32 = unix.RTN_ANYCAST
+	FibAddressTypeMulticast uint32 = unix.RTN_MULTICAST
+	FibAddressTypeBlackhole uint32 = unix.RTN_BLACKHOLE
 )
 
 // Default register and default xt_bpf version
@@ -61,6 +209,11 @@ const (
 	bpfRevision     = 1
 )
 
+// Register NAT statements load the port from, the address goes in the default register
+const (
+	natPortRegister = 2
+)
+
 // Returns a source port payload expression
 func SourcePort(reg uint32) *expr.Payload {
 	return &expr.Payload{
@@ -121,6 +274,36 @@ func IPv6DestinationAddress(reg uint32) *expr.Payload {
 	}
 }
 
+// Returns a TCP flags payload expression
+func TCPFlags(reg uint32) *expr.Payload {
+	return &expr.Payload{
+		DestRegister: reg,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       TCPFlagsOffset,
+		Len:          TCPFlagsLen,
+	}
+}
+
+// Returns an ICMP or ICMPv6 type payload expression
+func ICMPType(reg uint32) *expr.Payload {
+	return &expr.Payload{
+		DestRegister: reg,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       ICMPTypeOffset,
+		Len:          ICMPTypeLen,
+	}
+}
+
+// Returns an ICMP or ICMPv6 code payload expression
+func ICMPCode(reg uint32) *expr.Payload {
+	return &expr.Payload{
+		DestRegister: reg,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       ICMPCodeOffset,
+		Len:          ICMPCodeLen,
+	}
+}
+
 // Returns a port set lookup expression
 func PortSetLookUp(set *nftables.Set, reg uint32) *expr.Lookup {
 	return &expr.Lookup{
@@ -139,6 +322,15 @@ func IPSetLookUp(set *nftables.Set, reg uint32) *expr.Lookup {
 	}
 }
 
+// Returns a lookup expression for a set of any key type
+func SetLookUp(set *nftables.Set, reg uint32) *expr.Lookup {
+	return &expr.Lookup{
+		SourceRegister: reg,
+		SetName:        set.Name,
+		SetID:          set.ID,
+	}
+}
+
 // Returns a meta expression
 func Meta(meta expr.MetaKey, reg uint32) *expr.Meta {
 	return &expr.Meta{
@@ -152,6 +344,129 @@ func Counter() *expr.Counter {
 	return &expr.Counter{}
 }
 
+// Returns a packet rate limit expression, it matches while traffic is under rate packets per unit plus burst packets,
+// or only once that's exceeded if over is true
+func LimitPackets(rate uint64, unit expr.LimitTime, burst uint32, over bool) (*expr.Limit, error) {
+	return limit(expr.LimitTypePkts, rate, unit, burst, over)
+}
+
+// Returns a byte rate limit expression, it matches while traffic is under rate bytes per unit plus burst bytes, or
+// only once that's exceeded if over is true
+func LimitBytes(rate uint64, unit expr.LimitTime, burst uint32, over bool) (*expr.Limit, error) {
+	return limit(expr.LimitTypePktBytes, rate, unit, burst, over)
+}
+
+func limit(limitType expr.LimitType, rate uint64, unit expr.LimitTime, burst uint32, over bool) (*expr.Limit, error) {
+	if rate == 0 {
+		return &expr.Limit{}, fmt.Errorf("limit rate was 0")
+	}
+
+	switch unit {
+	case expr.LimitTimeSecond, expr.LimitTimeMinute, expr.LimitTimeHour, expr.LimitTimeDay, expr.LimitTimeWeek:
+	default:
+		return &expr.Limit{}, fmt.Errorf("invalid limit unit %v", unit)
+	}
+
+	return &expr.Limit{
+		Type:  limitType,
+		Rate:  rate,
+		Unit:  unit,
+		Burst: burst,
+		Over:  over,
+	}, nil
+}
+
+// Returns a quota expression, it matches until bytes have been seen by the rule, or only after that if over is true
+func Quota(bytes uint64, over bool) (*expr.Quota, error) {
+	if bytes == 0 {
+		return &expr.Quota{}, fmt.Errorf("quota bytes was 0")
+	}
+
+	return &expr.Quota{
+		Bytes: bytes,
+		Over:  over,
+	}, nil
+}
+
+// Returns a connection limit expression, it matches while the rule or set element has count connections or fewer,
+// or only once there are more than that if inverted is true, the equivalent of `ct count over 10` in nft
+func ConnLimit(count uint32, inverted bool) (*expr.Connlimit, error) {
+	// the connection being counted is included, a limit of 0 would never match
+	if count == 0 && !inverted {
+		return &expr.Connlimit{}, fmt.Errorf("connection limit was 0")
+	}
+
+	connlimit := &expr.Connlimit{Count: count}
+	if inverted {
+		connlimit.Flags = expr.NFT_CONNLIMIT_F_INV
+	}
+
+	return connlimit, nil
+}
+
+// NF_LOG_PREFIXLEN, the kernel limit on the log prefix including the NUL terminator
+const logPrefixMaxLen = 128
+
+// Returns a log expression that logs matching packets to the kernel log at level with prefix, an empty prefix is left out
+func Log(prefix string, level expr.LogLevel) (*expr.Log, error) {
+	if err := validateLogPrefix(prefix); err != nil {
+		return &expr.Log{}, err
+	}
+
+	if level > expr.LogLevelAudit {
+		return &expr.Log{}, fmt.Errorf("invalid log level %v", level)
+	}
+
+	e := &expr.Log{
+		Key:   1 << unix.NFTA_LOG_LEVEL,
+		Level: level,
+	}
+
+	if prefix != "" {
+		e.Key |= 1 << unix.NFTA_LOG_PREFIX
+		e.Data = []byte(prefix)
+	}
+
+	return e, nil
+}
+
+// Returns a log expression that sends matching packets to NFLOG group for a userspace collector, snaplen limits how
+// many bytes of each packet are copied, 0 copies the whole packet. An empty prefix is left out
+func NFLog(group uint16, snaplen uint32, prefix string) (*expr.Log, error) {
+	if err := validateLogPrefix(prefix); err != nil {
+		return &expr.Log{}, err
+	}
+
+	e := &expr.Log{
+		Key:   1 << unix.NFTA_LOG_GROUP,
+		Group: group,
+	}
+
+	if snaplen > 0 {
+		e.Key |= 1 << unix.NFTA_LOG_SNAPLEN
+		e.Snaplen = snaplen
+	}
+
+	if prefix != "" {
+		e.Key |= 1 << unix.NFTA_LOG_PREFIX
+		e.Data = []byte(prefix)
+	}
+
+	return e, nil
+}
+
+func validateLogPrefix(prefix string) error {
+	if len(prefix)+1 > logPrefixMaxLen {
+		return fmt.Errorf("log prefix %v is too long, %v > %v", prefix, len(prefix)+1, logPrefixMaxLen)
+	}
+
+	if strings.ContainsRune(prefix, 0x0) {
+		return fmt.Errorf("log prefix %q contains a NUL byte", prefix)
+	}
+
+	return nil
+}
+
 // Returns an equal comparison expression
 func Equals(data []byte, reg uint32) *expr.Cmp {
 	return &expr.Cmp{
@@ -184,6 +499,137 @@ func Drop() *expr.Verdict {
 	}
 }
 
+// Returns a list of expressions that rewrite the destination address of traffic to addr, and the destination port to
+// port unless it's 0
+func DNAT(addr netip.Addr, port uint16) ([]expr.Any, error) {
+	return nat(expr.NATTypeDestNAT, addr, port)
+}
+
+// Returns a list of expressions that rewrite the source address of traffic to addr, and the source port to port unless
+// it's 0
+func SNAT(addr netip.Addr, port uint16) ([]expr.Any, error) {
+	return nat(expr.NATTypeSourceNAT, addr, port)
+}
+
+func nat(natType expr.NATType, addr netip.Addr, port uint16) ([]expr.Any, error) {
+	if !addr.IsValid() {
+		return []expr.Any{}, fmt.Errorf("invalid nat address")
+	}
+
+	family := uint32(unix.NFPROTO_IPV4)
+	if addr.Is6() {
+		family = unix.NFPROTO_IPV6
+	}
+
+	addrImm := &expr.Immediate{
+		Register: defaultRegister,
+		Data:     addr.AsSlice(),
+	}
+
+	natExpr := &expr.NAT{
+		Type:       natType,
+		Family:     family,
+		RegAddrMin: defaultRegister,
+	}
+
+	if port == 0 {
+		return []expr.Any{addrImm, natExpr}, nil
+	}
+
+	// the kernel sets the proto specified flag when a port register is given, set it here too so the expression
+	// reads back the same
+	natExpr.RegProtoMin = natPortRegister
+	natExpr.Specified = true
+
+	portImm := &expr.Immediate{
+		Register: natPortRegister,
+		Data:     binaryutil.BigEndian.PutUint16(port),
+	}
+
+	return []expr.Any{addrImm, portImm, natExpr}, nil
+}
+
+// Returns a masquerade expression, it rewrites the source address of traffic to the address of the output interface
+func Masquerade() *expr.Masq {
+	return &expr.Masq{}
+}
+
+// Returns a list of expressions that redirect traffic to the local machine, to port unless it's 0
+func Redirect(port uint16) []expr.Any {
+	if port == 0 {
+		return []expr.Any{&expr.Redir{}}
+	}
+
+	return []expr.Any{
+		&expr.Immediate{
+			Register: defaultRegister,
+			Data:     binaryutil.BigEndian.PutUint16(port),
+		},
+		// see nat for why the proto specified flag is set
+		&expr.Redir{
+			RegisterProtoMin: defaultRegister,
+			Flags:            expr.NF_NAT_RANGE_PROTO_SPECIFIED,
+		},
+	}
+}
+
+// Returns a reject expression that answers TCP traffic with a reset
+func RejectTCPReset() *expr.Reject {
+	return &expr.Reject{
+		Type: unix.NFT_REJECT_TCP_RST,
+	}
+}
+
+// Returns a reject expression that answers traffic with an ICMP or ICMPv6 destination unreachable message with code,
+// which code means what depends on the family of the traffic
+func RejectICMP(code uint8) *expr.Reject {
+	return &expr.Reject{
+		Type: unix.NFT_REJECT_ICMP_UNREACH,
+		Code: code,
+	}
+}
+
+// Returns a reject expression that answers traffic with the ICMP or ICMPv6 destination unreachable message that
+// matches the ICMPx code, only inet tables support it
+func RejectICMPx(code uint8) (*expr.Reject, error) {
+	if code > ICMPxAdminProhibited {
+		return &expr.Reject{}, fmt.Errorf("invalid icmpx code %v", code)
+	}
+
+	return &expr.Reject{
+		Type: unix.NFT_REJECT_ICMPX_UNREACH,
+		Code: code,
+	}, nil
+}
+
+// Returns a queue expression that sends traffic to userspace on queues start through start+total-1, flags can bypass
+// the queues when nothing is listening (expr.QueueFlagBypass) and spread traffic across them by CPU instead of by
+// flow (expr.QueueFlagFanout), which requires more than one queue
+func Queue(start uint16, total uint16, flags expr.QueueFlag) (*expr.Queue, error) {
+	if flags&^expr.QueueFlagMask != 0 {
+		return &expr.Queue{}, fmt.Errorf("invalid queue flags %#x", flags)
+	}
+
+	if total == 0 {
+		return &expr.Queue{}, fmt.Errorf("queue range must have at least one queue")
+	}
+
+	if uint32(start)+uint32(total)-1 > math.MaxUint16 {
+		return &expr.Queue{}, fmt.Errorf("queue range %v-%v is out of range", start, uint32(start)+uint32(total)-1)
+	}
+
+	if flags&expr.QueueFlagFanout != 0 && total == 1 {
+		return &expr.Queue{}, fmt.Errorf("queue fanout requires more than one queue")
+	}
+
+	// the kernel reports a single queue as a range of 1, set it so rules read back the same
+	return &expr.Queue{
+		Num:   start,
+		Total: total,
+		Flag:  flags,
+	}, nil
+}
+
 // Returns a xtables match expression
 func Match(name string, revision uint32, info xt.InfoAny) *expr.Match {
 	return &expr.Match{
@@ -456,3 +902,907 @@ func CompareCtStateWithRegister(reg uint32, mask uint32) ([]expr.Any, error) {
 func CompareCtState(mask uint32) ([]expr.Any, error) {
 	return CompareCtStateWithRegister(defaultRegister, mask)
 }
+
+// Returns an interface name padded with NUL bytes to the size the kernel uses so it can be compared exactly
+func InterfaceName(name string) ([]byte, error) {
+	if err := utils.ValidateInterfaceName(name); err != nil {
+		return []byte{}, err
+	}
+
+	padded := make([]byte, utils.InterfaceNameSize)
+	copy(padded, name)
+
+	return padded, nil
+}
+
+// Returns a list of expressions that will compare the input interface name of traffic
+func CompareInputInterfaceName(name string) ([]expr.Any, error) {
+	return CompareInputInterfaceNameWithRegister(name, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the input interface name of traffic, with a user defined register
+func CompareInputInterfaceNameWithRegister(name string, reg uint32) ([]expr.Any, error) {
+	return compareInterfaceName(expr.MetaKeyIIFNAME, name, reg)
+}
+
+// Returns a list of expressions that will compare the output interface name of traffic
+func CompareOutputInterfaceName(name string) ([]expr.Any, error) {
+	return CompareOutputInterfaceNameWithRegister(name, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the output interface name of traffic, with a user defined register
+func CompareOutputInterfaceNameWithRegister(name string, reg uint32) ([]expr.Any, error) {
+	return compareInterfaceName(expr.MetaKeyOIFNAME, name, reg)
+}
+
+func compareInterfaceName(key expr.MetaKey, name string, reg uint32) ([]expr.Any, error) {
+	ifname, err := InterfaceName(name)
+	if err != nil {
+		return []expr.Any{}, err
+	}
+
+	return []expr.Any{
+		Meta(key, reg),
+		Equals(ifname, reg),
+	}, nil
+}
+
+// Returns a list of expressions that will compare the start of the input interface name of traffic, like eth* in nft
+func CompareInputInterfacePrefix(prefix string) ([]expr.Any, error) {
+	return CompareInputInterfacePrefixWithRegister(prefix, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the start of the input interface name of traffic, with a user defined register
+func CompareInputInterfacePrefixWithRegister(prefix string, reg uint32) ([]expr.Any, error) {
+	return compareInterfacePrefix(expr.MetaKeyIIFNAME, prefix, reg)
+}
+
+// Returns a list of expressions that will compare the start of the output interface name of traffic, like eth* in nft
+func CompareOutputInterfacePrefix(prefix string) ([]expr.Any, error) {
+	return CompareOutputInterfacePrefixWithRegister(prefix, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the start of the output interface name of traffic, with a user defined register
+func CompareOutputInterfacePrefixWithRegister(prefix string, reg uint32) ([]expr.Any, error) {
+	return compareInterfacePrefix(expr.MetaKeyOIFNAME, prefix, reg)
+}
+
+func compareInterfacePrefix(key expr.MetaKey, prefix string, reg uint32) ([]expr.Any, error) {
+	if err := utils.ValidateInterfacePrefix(prefix); err != nil {
+		return []expr.Any{}, err
+	}
+
+	// without the NUL padding the comparison only covers the length of the prefix
+	return []expr.Any{
+		Meta(key, reg),
+		Equals([]byte(prefix), reg),
+	}, nil
+}
+
+// Returns a list of expressions that will compare the input interface index of traffic
+func CompareInputInterfaceIndex(index uint32) ([]expr.Any, error) {
+	return CompareInputInterfaceIndexWithRegister(index, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the input interface index of traffic, with a user defined register
+func CompareInputInterfaceIndexWithRegister(index uint32, reg uint32) ([]expr.Any, error) {
+	return compareInterfaceIndex(expr.MetaKeyIIF, index, reg)
+}
+
+// Returns a list of expressions that will compare the output interface index of traffic
+func CompareOutputInterfaceIndex(index uint32) ([]expr.Any, error) {
+	return CompareOutputInterfaceIndexWithRegister(index, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the output interface index of traffic, with a user defined register
+func CompareOutputInterfaceIndexWithRegister(index uint32, reg uint32) ([]expr.Any, error) {
+	return compareInterfaceIndex(expr.MetaKeyOIF, index, reg)
+}
+
+func compareInterfaceIndex(key expr.MetaKey, index uint32, reg uint32) ([]expr.Any, error) {
+	if index == 0 {
+		return []expr.Any{}, fmt.Errorf("interface index was 0")
+	}
+
+	return []expr.Any{
+		Meta(key, reg),
+		Equals(binaryutil.NativeEndian.PutUint32(index), reg),
+	}, nil
+}
+
+// Returns a list of expressions that will compare the input interface of traffic against a set of interface names or indexes
+func CompareInputInterfaceSet(set *nftables.Set) ([]expr.Any, error) {
+	return CompareInputInterfaceSetWithRegister(set, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the input interface of traffic against a set, with a user defined register
+func CompareInputInterfaceSetWithRegister(set *nftables.Set, reg uint32) ([]expr.Any, error) {
+	return compareInterfaceSet(expr.MetaKeyIIFNAME, expr.MetaKeyIIF, set, reg)
+}
+
+// Returns a list of expressions that will compare the output interface of traffic against a set of interface names or indexes
+func CompareOutputInterfaceSet(set *nftables.Set) ([]expr.Any, error) {
+	return CompareOutputInterfaceSetWithRegister(set, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the output interface of traffic against a set, with a user defined register
+func CompareOutputInterfaceSetWithRegister(set *nftables.Set, reg uint32) ([]expr.Any, error) {
+	return compareInterfaceSet(expr.MetaKeyOIFNAME, expr.MetaKeyOIF, set, reg)
+}
+
+func compareInterfaceSet(nameKey expr.MetaKey, indexKey expr.MetaKey, set *nftables.Set, reg uint32) ([]expr.Any, error) {
+	var key expr.MetaKey
+	switch set.KeyType {
+	case nftables.TypeIFName:
+		key = nameKey
+	case nftables.TypeIFIndex:
+		key = indexKey
+	default:
+		return []expr.Any{}, fmt.Errorf("unsupported set key type %v", set.KeyType.Name)
+	}
+
+	return []expr.Any{Meta(key, reg), SetLookUp(set, reg)}, nil
+}
+
+// Returns a list of expressions that will compare the ICMP or ICMPv6 type of traffic
+func CompareICMPType(icmpType uint8) ([]expr.Any, error) {
+	return CompareICMPTypeWithRegister(icmpType, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the ICMP or ICMPv6 type of traffic, with a user defined register
+func CompareICMPTypeWithRegister(icmpType uint8, reg uint32) ([]expr.Any, error) {
+	return []expr.Any{
+		ICMPType(reg),
+		Equals([]byte{icmpType}, reg),
+	}, nil
+}
+
+// Returns a list of expressions that will compare the ICMP or ICMPv6 code of traffic
+func CompareICMPCode(code uint8) ([]expr.Any, error) {
+	return CompareICMPCodeWithRegister(code, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the ICMP or ICMPv6 code of traffic, with a user defined register
+func CompareICMPCodeWithRegister(code uint8, reg uint32) ([]expr.Any, error) {
+	return []expr.Any{
+		ICMPCode(reg),
+		Equals([]byte{code}, reg),
+	}, nil
+}
+
+// Returns a list of expressions that will compare the ICMP or ICMPv6 type of traffic against a set
+func CompareICMPTypeSet(set *nftables.Set) ([]expr.Any, error) {
+	return CompareICMPTypeSetWithRegister(set, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the ICMP or ICMPv6 type of traffic against a set, with a user defined register
+func CompareICMPTypeSetWithRegister(set *nftables.Set, reg uint32) ([]expr.Any, error) {
+	switch set.KeyType {
+	case nftables.TypeICMPType, nftables.TypeICMP6Type:
+	default:
+		return []expr.Any{}, fmt.Errorf("unsupported set key type %v", set.KeyType.Name)
+	}
+
+	return []expr.Any{ICMPType(reg), SetLookUp(set, reg)}, nil
+}
+
+// Returns a list of expressions that will compare the TCP flags of traffic, only the flags in `mask` are compared and
+// they have to be equal to `value` (ex. mask `TCPFlagSYN | TCPFlagACK` and value `TCPFlagSYN` for SYN without ACK)
+func CompareTCPFlags(mask uint8, value uint8) ([]expr.Any, error) {
+	return CompareTCPFlagsWithRegister(mask, value, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the TCP flags of traffic, with a user defined register
+func CompareTCPFlagsWithRegister(mask uint8, value uint8, reg uint32) ([]expr.Any, error) {
+	if mask == 0 {
+		return []expr.Any{}, fmt.Errorf("invalid tcp flags mask, mask cannot be empty")
+	}
+
+	if value&^mask != 0 {
+		return []expr.Any{}, fmt.Errorf("invalid tcp flags value %#x, it has flags outside of mask %#x", value, mask)
+	}
+
+	// comparing every flag doesn't need the mask applied
+	if mask == 0xff {
+		return []expr.Any{
+			TCPFlags(reg),
+			Equals([]byte{value}, reg),
+		}, nil
+	}
+
+	return []expr.Any{
+		TCPFlags(reg),
+		BitwiseWithRegisters(reg, reg, TCPFlagsLen, []byte{mask}, []byte{0x0}),
+		Equals([]byte{value}, reg),
+	}, nil
+}
+
+// Returns a range comparison expression, from and to are inclusive
+func InRange(from []byte, to []byte, reg uint32) *expr.Range {
+	return &expr.Range{
+		Op:       expr.CmpOpEq,
+		Register: reg,
+		FromData: from,
+		ToData:   to,
+	}
+}
+
+// Returns a list of expressions that will compare the source port of traffic against an inclusive range
+func CompareSourcePortRange(start uint16, end uint16) ([]expr.Any, error) {
+	return CompareSourcePortRangeWithRegister(start, end, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the source port of traffic against an inclusive range, with a user defined register
+func CompareSourcePortRangeWithRegister(start uint16, end uint16, reg uint32) ([]expr.Any, error) {
+	if err := utils.ValidatePortRange(start, end); err != nil {
+		return []expr.Any{}, err
+	}
+
+	return []expr.Any{
+		SourcePort(reg),
+		InRange(binaryutil.BigEndian.PutUint16(start), binaryutil.BigEndian.PutUint16(end), reg),
+	}, nil
+}
+
+// Returns a list of expressions that will compare the destination port of traffic against an inclusive range
+func CompareDestinationPortRange(start uint16, end uint16) ([]expr.Any, error) {
+	return CompareDestinationPortRangeWithRegister(start, end, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the destination port of traffic against an inclusive range, with a user defined register
+func CompareDestinationPortRangeWithRegister(start uint16, end uint16, reg uint32) ([]expr.Any, error) {
+	if err := utils.ValidatePortRange(start, end); err != nil {
+		return []expr.Any{}, err
+	}
+
+	return []expr.Any{
+		DestinationPort(reg),
+		InRange(binaryutil.BigEndian.PutUint16(start), binaryutil.BigEndian.PutUint16(end), reg),
+	}, nil
+}
+
+// Returns a list of expressions that will compare the source address of traffic against a prefix
+func CompareSourcePrefix(prefix netip.Prefix) ([]expr.Any, error) {
+	return CompareSourcePrefixWithRegister(prefix, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the source address of traffic against a prefix, with a user defined register
+func CompareSourcePrefixWithRegister(prefix netip.Prefix, reg uint32) ([]expr.Any, error) {
+	if err := utils.ValidatePrefix(prefix); err != nil {
+		return []expr.Any{}, err
+	}
+
+	if prefix.Addr().Is4() {
+		return comparePrefix(IPv4SourceAddress(reg), prefix, reg), nil
+	}
+
+	return comparePrefix(IPv6SourceAddress(reg), prefix, reg), nil
+}
+
+// Returns a list of expressions that will compare the destination address of traffic against a prefix
+func CompareDestinationPrefix(prefix netip.Prefix) ([]expr.Any, error) {
+	return CompareDestinationPrefixWithRegister(prefix, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the destination address of traffic against a prefix, with a user defined register
+func CompareDestinationPrefixWithRegister(prefix netip.Prefix, reg uint32) ([]expr.Any, error) {
+	if err := utils.ValidatePrefix(prefix); err != nil {
+		return []expr.Any{}, err
+	}
+
+	if prefix.Addr().Is4() {
+		return comparePrefix(IPv4DestinationAddress(reg), prefix, reg), nil
+	}
+
+	return comparePrefix(IPv6DestinationAddress(reg), prefix, reg), nil
+}
+
+func comparePrefix(addr *expr.Payload, prefix netip.Prefix, reg uint32) []expr.Any {
+	prefix = prefix.Masked()
+
+	// a full length prefix is a single address and doesn't need the mask applied
+	if prefix.IsSingleIP() {
+		return []expr.Any{addr, Equals(prefix.Addr().AsSlice(), reg)}
+	}
+
+	mask := make([]byte, addr.Len)
+	for i := 0; i < prefix.Bits(); i++ {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+
+	return []expr.Any{
+		addr,
+		BitwiseWithRegisters(reg, reg, addr.Len, mask, make([]byte, addr.Len)),
+		Equals(prefix.Addr().AsSlice(), reg),
+	}
+}
+
+// Returns a dynamic set update expression, it adds the key in reg to the set or refreshes its timeout if it's already
+// there. The expressions, like a limit or counter, are attached to each element so they apply per key. A timeout of 0
+// uses the timeout of the set.
+func DynamicSetUpdate(set *nftables.Set, timeout time.Duration, exprs []expr.Any, reg uint32) *expr.Dynset {
+	return &expr.Dynset{
+		SrcRegKey: reg,
+		SetName:   set.Name,
+		SetID:     set.ID,
+		Operation: unix.NFT_DYNSET_OP_UPDATE,
+		Timeout:   timeout,
+		Exprs:     exprs,
+	}
+}
+
+// Returns a dynamic set add expression, it adds the key in reg to the set if it isn't there yet. The expressions are
+// attached to each element like with DynamicSetUpdate but an element that's already there is left as it is.
+func DynamicSetAdd(set *nftables.Set, exprs []expr.Any, reg uint32) *expr.Dynset {
+	return &expr.Dynset{
+		SrcRegKey: reg,
+		SetName:   set.Name,
+		SetID:     set.ID,
+		Operation: unix.NFT_DYNSET_OP_ADD,
+		Exprs:     exprs,
+	}
+}
+
+// Returns a list of expressions that meter the source address of traffic in a dynamic set, the equivalent of
+// `update @set { ip saddr limit rate over 10/minute }` in nft
+func MeterSourceAddress(set *nftables.Set, timeout time.Duration, exprs ...expr.Any) ([]expr.Any, error) {
+	return MeterSourceAddressWithRegister(set, timeout, defaultRegister, exprs...)
+}
+
+// Returns a list of expressions that meter the source address of traffic in a dynamic set, with a user defined register
+func MeterSourceAddressWithRegister(set *nftables.Set, timeout time.Duration, reg uint32, exprs ...expr.Any) ([]expr.Any, error) {
+	srcAddr, err := sourceAddressForSet(set, reg)
+	if err != nil {
+		return []expr.Any{}, err
+	}
+
+	return meter(set, srcAddr, DynamicSetUpdate(set, timeout, exprs, reg))
+}
+
+// Returns a list of expressions that meter the destination address of traffic in a dynamic set
+func MeterDestinationAddress(set *nftables.Set, timeout time.Duration, exprs ...expr.Any) ([]expr.Any, error) {
+	return MeterDestinationAddressWithRegister(set, timeout, defaultRegister, exprs...)
+}
+
+// Returns a list of expressions that meter the destination address of traffic in a dynamic set, with a user defined register
+func MeterDestinationAddressWithRegister(set *nftables.Set, timeout time.Duration, reg uint32, exprs ...expr.Any) ([]expr.Any, error) {
+	var dstAddr *expr.Payload
+	switch set.KeyType {
+	case nftables.TypeIPAddr:
+		dstAddr = IPv4DestinationAddress(reg)
+	case nftables.TypeIP6Addr:
+		dstAddr = IPv6DestinationAddress(reg)
+	default:
+		return []expr.Any{}, fmt.Errorf("unsupported set key type %v", set.KeyType.Name)
+	}
+
+	return meter(set, dstAddr, DynamicSetUpdate(set, timeout, exprs, reg))
+}
+
+// the kernel allows at most two expressions per set element (NFT_SET_EXPR_MAX)
+const maxMeterExprs = 2
+
+// sourceAddressForSet returns the payload expression that loads the source address of the family of the set key
+func sourceAddressForSet(set *nftables.Set, reg uint32) (*expr.Payload, error) {
+	switch set.KeyType {
+	case nftables.TypeIPAddr:
+		return IPv4SourceAddress(reg), nil
+	case nftables.TypeIP6Addr:
+		return IPv6SourceAddress(reg), nil
+	default:
+		return nil, fmt.Errorf("unsupported set key type %v", set.KeyType.Name)
+	}
+}
+
+// meter checks the dynamic set expression can be used with the set and returns it along with the expression that
+// loads its key
+func meter(set *nftables.Set, key *expr.Payload, dynset *expr.Dynset) ([]expr.Any, error) {
+	if !set.Dynamic {
+		return []expr.Any{}, fmt.Errorf("set %v is not dynamic", set.Name)
+	}
+
+	if set.Interval {
+		return []expr.Any{}, fmt.Errorf("set %v is an interval set, dynamic updates need single elements", set.Name)
+	}
+
+	if dynset.Timeout > 0 && !set.HasTimeout {
+		return []expr.Any{}, fmt.Errorf("set %v doesn't support timeouts", set.Name)
+	}
+
+	if len(dynset.Exprs) > maxMeterExprs {
+		return []expr.Any{}, fmt.Errorf("too many meter expressions, %v > %v", len(dynset.Exprs), maxMeterExprs)
+	}
+
+	for _, e := range dynset.Exprs {
+		switch e.(type) {
+		case *expr.Counter, *expr.Limit, *expr.Quota:
+		case *expr.Connlimit:
+			// elements with a connection limit are removed once their connections are gone, the kernel refuses
+			// timeouts for them
+			if set.HasTimeout || dynset.Timeout > 0 {
+				return []expr.Any{}, fmt.Errorf("set %v has a timeout, connection limits can't be used with one", set.Name)
+			}
+		default:
+			return []expr.Any{}, fmt.Errorf("unsupported meter expression %T", e)
+		}
+	}
+
+	return []expr.Any{key, dynset}, nil
+}
+
+// Returns a list of expressions that will compare the packet mark of traffic, only the bits in mask are compared
+func CompareMark(value uint32, mask uint32) ([]expr.Any, error) {
+	return CompareMarkWithRegister(value, mask, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the packet mark of traffic, with a user defined register
+func CompareMarkWithRegister(value uint32, mask uint32, reg uint32) ([]expr.Any, error) {
+	return compareMark(Meta(expr.MetaKeyMARK, reg), value, mask, reg)
+}
+
+// Returns a list of expressions that will compare the connection mark of traffic, only the bits in mask are compared
+func CompareConnectionMark(value uint32, mask uint32) ([]expr.Any, error) {
+	return CompareConnectionMarkWithRegister(value, mask, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the connection mark of traffic, with a user defined register
+func CompareConnectionMarkWithRegister(value uint32, mask uint32, reg uint32) ([]expr.Any, error) {
+	return compareMark(&expr.Ct{Key: expr.CtKeyMARK, Register: reg}, value, mask, reg)
+}
+
+func compareMark(load expr.Any, value uint32, mask uint32, reg uint32) ([]expr.Any, error) {
+	if err := validateMark(value, mask); err != nil {
+		return []expr.Any{}, err
+	}
+
+	// marks are in host byte order
+	if mask == math.MaxUint32 {
+		return []expr.Any{load, Equals(binaryutil.NativeEndian.PutUint32(value), reg)}, nil
+	}
+
+	return []expr.Any{
+		load,
+		BitwiseWithRegisters(reg, reg, 4, binaryutil.NativeEndian.PutUint32(mask), binaryutil.NativeEndian.PutUint32(0)),
+		Equals(binaryutil.NativeEndian.PutUint32(value), reg),
+	}, nil
+}
+
+// Returns a list of expressions that set the packet mark of traffic, only the bits in mask are changed, the equivalent
+// of `meta mark set meta mark and ~mask or value` in nft
+func SetMark(value uint32, mask uint32) ([]expr.Any, error) {
+	return SetMarkWithRegister(value, mask, defaultRegister)
+}
+
+// Returns a list of expressions that set the packet mark of traffic, with a user defined register
+func SetMarkWithRegister(value uint32, mask uint32, reg uint32) ([]expr.Any, error) {
+	return setMark(
+		Meta(expr.MetaKeyMARK, reg),
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: reg},
+		value, mask, reg,
+	)
+}
+
+// Returns a list of expressions that set the connection mark of traffic, only the bits in mask are changed
+func SetConnectionMark(value uint32, mask uint32) ([]expr.Any, error) {
+	return SetConnectionMarkWithRegister(value, mask, defaultRegister)
+}
+
+// Returns a list of expressions that set the connection mark of traffic, with a user defined register
+func SetConnectionMarkWithRegister(value uint32, mask uint32, reg uint32) ([]expr.Any, error) {
+	return setMark(
+		&expr.Ct{Key: expr.CtKeyMARK, Register: reg},
+		&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: reg},
+		value, mask, reg,
+	)
+}
+
+func setMark(load expr.Any, store expr.Any, value uint32, mask uint32, reg uint32) ([]expr.Any, error) {
+	if err := validateMark(value, mask); err != nil {
+		return []expr.Any{}, err
+	}
+
+	if mask == math.MaxUint32 {
+		return []expr.Any{
+			&expr.Immediate{Register: reg, Data: binaryutil.NativeEndian.PutUint32(value)},
+			store,
+		}, nil
+	}
+
+	// keep the bits outside of the mask and set the ones inside it to value
+	return []expr.Any{
+		load,
+		BitwiseWithRegisters(reg, reg, 4, binaryutil.NativeEndian.PutUint32(^mask), binaryutil.NativeEndian.PutUint32(value)),
+		store,
+	}, nil
+}
+
+func validateMark(value uint32, mask uint32) error {
+	if mask == 0 {
+		return fmt.Errorf("mark mask was 0")
+	}
+
+	if value&^mask != 0 {
+		return fmt.Errorf("mark %#x has bits outside of mask %#x", value, mask)
+	}
+
+	return nil
+}
+
+// Returns a list of expressions that copy the packet mark of traffic to its connection mark, the equivalent of
+// `ct mark set meta mark` in nft
+func SaveMark() []expr.Any {
+	return SaveMarkWithRegister(defaultRegister)
+}
+
+// Returns a list of expressions that copy the packet mark of traffic to its connection mark, with a user defined
+// register
+func SaveMarkWithRegister(reg uint32) []expr.Any {
+	return []expr.Any{
+		Meta(expr.MetaKeyMARK, reg),
+		&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: reg},
+	}
+}
+
+// Returns a list of expressions that copy the connection mark of traffic to its packet mark, the equivalent of
+// `meta mark set ct mark` in nft
+func RestoreMark() []expr.Any {
+	return RestoreMarkWithRegister(defaultRegister)
+}
+
+// Returns a list of expressions that copy the connection mark of traffic to its packet mark, with a user defined
+// register
+func RestoreMarkWithRegister(reg uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeyMARK, Register: reg},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: reg},
+	}
+}
+
+// Returns a list of expressions that will compare the user ID of the socket that sent traffic, only locally generated
+// traffic has one
+func CompareSocketUID(uid uint32) []expr.Any {
+	return CompareSocketUIDWithRegister(uid, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the user ID of the socket that sent traffic, with a user defined
+// register
+func CompareSocketUIDWithRegister(uid uint32, reg uint32) []expr.Any {
+	return []expr.Any{
+		Meta(expr.MetaKeySKUID, reg),
+		Equals(binaryutil.NativeEndian.PutUint32(uid), reg),
+	}
+}
+
+// Returns a list of expressions that will compare the group ID of the socket that sent traffic, only locally generated
+// traffic has one
+func CompareSocketGID(gid uint32) []expr.Any {
+	return CompareSocketGIDWithRegister(gid, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the group ID of the socket that sent traffic, with a user defined
+// register
+func CompareSocketGIDWithRegister(gid uint32, reg uint32) []expr.Any {
+	return []expr.Any{
+		Meta(expr.MetaKeySKGID, reg),
+		Equals(binaryutil.NativeEndian.PutUint32(gid), reg),
+	}
+}
+
+// the deepest cgroup level the kernel's socket expression supports
+const maxCgroupV2Level = 255
+
+// Returns a list of expressions that will compare the cgroup v2 ancestor at level of the socket that sent traffic to
+// the cgroup with id, see utils.ResolveCgroupV2
+func CompareSocketCgroupV2(id uint64, level uint32) ([]expr.Any, error) {
+	return CompareSocketCgroupV2WithRegister(id, level, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the cgroup v2 ancestor at level of the socket that sent traffic, with
+// a user defined register
+func CompareSocketCgroupV2WithRegister(id uint64, level uint32, reg uint32) ([]expr.Any, error) {
+	if id == 0 {
+		return []expr.Any{}, fmt.Errorf("cgroup id was 0")
+	}
+
+	if level == 0 || level > maxCgroupV2Level {
+		return []expr.Any{}, fmt.Errorf("invalid cgroup level %v", level)
+	}
+
+	return []expr.Any{
+		&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: level, Register: reg},
+		Equals(binaryutil.NativeEndian.PutUint64(id), reg),
+	}, nil
+}
+
+// Returns a fib expression that looks up the route of traffic with the fields in flags (ex.
+// `FibSourceAddress|FibInputInterface`) and loads result into the register
+func Fib(flags uint32, result uint32) (*expr.Fib, error) {
+	return FibWithRegister(flags, result, defaultRegister)
+}
+
+// Returns a fib expression that looks up the route of traffic, with a user defined register
+func FibWithRegister(flags uint32, result uint32, reg uint32) (*expr.Fib, error) {
+	if flags&^(FibSourceAddress|FibDestinationAddress|FibMark|FibInputInterface|FibOutputInterface) != 0 {
+		return &expr.Fib{}, fmt.Errorf("invalid fib flags %#x", flags)
+	}
+
+	if (flags&FibSourceAddress != 0) == (flags&FibDestinationAddress != 0) {
+		return &expr.Fib{}, fmt.Errorf("fib lookup requires exactly one of the source and destination address")
+	}
+
+	if flags&FibInputInterface != 0 && flags&FibOutputInterface != 0 {
+		return &expr.Fib{}, fmt.Errorf("fib lookup can't use both the input and output interface")
+	}
+
+	e := &expr.Fib{
+		Register:  reg,
+		FlagSADDR: flags&FibSourceAddress != 0,
+		FlagDADDR: flags&FibDestinationAddress != 0,
+		FlagMARK:  flags&FibMark != 0,
+		FlagIIF:   flags&FibInputInterface != 0,
+		FlagOIF:   flags&FibOutputInterface != 0,
+	}
+
+	switch result {
+	case FibResultOutputInterface:
+		e.ResultOIF = true
+	case FibResultOutputInterfaceName:
+		e.ResultOIFNAME = true
+	case FibResultAddressType:
+		e.ResultADDRTYPE = true
+	default:
+		return &expr.Fib{}, fmt.Errorf("invalid fib result %v", result)
+	}
+
+	return e, nil
+}
+
+// Returns a list of expressions that will compare the address type of the route of traffic looked up with the fields
+// in flags, the equivalent of `fib daddr type local` in nft for `CompareFibAddressType(FibDestinationAddress,
+// FibAddressTypeLocal)`
+func CompareFibAddressType(flags uint32, addrType uint32) ([]expr.Any, error) {
+	return CompareFibAddressTypeWithRegister(flags, addrType, defaultRegister)
+}
+
+// Returns a list of expressions that will compare the address type of the route of traffic, with a user defined
+// register
+func CompareFibAddressTypeWithRegister(flags uint32, addrType uint32, reg uint32) ([]expr.Any, error) {
+	if addrType > unix.RTN_MAX {
+		return []expr.Any{}, fmt.Errorf("invalid address type %v", addrType)
+	}
+
+	fib, err := FibWithRegister(flags, FibResultAddressType, reg)
+	if err != nil {
+		return []expr.Any{}, err
+	}
+
+	return []expr.Any{fib, Equals(binaryutil.NativeEndian.PutUint32(addrType), reg)}, nil
+}
+
+// Returns a list of expressions that match traffic that fails a strict reverse path check, traffic with a source
+// address the host has no route back to through the interface it came in on, the equivalent of
+// `fib saddr . mark . iif oif missing` in nft. The mark is part of the lookup so policy routing is taken into account
+func ReversePathFilter() []expr.Any {
+	return ReversePathFilterWithRegister(defaultRegister)
+}
+
+// Returns a list of expressions that match traffic that fails a strict reverse path check, with a user defined
+// register
+func ReversePathFilterWithRegister(reg uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Fib{
+			Register:  reg,
+			ResultOIF: true,
+			FlagSADDR: true,
+			FlagMARK:  true,
+			FlagIIF:   true,
+		},
+		// no output interface, the lookup didn't find a route
+		Equals([]byte{0x0, 0x0, 0x0, 0x0}, reg),
+	}
+}
+
+// Returns a list of expressions that limit the connections of each source address of traffic with a dynamic set, the
+// equivalent of `add @set { ip saddr ct count over 10 }` in nft. The set can't have a timeout, elements are removed
+// once their connections are gone
+func ConnLimitSourceAddress(set *nftables.Set, count uint32, inverted bool) ([]expr.Any, error) {
+	return ConnLimitSourceAddressWithRegister(set, count, inverted, defaultRegister)
+}
+
+// Returns a list of expressions that limit the connections of each source address of traffic with a dynamic set, with
+// a user defined register
+func ConnLimitSourceAddressWithRegister(set *nftables.Set, count uint32, inverted bool, reg uint32) ([]expr.Any, error) {
+	connlimit, err := ConnLimit(count, inverted)
+	if err != nil {
+		return []expr.Any{}, err
+	}
+
+	srcAddr, err := sourceAddressForSet(set, reg)
+	if err != nil {
+		return []expr.Any{}, err
+	}
+
+	return meter(set, srcAddr, DynamicSetAdd(set, []expr.Any{connlimit}, reg))
+}
+
+// NFT_REG_SIZE, the most data a payload comparison can load into a register
+const maxPayloadLen = 16
+
+// Returns a list of expressions that will compare length bytes of traffic at offset from base with value using op,
+// only the bits in mask are compared unless it's nil. Multi-byte fields are in network byte order so comparisons other
+// than equality work on them as numbers
+func ComparePayload(base expr.PayloadBase, offset uint32, length uint32, mask []byte, value []byte, op expr.CmpOp) ([]expr.Any, error) {
+	return ComparePayloadWithRegister(base, offset, length, mask, value, op, defaultRegister)
+}
+
+// Returns a list of expressions that will compare length bytes of traffic at offset from base, with a user defined
+// register
+func ComparePayloadWithRegister(base expr.PayloadBase, offset uint32, length uint32, mask []byte, value []byte, op expr.CmpOp, reg uint32) ([]expr.Any, error) {
+	switch base {
+	case expr.PayloadBaseLLHeader, expr.PayloadBaseNetworkHeader, expr.PayloadBaseTransportHeader:
+	default:
+		return []expr.Any{}, fmt.Errorf("invalid payload base %v", base)
+	}
+
+	if err := validatePayload(length, mask, value); err != nil {
+		return []expr.Any{}, err
+	}
+
+	switch op {
+	case expr.CmpOpEq, expr.CmpOpNeq, expr.CmpOpLt, expr.CmpOpLte, expr.CmpOpGt, expr.CmpOpGte:
+	default:
+		return []expr.Any{}, fmt.Errorf("invalid comparison operator %v", op)
+	}
+
+	exprs := []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         base,
+			Offset:       offset,
+			Len:          length,
+		},
+	}
+
+	if mask != nil {
+		exprs = append(exprs, BitwiseWithRegisters(reg, reg, length, mask, make([]byte, length)))
+	}
+
+	return append(exprs, &expr.Cmp{Op: op, Register: reg, Data: value}), nil
+}
+
+// Returns a list of expressions that will write value to length bytes of traffic at offset from base, only the bits in
+// mask are written unless it's nil. The checksum of csumType at csumOffset from base is updated along with it, the IPv4
+// header checksum is at IPv4ChecksumOffset, and csumFlags of unix.NFT_PAYLOAD_L4CSUM_PSEUDOHDR updates the transport
+// checksum too for fields in its pseudo-header. Checksums are summed over 16 bit words, a field covered by one that
+// doesn't start and end on a word boundary has to be widened to one that does with mask keeping the bytes around it
+func SetPayload(base expr.PayloadBase, offset uint32, length uint32, mask []byte, value []byte, csumType expr.PayloadCsumType, csumOffset uint32, csumFlags uint32) ([]expr.Any, error) {
+	return SetPayloadWithRegister(base, offset, length, mask, value, csumType, csumOffset, csumFlags, defaultRegister)
+}
+
+// Returns a list of expressions that will write value to length bytes of traffic at offset from base, with a user
+// defined register
+func SetPayloadWithRegister(base expr.PayloadBase, offset uint32, length uint32, mask []byte, value []byte, csumType expr.PayloadCsumType, csumOffset uint32, csumFlags uint32, reg uint32) ([]expr.Any, error) {
+	switch base {
+	case expr.PayloadBaseLLHeader, expr.PayloadBaseNetworkHeader, expr.PayloadBaseTransportHeader:
+	default:
+		return []expr.Any{}, fmt.Errorf("invalid payload base %v", base)
+	}
+
+	if err := validatePayload(length, mask, value); err != nil {
+		return []expr.Any{}, err
+	}
+
+	switch csumType {
+	case expr.CsumTypeNone:
+		if csumOffset != 0 || csumFlags != 0 {
+			return []expr.Any{}, fmt.Errorf("checksum offset and flags require a checksum type")
+		}
+	case expr.CsumTypeInet:
+		if csumFlags&^unix.NFT_PAYLOAD_L4CSUM_PSEUDOHDR != 0 {
+			return []expr.Any{}, fmt.Errorf("invalid checksum flags %#x", csumFlags)
+		}
+	default:
+		return []expr.Any{}, fmt.Errorf("invalid checksum type %v", csumType)
+	}
+
+	write := &expr.Payload{
+		OperationType:  expr.PayloadWrite,
+		SourceRegister: reg,
+		Base:           base,
+		Offset:         offset,
+		Len:            length,
+		CsumType:       csumType,
+		CsumOffset:     csumOffset,
+		CsumFlags:      csumFlags,
+	}
+
+	if mask == nil {
+		return []expr.Any{&expr.Immediate{Register: reg, Data: value}, write}, nil
+	}
+
+	// keep the bits outside of the mask and set the ones inside it to value
+	keep := make([]byte, length)
+	for i := range mask {
+		keep[i] = ^mask[i]
+	}
+
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         base,
+			Offset:       offset,
+			Len:          length,
+		},
+		BitwiseWithRegisters(reg, reg, length, keep, value),
+		write,
+	}, nil
+}
+
+func validatePayload(length uint32, mask []byte, value []byte) error {
+	if length == 0 || length > maxPayloadLen {
+		return fmt.Errorf("invalid payload length %v", length)
+	}
+
+	if len(value) != int(length) {
+		return fmt.Errorf("payload value is %v bytes, expected %v", len(value), length)
+	}
+
+	if mask != nil && len(mask) != int(length) {
+		return fmt.Errorf("payload mask is %v bytes, expected %v", len(mask), length)
+	}
+
+	for i := range mask {
+		if value[i]&^mask[i] != 0 {
+			return fmt.Errorf("payload value %x has bits outside of mask %x", value, mask)
+		}
+	}
+
+	return nil
+}
+
+// Returns a list of expressions that will set the MSS option of TCP traffic to mss, the kernel only ever lowers it so
+// connections don't stall sending segments the path can't carry. Traffic without the option is left as it is
+func SetTCPMSS(mss uint16) ([]expr.Any, error) {
+	return SetTCPMSSWithRegister(mss, defaultRegister)
+}
+
+// Returns a list of expressions that will set the MSS option of TCP traffic to mss, with a user defined register
+func SetTCPMSSWithRegister(mss uint16, reg uint32) ([]expr.Any, error) {
+	if mss == 0 {
+		return []expr.Any{}, fmt.Errorf("mss was 0")
+	}
+
+	return []expr.Any{
+		&expr.Immediate{Register: reg, Data: binaryutil.BigEndian.PutUint16(mss)},
+		writeTCPMSS(reg),
+	}, nil
+}
+
+// Returns a list of expressions that will clamp the MSS option of TCP traffic to the MTU of its route, the equivalent
+// of `tcp option maxseg size set rt mtu` in nft. The route is only known after the routing decision so the kernel
+// only allows it on the forward, output and postrouting hooks
+func ClampTCPMSSToPMTU() []expr.Any {
+	return ClampTCPMSSToPMTUWithRegister(defaultRegister)
+}
+
+// Returns a list of expressions that will clamp the MSS option of TCP traffic to the MTU of its route, with a user
+// defined register
+func ClampTCPMSSToPMTUWithRegister(reg uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Rt{Register: reg, Key: expr.RtTCPMSS},
+		// the route MSS is loaded in host byte order
+		&expr.Byteorder{SourceRegister: reg, DestRegister: reg, Op: expr.ByteorderHton, Len: 2, Size: 2},
+		writeTCPMSS(reg),
+	}
+}
+
+// writeTCPMSS writes reg to the MSS option, the kernel updates the TCP checksum itself
+func writeTCPMSS(reg uint32) *expr.Exthdr {
+	return &expr.Exthdr{
+		SourceRegister: reg,
+		Type:           TCPOptionMSS,
+		Offset:         TCPOptionMSSOffset,
+		Len:            TCPOptionMSSLen,
+		Op:             expr.ExthdrOpTcpopt,
+	}
+}
@@ -3,8 +3,11 @@
 package expressions
 
 import (
+	"math"
 	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
@@ -202,3 +205,623 @@ func TestCompareCtStateWithRegisterInvalidInput(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, []expr.Any{}, res)
 }
+
+func TestCompareInterfaceName(t *testing.T) {
+	res, err := CompareInputInterfaceName("eth0")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 0x1}, res[0])
+	assert.Equal(t, &expr.Cmp{Op: 0x0, Register: 0x1, Data: []uint8{0x65, 0x74, 0x68, 0x30, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}}, res[1])
+
+	res, err = CompareOutputInterfaceName("eth0")
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 0x1}, res[0])
+
+	res, err = CompareInputInterfaceName("averyveryverylongname")
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestCompareInterfacePrefix(t *testing.T) {
+	res, err := CompareInputInterfacePrefix("eth")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 0x1}, res[0])
+	assert.Equal(t, &expr.Cmp{Op: 0x0, Register: 0x1, Data: []uint8{0x65, 0x74, 0x68}}, res[1])
+
+	res, err = CompareOutputInterfacePrefix("")
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestCompareInterfaceIndex(t *testing.T) {
+	res, err := CompareInputInterfaceIndex(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Meta{Key: expr.MetaKeyIIF, Register: 0x1}, res[0])
+	assert.Equal(t, &expr.Cmp{Op: 0x0, Register: 0x1, Data: binaryutil.NativeEndian.PutUint32(2)}, res[1])
+
+	res, err = CompareOutputInterfaceIndex(0)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestCompareInterfaceSet(t *testing.T) {
+	res, err := CompareInputInterfaceSet(&nftables.Set{Name: "testsets", KeyType: nftables.TypeIFName})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 0x1}, res[0])
+	assert.Equal(t, &expr.Lookup{SourceRegister: 0x1, SetName: "testsets"}, res[1])
+
+	res, err = CompareOutputInterfaceSet(&nftables.Set{Name: "testsets", KeyType: nftables.TypeIFIndex})
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Meta{Key: expr.MetaKeyOIF, Register: 0x1}, res[0])
+
+	res, err = CompareOutputInterfaceSet(&nftables.Set{Name: "testsets", KeyType: nftables.TypeIPAddr})
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestCompareICMP(t *testing.T) {
+	res, err := CompareICMPType(ICMPEchoRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: expr.PayloadBaseTransportHeader, Offset: 0x0, Len: 0x1}, res[0])
+	assert.Equal(t, &expr.Cmp{Op: 0x0, Register: 0x1, Data: []uint8{0x8}}, res[1])
+
+	res, err = CompareICMPCode(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: expr.PayloadBaseTransportHeader, Offset: 0x1, Len: 0x1}, res[0])
+	assert.Equal(t, &expr.Cmp{Op: 0x0, Register: 0x1, Data: []uint8{0x1}}, res[1])
+}
+
+func TestCompareICMPTypeSet(t *testing.T) {
+	res, err := CompareICMPTypeSet(&nftables.Set{Name: "testsets", KeyType: nftables.TypeICMP6Type})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: expr.PayloadBaseTransportHeader, Offset: 0x0, Len: 0x1}, res[0])
+	assert.Equal(t, &expr.Lookup{SourceRegister: 0x1, SetName: "testsets"}, res[1])
+
+	res, err = CompareICMPTypeSet(&nftables.Set{Name: "testsets", KeyType: nftables.TypeInetService})
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestCompareTCPFlags(t *testing.T) {
+	res, err := CompareTCPFlags(TCPFlagSYN|TCPFlagACK, TCPFlagSYN)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: expr.PayloadBaseTransportHeader, Offset: 0xd, Len: 0x1}, res[0])
+	assert.Equal(t, &expr.Bitwise{SourceRegister: 0x1, DestRegister: 0x1, Len: 0x1, Mask: []byte{0x12}, Xor: []byte{0x0}}, res[1])
+	assert.Equal(t, &expr.Cmp{Op: 0x0, Register: 0x1, Data: []uint8{0x2}}, res[2])
+
+	res, err = CompareTCPFlags(0xff, TCPFlagRST)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Cmp{Op: 0x0, Register: 0x1, Data: []uint8{0x4}}, res[1])
+}
+
+func TestCompareTCPFlagsInvalid(t *testing.T) {
+	res, err := CompareTCPFlags(0, 0)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+
+	res, err = CompareTCPFlags(TCPFlagSYN, TCPFlagACK)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestComparePortRange(t *testing.T) {
+	res, err := CompareDestinationPortRange(8000, 8080)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: 0x2, Offset: 0x2, Len: 0x2}, res[0])
+	assert.Equal(t, &expr.Range{Op: expr.CmpOpEq, Register: 0x1, FromData: []byte{0x1f, 0x40}, ToData: []byte{0x1f, 0x90}}, res[1])
+
+	res, err = CompareSourcePortRange(1024, 65535)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: 0x2, Offset: 0x0, Len: 0x2}, res[0])
+
+	res, err = CompareDestinationPortRange(8080, 8000)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestComparePrefix(t *testing.T) {
+	res, err := CompareSourcePrefix(netip.MustParsePrefix("198.51.100.7/20"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: 0x1, Offset: 0xc, Len: 0x4}, res[0])
+	assert.Equal(t, &expr.Bitwise{SourceRegister: 0x1, DestRegister: 0x1, Len: 0x4, Mask: []byte{0xff, 0xff, 0xf0, 0x0}, Xor: []byte{0x0, 0x0, 0x0, 0x0}}, res[1])
+	assert.Equal(t, &expr.Cmp{Op: 0x0, Register: 0x1, Data: []byte{0xc6, 0x33, 0x60, 0x0}}, res[2])
+
+	res, err = CompareDestinationPrefix(netip.MustParsePrefix("2001:db8::/33"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: 0x1, Offset: 0x18, Len: 0x10}, res[0])
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, res[1].(*expr.Bitwise).Mask)
+
+	res, err = CompareSourcePrefix(netip.MustParsePrefix("198.51.100.7/32"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+
+	res, err = CompareSourcePrefix(netip.Prefix{})
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestLimit(t *testing.T) {
+	limit, err := LimitPackets(10, expr.LimitTimeSecond, 20, false)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeSecond, Burst: 20}, limit)
+
+	limit, err = LimitBytes(1024, expr.LimitTimeMinute, 0, true)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Limit{Type: expr.LimitTypePktBytes, Rate: 1024, Unit: expr.LimitTimeMinute, Over: true}, limit)
+
+	limit, err = LimitPackets(0, expr.LimitTimeSecond, 0, false)
+	assert.Error(t, err)
+	assert.Equal(t, &expr.Limit{}, limit)
+
+	limit, err = LimitPackets(10, expr.LimitTime(2), 0, false)
+	assert.Error(t, err)
+	assert.Equal(t, &expr.Limit{}, limit)
+}
+
+func TestQuota(t *testing.T) {
+	quota, err := Quota(1<<20, true)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Quota{Bytes: 1 << 20, Over: true}, quota)
+
+	quota, err = Quota(0, false)
+	assert.Error(t, err)
+	assert.Equal(t, &expr.Quota{}, quota)
+}
+
+func TestMeterSourceAddress(t *testing.T) {
+	set := &nftables.Set{Name: "meter", KeyType: nftables.TypeIPAddr, Dynamic: true, HasTimeout: true}
+	limit := &expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeMinute, Over: true}
+
+	res, err := MeterSourceAddress(set, time.Minute, limit)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: 0x1, Offset: 0xc, Len: 0x4}, res[0])
+	assert.Equal(t, &expr.Dynset{SrcRegKey: 0x1, SetName: "meter", Operation: unix.NFT_DYNSET_OP_UPDATE, Timeout: time.Minute, Exprs: []expr.Any{limit}}, res[1])
+
+	res, err = MeterDestinationAddress(&nftables.Set{Name: "meter6", KeyType: nftables.TypeIP6Addr, Dynamic: true}, 0, &expr.Counter{})
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Payload{DestRegister: 0x1, Base: 0x1, Offset: 0x18, Len: 0x10}, res[0])
+}
+
+func TestMeterInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   *nftables.Set
+		exprs []expr.Any
+	}{
+		{"not dynamic", &nftables.Set{KeyType: nftables.TypeIPAddr}, nil},
+		{"interval", &nftables.Set{KeyType: nftables.TypeIPAddr, Dynamic: true, Interval: true, HasTimeout: true}, nil},
+		{"bad key type", &nftables.Set{KeyType: nftables.TypeInetService, Dynamic: true, HasTimeout: true}, nil},
+		{"too many exprs", &nftables.Set{KeyType: nftables.TypeIPAddr, Dynamic: true, HasTimeout: true}, []expr.Any{&expr.Counter{}, &expr.Counter{}, &expr.Counter{}}},
+		{"bad expr", &nftables.Set{KeyType: nftables.TypeIPAddr, Dynamic: true, HasTimeout: true}, []expr.Any{Accept()}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := MeterSourceAddress(test.set, time.Minute, test.exprs...)
+			assert.Error(t, err)
+			assert.Equal(t, []expr.Any{}, res)
+		})
+	}
+
+	// a timeout needs a set with timeouts
+	res, err := MeterSourceAddress(&nftables.Set{KeyType: nftables.TypeIPAddr, Dynamic: true}, time.Minute)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestConnLimit(t *testing.T) {
+	connlimit, err := ConnLimit(10, true)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Connlimit{Count: 10, Flags: expr.NFT_CONNLIMIT_F_INV}, connlimit)
+
+	connlimit, err = ConnLimit(0, true)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Connlimit{Flags: expr.NFT_CONNLIMIT_F_INV}, connlimit)
+
+	connlimit, err = ConnLimit(0, false)
+	assert.Error(t, err)
+	assert.Equal(t, &expr.Connlimit{}, connlimit)
+}
+
+func TestConnLimitSourceAddress(t *testing.T) {
+	set := &nftables.Set{Name: "connlimit", KeyType: nftables.TypeIP6Addr, Dynamic: true}
+
+	res, err := ConnLimitSourceAddress(set, 20, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Payload{DestRegister: 0x1, Base: 0x1, Offset: 0x8, Len: 0x10},
+		&expr.Dynset{SrcRegKey: 0x1, SetName: "connlimit", Operation: unix.NFT_DYNSET_OP_ADD, Exprs: []expr.Any{&expr.Connlimit{Count: 20, Flags: expr.NFT_CONNLIMIT_F_INV}}},
+	}, res)
+
+	// elements with connection limits are garbage collected, the kernel refuses timeouts
+	res, err = ConnLimitSourceAddress(&nftables.Set{Name: "timeout", KeyType: nftables.TypeIPAddr, Dynamic: true, HasTimeout: true}, 20, true)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+
+	res, err = MeterSourceAddress(&nftables.Set{Name: "timeout", KeyType: nftables.TypeIPAddr, Dynamic: true, HasTimeout: true}, 0, &expr.Connlimit{Count: 1})
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+
+	res, err = ConnLimitSourceAddress(&nftables.Set{Name: "static", KeyType: nftables.TypeIPAddr}, 20, true)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+
+	res, err = ConnLimitSourceAddress(set, 0, false)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestLog(t *testing.T) {
+	log, err := Log("fwtk drop: ", expr.LogLevelWarning)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Log{Key: 1<<unix.NFTA_LOG_LEVEL | 1<<unix.NFTA_LOG_PREFIX, Level: expr.LogLevelWarning, Data: []byte("fwtk drop: ")}, log)
+
+	log, err = Log("", expr.LogLevelInfo)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Log{Key: 1 << unix.NFTA_LOG_LEVEL, Level: expr.LogLevelInfo}, log)
+
+	log, err = Log("drop", expr.LogLevel(9))
+	assert.Error(t, err)
+	assert.Equal(t, &expr.Log{}, log)
+
+	log, err = Log(strings.Repeat("a", 128), expr.LogLevelInfo)
+	assert.Error(t, err)
+	assert.Equal(t, &expr.Log{}, log)
+
+	log, err = Log("drop\x00", expr.LogLevelInfo)
+	assert.Error(t, err)
+	assert.Equal(t, &expr.Log{}, log)
+}
+
+func TestNFLog(t *testing.T) {
+	log, err := NFLog(5, 128, "drop")
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Log{Key: 1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_SNAPLEN | 1<<unix.NFTA_LOG_PREFIX, Group: 5, Snaplen: 128, Data: []byte("drop")}, log)
+
+	log, err = NFLog(0, 0, "")
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Log{Key: 1 << unix.NFTA_LOG_GROUP}, log)
+
+	log, err = NFLog(1, 0, strings.Repeat("a", 200))
+	assert.Error(t, err)
+	assert.Equal(t, &expr.Log{}, log)
+}
+
+func TestNAT(t *testing.T) {
+	res, err := DNAT(netip.MustParseAddr("192.0.2.10"), 8080)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Immediate{Register: 0x1, Data: []byte{0xc0, 0x0, 0x2, 0xa}},
+		&expr.Immediate{Register: 0x2, Data: []byte{0x1f, 0x90}},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 0x1, RegProtoMin: 0x2, Specified: true},
+	}, res)
+
+	res, err = SNAT(netip.MustParseAddr("2001:db8::1"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Immediate{Register: 0x1, Data: netip.MustParseAddr("2001:db8::1").AsSlice()},
+		&expr.NAT{Type: expr.NATTypeSourceNAT, Family: unix.NFPROTO_IPV6, RegAddrMin: 0x1},
+	}, res)
+
+	res, err = DNAT(netip.Addr{}, 80)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestMasqueradeAndRedirect(t *testing.T) {
+	assert.Equal(t, &expr.Masq{}, Masquerade())
+
+	assert.Equal(t, []expr.Any{&expr.Redir{}}, Redirect(0))
+	assert.Equal(t, []expr.Any{
+		&expr.Immediate{Register: 0x1, Data: []byte{0x0, 0x35}},
+		&expr.Redir{RegisterProtoMin: 0x1, Flags: expr.NF_NAT_RANGE_PROTO_SPECIFIED},
+	}, Redirect(53))
+}
+
+func TestReject(t *testing.T) {
+	assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_TCP_RST}, RejectTCPReset())
+	assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 13}, RejectICMP(ICMPAdminProhibited))
+
+	reject, err := RejectICMPx(ICMPxAdminProhibited)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: 3}, reject)
+
+	reject, err = RejectICMPx(4)
+	assert.Error(t, err)
+	assert.Equal(t, &expr.Reject{}, reject)
+}
+
+func TestQueue(t *testing.T) {
+	queue, err := Queue(5, 1, expr.QueueFlagBypass)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Queue{Num: 5, Total: 1, Flag: expr.QueueFlagBypass}, queue)
+
+	queue, err = Queue(0, 4, expr.QueueFlagBypass|expr.QueueFlagFanout)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Queue{Num: 0, Total: 4, Flag: 0x3}, queue)
+
+	queue, err = Queue(65532, 4, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Queue{Num: 65532, Total: 4}, queue)
+}
+
+func TestQueueInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		start uint16
+		total uint16
+		flags expr.QueueFlag
+	}{
+		{"unknown flag", 1, 1, 0x4},
+		{"no queues", 1, 0, 0},
+		{"overflow", 65533, 4, 0},
+		{"fanout without range", 1, 1, expr.QueueFlagFanout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue, err := Queue(test.start, test.total, test.flags)
+			assert.Error(t, err)
+			assert.Equal(t, &expr.Queue{}, queue)
+		})
+	}
+}
+
+func TestMark(t *testing.T) {
+	res, err := CompareMark(0x1, math.MaxUint32)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0x1)},
+	}, res)
+
+	res, err = CompareConnectionMarkWithRegister(0x100, 0xff00, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 2},
+		&expr.Bitwise{SourceRegister: 2, DestRegister: 2, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(0xff00), Xor: []byte{0x0, 0x0, 0x0, 0x0}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 2, Data: binaryutil.NativeEndian.PutUint32(0x100)},
+	}, res)
+
+	res, err = SetMark(0x1, 0x1)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(0xfffffffe), Xor: binaryutil.NativeEndian.PutUint32(0x1)},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	}, res)
+
+	res, err = SetConnectionMark(0x2a, math.MaxUint32)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(0x2a)},
+		&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+	}, res)
+
+	assert.Equal(t, []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+	}, SaveMark())
+	assert.Equal(t, []expr.Any{
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	}, RestoreMark())
+}
+
+func TestMarkInvalid(t *testing.T) {
+	res, err := CompareMark(0x1, 0)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+
+	res, err = CompareConnectionMark(0x10, 0x1)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+
+	res, err = SetMark(0x100, 0xff)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestSocketOwner(t *testing.T) {
+	assert.Equal(t, []expr.Any{
+		&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(1000)},
+	}, CompareSocketUID(1000))
+
+	assert.Equal(t, []expr.Any{
+		&expr.Meta{Key: expr.MetaKeySKGID, Register: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 2, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}, CompareSocketGIDWithRegister(0, 2))
+}
+
+func TestSocketCgroupV2(t *testing.T) {
+	res, err := CompareSocketCgroupV2(4242, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: 2, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint64(4242)},
+	}, res)
+
+	res, err = CompareSocketCgroupV2(0, 1)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+
+	res, err = CompareSocketCgroupV2(4242, 0)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+
+	res, err = CompareSocketCgroupV2(4242, 256)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestFib(t *testing.T) {
+	fib, err := Fib(FibSourceAddress|FibMark|FibInputInterface, FibResultOutputInterface)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Fib{Register: 1, ResultOIF: true, FlagSADDR: true, FlagMARK: true, FlagIIF: true}, fib)
+
+	fib, err = FibWithRegister(FibDestinationAddress|FibOutputInterface, FibResultOutputInterfaceName, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, &expr.Fib{Register: 2, ResultOIFNAME: true, FlagDADDR: true, FlagOIF: true}, fib)
+
+	res, err := CompareFibAddressType(FibDestinationAddress, FibAddressTypeLocal)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Fib{Register: 1, ResultADDRTYPE: true, FlagDADDR: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+	}, res)
+
+	assert.Equal(t, []expr.Any{
+		&expr.Fib{Register: 1, ResultOIF: true, FlagSADDR: true, FlagMARK: true, FlagIIF: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x0, 0x0, 0x0, 0x0}},
+	}, ReversePathFilter())
+}
+
+func TestFibInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		flags  uint32
+		result uint32
+	}{
+		{"unknown flag", FibSourceAddress | 0x40, FibResultOutputInterface},
+		{"no address", FibInputInterface, FibResultOutputInterface},
+		{"both addresses", FibSourceAddress | FibDestinationAddress, FibResultOutputInterface},
+		{"both interfaces", FibSourceAddress | FibInputInterface | FibOutputInterface, FibResultOutputInterface},
+		{"unknown result", FibSourceAddress, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fib, err := Fib(test.flags, test.result)
+			assert.Error(t, err)
+			assert.Equal(t, &expr.Fib{}, fib)
+		})
+	}
+
+	res, err := CompareFibAddressType(FibDestinationAddress, 12)
+	assert.Error(t, err)
+	assert.Equal(t, []expr.Any{}, res)
+}
+
+func TestComparePayload(t *testing.T) {
+	res, err := ComparePayload(expr.PayloadBaseNetworkHeader, IPv4TTLOffset, IPv4TTLLen, nil, []byte{0x1}, expr.CmpOpLte)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Payload{DestRegister: 0x1, Base: expr.PayloadBaseNetworkHeader, Offset: 0x8, Len: 0x1},
+		&expr.Cmp{Op: expr.CmpOpLte, Register: 0x1, Data: []byte{0x1}},
+	}, res)
+
+	res, err = ComparePayloadWithRegister(expr.PayloadBaseTransportHeader, UDPHeaderLen, 2, []byte{0xff, 0xf0}, []byte{0x12, 0x30}, expr.CmpOpEq, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Payload{DestRegister: 0x2, Base: expr.PayloadBaseTransportHeader, Offset: 0x8, Len: 0x2},
+		&expr.Bitwise{SourceRegister: 0x2, DestRegister: 0x2, Len: 0x2, Mask: []byte{0xff, 0xf0}, Xor: []byte{0x0, 0x0}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 0x2, Data: []byte{0x12, 0x30}},
+	}, res)
+}
+
+func TestComparePayloadInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   expr.PayloadBase
+		length uint32
+		mask   []byte
+		value  []byte
+		op     expr.CmpOp
+	}{
+		{"bad base", expr.PayloadBase(7), 1, nil, []byte{0x1}, expr.CmpOpEq},
+		{"zero length", expr.PayloadBaseNetworkHeader, 0, nil, []byte{}, expr.CmpOpEq},
+		{"too long", expr.PayloadBaseNetworkHeader, 17, nil, make([]byte, 17), expr.CmpOpEq},
+		{"value length", expr.PayloadBaseNetworkHeader, 2, nil, []byte{0x1}, expr.CmpOpEq},
+		{"mask length", expr.PayloadBaseNetworkHeader, 2, []byte{0xff}, []byte{0x1, 0x2}, expr.CmpOpEq},
+		{"value outside mask", expr.PayloadBaseNetworkHeader, 1, []byte{0xf0}, []byte{0x1}, expr.CmpOpEq},
+		{"bad op", expr.PayloadBaseNetworkHeader, 1, nil, []byte{0x1}, expr.CmpOp(9)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := ComparePayload(test.base, 0, test.length, test.mask, test.value, test.op)
+			assert.Error(t, err)
+			assert.Equal(t, []expr.Any{}, res)
+		})
+	}
+}
+
+func TestSetPayload(t *testing.T) {
+	res, err := SetPayload(expr.PayloadBaseNetworkHeader, IPv6HopLimitOffset, IPv6HopLimitLen, nil, []byte{0x40}, expr.CsumTypeNone, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Immediate{Register: 0x1, Data: []byte{0x40}},
+		&expr.Payload{OperationType: expr.PayloadWrite, SourceRegister: 0x1, Base: expr.PayloadBaseNetworkHeader, Offset: 0x7, Len: 0x1},
+	}, res)
+
+	res, err = SetPayloadWithRegister(expr.PayloadBaseNetworkHeader, 0, 2, []byte{0x00, 0xfc}, []byte{0x00, 0xb8}, expr.CsumTypeInet, IPv4ChecksumOffset, 0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Payload{DestRegister: 0x2, Base: expr.PayloadBaseNetworkHeader, Offset: 0x0, Len: 0x2},
+		&expr.Bitwise{SourceRegister: 0x2, DestRegister: 0x2, Len: 0x2, Mask: []byte{0xff, 0x03}, Xor: []byte{0x00, 0xb8}},
+		&expr.Payload{OperationType: expr.PayloadWrite, SourceRegister: 0x2, Base: expr.PayloadBaseNetworkHeader, Offset: 0x0, Len: 0x2, CsumType: expr.CsumTypeInet, CsumOffset: 0xa},
+	}, res)
+
+	// addresses are part of the transport pseudo-header
+	res, err = SetPayload(expr.PayloadBaseNetworkHeader, IPv4DstOffset, IPv4AddrLen, nil, []byte{0xa, 0x0, 0x0, 0x1}, expr.CsumTypeInet, IPv4ChecksumOffset, unix.NFT_PAYLOAD_L4CSUM_PSEUDOHDR)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(unix.NFT_PAYLOAD_L4CSUM_PSEUDOHDR), res[1].(*expr.Payload).CsumFlags)
+}
+
+func TestSetPayloadInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      expr.PayloadBase
+		length    uint32
+		mask      []byte
+		value     []byte
+		csumType  expr.PayloadCsumType
+		csumFlags uint32
+	}{
+		{"bad base", expr.PayloadBase(7), 1, nil, []byte{0x1}, expr.CsumTypeNone, 0},
+		{"zero length", expr.PayloadBaseNetworkHeader, 0, nil, []byte{}, expr.CsumTypeNone, 0},
+		{"value length", expr.PayloadBaseNetworkHeader, 2, nil, []byte{0x1}, expr.CsumTypeNone, 0},
+		{"value outside mask", expr.PayloadBaseNetworkHeader, 1, []byte{0xf0}, []byte{0x1}, expr.CsumTypeNone, 0},
+		{"bad checksum type", expr.PayloadBaseNetworkHeader, 1, nil, []byte{0x1}, expr.PayloadCsumType(5), 0},
+		{"bad checksum flags", expr.PayloadBaseNetworkHeader, 1, nil, []byte{0x1}, expr.CsumTypeInet, 0x2},
+		{"flags without checksum", expr.PayloadBaseNetworkHeader, 1, nil, []byte{0x1}, expr.CsumTypeNone, unix.NFT_PAYLOAD_L4CSUM_PSEUDOHDR},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := SetPayload(test.base, 0, test.length, test.mask, test.value, test.csumType, 0, test.csumFlags)
+			assert.Error(t, err)
+			assert.Equal(t, []expr.Any{}, res)
+		})
+	}
+}
+
+func TestTCPMSS(t *testing.T) {
+	write := &expr.Exthdr{SourceRegister: 0x1, Type: 0x2, Offset: 0x2, Len: 0x2, Op: expr.ExthdrOpTcpopt}
+
+	res, err := SetTCPMSS(1400)
+	assert.Nil(t, err)
+	assert.Equal(t, []expr.Any{&expr.Immediate{Register: 0x1, Data: []byte{0x05, 0x78}}, write}, res)
+
+	_, err = SetTCPMSS(0)
+	assert.Error(t, err)
+
+	assert.Equal(t, []expr.Any{
+		&expr.Rt{Register: 0x1, Key: expr.RtTCPMSS},
+		&expr.Byteorder{SourceRegister: 0x1, DestRegister: 0x1, Op: expr.ByteorderHton, Len: 0x2, Size: 0x2},
+		write,
+	}, ClampTCPMSSToPMTU())
+}
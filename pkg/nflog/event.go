@@ -0,0 +1,200 @@
+//go:build linux
+
+package nflog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/netlink"
+)
+
+// nfnetlink_log attribute types
+// https://git.netfilter.org/libnetfilter_log/tree/include/libnetfilter_log/linux_nfnetlink_log.h
+const (
+	attrPacketHdr  = 0x1
+	attrMark       = 0x2
+	attrTimestamp  = 0x3
+	attrIfIndexIn  = 0x4
+	attrIfIndexOut = 0x5
+	attrPayload    = 0x9
+	attrPrefix     = 0xa
+)
+
+const (
+	nfgenmsgLen  = 4
+	packetHdrLen = 4
+	timestampLen = 16
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+)
+
+// Event is a packet logged to an NFLOG group
+type Event struct {
+	// the prefix of the log rule, see rule.NFLog
+	Prefix string
+	// the ID of the rule that logged the packet, empty if it couldn't be correlated, see Conn.Correlate
+	RuleID []byte
+	// the netfilter hook the packet was logged from and its ethertype
+	Hook       uint8
+	HwProtocol uint16
+	Mark       uint32
+	// interface indexes, 0 if the packet didn't have one
+	InputInterface  uint32
+	OutputInterface uint32
+	// when the packet was received, if the kernel didn't include a timestamp it's when the event was decoded
+	Timestamp time.Time
+	// the packet from the network header on, up to the copy range
+	Payload []byte
+
+	// the 5-tuple of the packet, ports are 0 for protocols without them
+	SourceAddress      netip.Addr
+	DestinationAddress netip.Addr
+	Protocol           uint8
+	SourcePort         uint16
+	DestinationPort    uint16
+}
+
+// InputInterfaceName returns the name of the input interface, or an empty string if there isn't one
+func (e Event) InputInterfaceName() string {
+	return interfaceName(e.InputInterface)
+}
+
+// OutputInterfaceName returns the name of the output interface, or an empty string if there isn't one
+func (e Event) OutputInterfaceName() string {
+	return interfaceName(e.OutputInterface)
+}
+
+func interfaceName(index uint32) string {
+	if index == 0 {
+		return ""
+	}
+
+	iface, err := net.InterfaceByIndex(int(index))
+	if err != nil {
+		return ""
+	}
+
+	return iface.Name
+}
+
+// decodePacket decodes the data of a NFULNL_MSG_PACKET message, now is used when the kernel didn't include a timestamp
+func decodePacket(data []byte, now time.Time) (Event, error) {
+	if len(data) < nfgenmsgLen {
+		return Event{}, fmt.Errorf("message too short, %v < %v", len(data), nfgenmsgLen)
+	}
+
+	ad, err := netlink.NewAttributeDecoder(data[nfgenmsgLen:])
+	if err != nil {
+		return Event{}, err
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	event := Event{Timestamp: now}
+	for ad.Next() {
+		switch ad.Type() {
+		case attrPacketHdr:
+			hdr := ad.Bytes()
+			if len(hdr) < packetHdrLen {
+				return Event{}, fmt.Errorf("packet header too short, %v < %v", len(hdr), packetHdrLen)
+			}
+			event.HwProtocol = binary.BigEndian.Uint16(hdr[0:2])
+			event.Hook = hdr[2]
+		case attrMark:
+			event.Mark = ad.Uint32()
+		case attrTimestamp:
+			ts := ad.Bytes()
+			if len(ts) < timestampLen {
+				return Event{}, fmt.Errorf("timestamp too short, %v < %v", len(ts), timestampLen)
+			}
+			sec := binary.BigEndian.Uint64(ts[0:8])
+			usec := binary.BigEndian.Uint64(ts[8:16])
+			event.Timestamp = time.Unix(int64(sec), int64(usec)*int64(time.Microsecond))
+		case attrIfIndexIn:
+			event.InputInterface = ad.Uint32()
+		case attrIfIndexOut:
+			event.OutputInterface = ad.Uint32()
+		case attrPayload:
+			event.Payload = append([]byte{}, ad.Bytes()...)
+		case attrPrefix:
+			event.Prefix = ad.String()
+		}
+	}
+
+	if err := ad.Err(); err != nil {
+		return Event{}, err
+	}
+
+	if err := event.decodePayload(); err != nil {
+		return Event{}, err
+	}
+
+	return event, nil
+}
+
+// decodePayload fills in the 5-tuple from the payload
+func (e *Event) decodePayload() error {
+	if len(e.Payload) == 0 {
+		return nil
+	}
+
+	version := e.Payload[0] >> 4
+	switch e.HwProtocol {
+	case etherTypeIPv4:
+		version = 4
+	case etherTypeIPv6:
+		version = 6
+	}
+
+	// the IP header has to be intact, the transport header may have been cut off by the copy range or snaplen in
+	// which case the ports are left empty
+	var ip gopacket.DecodingLayer
+	switch version {
+	case 4:
+		ip4 := &layers.IPv4{}
+		if err := ip4.DecodeFromBytes(e.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return fmt.Errorf("error decoding ipv4 header: %v", err)
+		}
+		e.SourceAddress, _ = netip.AddrFromSlice(ip4.SrcIP.To4())
+		e.DestinationAddress, _ = netip.AddrFromSlice(ip4.DstIP.To4())
+		e.Protocol = uint8(ip4.Protocol)
+		ip = ip4
+	case 6:
+		ip6 := &layers.IPv6{}
+		if err := ip6.DecodeFromBytes(e.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return fmt.Errorf("error decoding ipv6 header: %v", err)
+		}
+		e.SourceAddress, _ = netip.AddrFromSlice(ip6.SrcIP.To16())
+		e.DestinationAddress, _ = netip.AddrFromSlice(ip6.DstIP.To16())
+		e.Protocol = uint8(ip6.NextHeader)
+		ip = ip6
+	default:
+		return nil
+	}
+
+	// anything after the IP header, extension headers included
+	packet := gopacket.NewPacket(ip.LayerPayload(), ip.NextLayerType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		e.Protocol = uint8(layers.IPProtocolTCP)
+		e.SourcePort = uint16(transport.SrcPort)
+		e.DestinationPort = uint16(transport.DstPort)
+	case *layers.UDP:
+		e.Protocol = uint8(layers.IPProtocolUDP)
+		e.SourcePort = uint16(transport.SrcPort)
+		e.DestinationPort = uint16(transport.DstPort)
+	case *layers.SCTP:
+		e.Protocol = uint8(layers.IPProtocolSCTP)
+		e.SourcePort = uint16(transport.SrcPort)
+		e.DestinationPort = uint16(transport.DstPort)
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+//go:build linux
+
+/*
+A library for consuming packets sent to an NFLOG group by nftables log rules
+*/
+package nflog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/ngrok/firewall_toolkit/pkg/logger"
+	m "github.com/ngrok/firewall_toolkit/pkg/metrics"
+	"github.com/ngrok/firewall_toolkit/pkg/rule"
+)
+
+// nfnetlink_log message types, commands and copy modes
+// https://git.netfilter.org/libnetfilter_log/tree/include/libnetfilter_log/linux_nfnetlink_log.h
+const (
+	msgPacket = 0x0
+	msgConfig = 0x1
+
+	attrCfgCmd  = 0x1
+	attrCfgMode = 0x2
+
+	cfgCmdBind   = 0x1
+	cfgCmdUnbind = 0x2
+
+	copyPacket = 0x2
+
+	defaultCopyRange  = 0xffff
+	defaultBufferSize = 1024
+)
+
+// Defines an optional setting for a NFLOG consumer
+type Option func(*Conn)
+
+// Represents a consumer bound to a single NFLOG group
+type Conn struct {
+	conn       *netlink.Conn
+	group      uint16
+	copyRange  uint32
+	bufferSize int
+	events     chan Event
+	logger     logger.Logger
+	metrics    m.Metrics
+
+	mu    sync.RWMutex
+	rules map[string][]byte
+
+	dropped atomic.Uint64
+}
+
+// Open binds to NFLOG group over netlink, rules send packets to it with rule.NFLog.
+// Passing a nil metrics object is safe and will result in the "NoOp" client being used.
+func Open(group uint16, logger logger.Logger, metrics m.Metrics, opts ...Option) (*Conn, error) {
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := NewConn(c, group, logger, metrics, opts...)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// NewConn binds to NFLOG group over an existing netlink connection, the connection is closed by Close
+func NewConn(c *netlink.Conn, group uint16, logger logger.Logger, metrics m.Metrics, opts ...Option) (*Conn, error) {
+	if metrics == nil {
+		metrics = &statsd.NoOpClient{}
+	}
+
+	conn := &Conn{
+		conn:       c,
+		group:      group,
+		copyRange:  defaultCopyRange,
+		bufferSize: defaultBufferSize,
+		logger:     logger,
+		metrics:    metrics,
+		rules:      map[string][]byte{},
+	}
+
+	for _, opt := range opts {
+		opt(conn)
+	}
+
+	conn.events = make(chan Event, conn.bufferSize)
+
+	if err := conn.config(cfgCmdAttr(cfgCmdBind)); err != nil {
+		return nil, fmt.Errorf("binding to nflog group %v failed: %v", group, err)
+	}
+
+	if err := conn.config(cfgModeAttr(copyPacket, conn.copyRange)); err != nil {
+		return nil, fmt.Errorf("setting copy mode for nflog group %v failed: %v", group, err)
+	}
+
+	return conn, nil
+}
+
+// WithCopyRange sets the maximum number of bytes of each packet copied to userspace, the log rule's snaplen also
+// applies. Defaults to 65535
+func WithCopyRange(copyRange uint32) Option {
+	return func(c *Conn) {
+		c.copyRange = copyRange
+	}
+}
+
+// WithBufferSize sets the size of the events channel, events that don't fit are dropped rather than holding up the
+// netlink socket. Defaults to 1024
+func WithBufferSize(size int) Option {
+	return func(c *Conn) {
+		c.bufferSize = size
+	}
+}
+
+// Events returns the channel events are sent on, it's closed when Start returns
+func (c *Conn) Events() <-chan Event {
+	return c.events
+}
+
+// Dropped returns the number of events dropped because the events channel was full
+func (c *Conn) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// Correlate sets the rules used to fill in Event.RuleID. Events are matched to the rule that sends packets to this
+// group with the same prefix, if more than one rule does the prefix is ambiguous and RuleID is left empty. Call it
+// again whenever the rules change.
+func (c *Conn) Correlate(rules []rule.RuleData) {
+	index := map[string][]byte{}
+	ambiguous := map[string]bool{}
+
+	for _, r := range rules {
+		for _, prefix := range c.prefixes(r) {
+			if _, ok := index[prefix]; ok {
+				ambiguous[prefix] = true
+				continue
+			}
+			index[prefix] = r.ID
+		}
+	}
+
+	for prefix := range ambiguous {
+		c.logger.Warnf("nflog prefix %q is used by more than one rule in group %v, events won't be correlated", prefix, c.group)
+		delete(index, prefix)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = index
+}
+
+// prefixes returns the prefixes of the log expressions in the rule that send packets to this group
+func (c *Conn) prefixes(r rule.RuleData) []string {
+	prefixes := []string{}
+	for _, e := range r.Expressions {
+		log, ok := e.(*expr.Log)
+		if !ok || log.Key&(1<<unix.NFTA_LOG_GROUP) == 0 || log.Group != c.group {
+			continue
+		}
+		prefixes = append(prefixes, string(log.Data))
+	}
+
+	return prefixes
+}
+
+// RuleID returns the ID of the rule that sends packets to this group with the prefix, or nil if there isn't exactly one
+func (c *Conn) RuleID(prefix string) []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rules[prefix]
+}
+
+// Start receives packets from the group and sends them on the events channel until the context is done
+func (c *Conn) Start(ctx context.Context) error {
+	c.logger.Infof("starting nflog consumer for group %v", c.group)
+	defer close(c.events)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// unblock Receive once the context is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := c.conn.SetReadDeadline(time.Now()); err != nil {
+				c.logger.Warnf("error interrupting nflog consumer for group %v: %v", c.group, err)
+			}
+		case <-done:
+		}
+	}()
+
+	for {
+		msgs, err := c.conn.Receive()
+		if ctx.Err() != nil {
+			c.logger.Infof("got context done, stopping nflog consumer for group %v", c.group)
+			return nil
+		}
+
+		if err != nil {
+			// the kernel dropped messages because we weren't reading fast enough, carry on with the ones that follow
+			if errors.Is(err, unix.ENOBUFS) {
+				c.logger.Warnf("nflog group %v receive buffer overrun, events were lost", c.group)
+				c.count("nflog_overrun", 1)
+				continue
+			}
+			return fmt.Errorf("error receiving from nflog group %v: %v", c.group, err)
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Type != packetType {
+				continue
+			}
+
+			event, err := decodePacket(msg.Data, time.Now())
+			if err != nil {
+				c.logger.Warnf("error decoding nflog packet from group %v: %v", c.group, err)
+				c.count("nflog_decode_error", 1)
+				continue
+			}
+			event.RuleID = c.RuleID(event.Prefix)
+
+			select {
+			case c.events <- event:
+			default:
+				c.dropped.Add(1)
+				c.count("nflog_events_dropped", 1)
+			}
+		}
+	}
+}
+
+// Close unbinds from the group and closes the netlink connection, call it once Start has returned
+func (c *Conn) Close() error {
+	if err := c.config(cfgCmdAttr(cfgCmdUnbind)); err != nil {
+		c.logger.Warnf("error unbinding from nflog group %v: %v", c.group, err)
+	}
+
+	return c.conn.Close()
+}
+
+func (c *Conn) count(name string, value int64) {
+	err := c.metrics.Count(m.Prefix(name), value, []string{fmt.Sprintf("group:%v", c.group)}, 1)
+	if err != nil {
+		c.logger.Warnf("error sending %v metric: %v", name, err)
+	}
+}
+
+// config sends a config message for the group and waits for the kernel to acknowledge it
+func (c *Conn) config(attr netlink.Attribute) error {
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{attr})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  configType,
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(nfgenmsg(unix.AF_UNSPEC, c.group), data...),
+	})
+
+	return err
+}
+
+var (
+	packetType = netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | msgPacket)
+	configType = netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | msgConfig)
+)
+
+// nfgenmsg is the header of every nfnetlink message, for nflog the resource ID is the group
+func nfgenmsg(family uint8, group uint16) []byte {
+	return append([]byte{family, unix.NFNETLINK_V0}, binaryutil.BigEndian.PutUint16(group)...)
+}
+
+// NFULA_CFG_CMD, struct nfulnl_msg_config_cmd
+func cfgCmdAttr(cmd uint8) netlink.Attribute {
+	return netlink.Attribute{Type: attrCfgCmd, Data: []byte{cmd}}
+}
+
+// NFULA_CFG_MODE, struct nfulnl_msg_config_mode
+func cfgModeAttr(mode uint8, copyRange uint32) netlink.Attribute {
+	return netlink.Attribute{Type: attrCfgMode, Data: append(binaryutil.BigEndian.PutUint32(copyRange), mode, 0x0)}
+}
@@ -0,0 +1,281 @@
+//go:build linux
+
+package nflog
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/ngrok/firewall_toolkit/pkg/logger"
+	"github.com/ngrok/firewall_toolkit/pkg/rule"
+)
+
+func tcpPacket(t *testing.T) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP("198.51.100.7"),
+		DstIP:    net.ParseIP("192.0.2.1"),
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true}
+	assert.Nil(t, tcp.SetNetworkLayerForChecksum(ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, tcp)
+	assert.Nil(t, err)
+
+	return buf.Bytes()
+}
+
+func udp6Packet(t *testing.T) []byte {
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("2001:db8::7"),
+		DstIP:      net.ParseIP("2001:db8::1"),
+	}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	assert.Nil(t, udp.SetNetworkLayerForChecksum(ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, udp)
+	assert.Nil(t, err)
+
+	return buf.Bytes()
+}
+
+// packetMessage builds a NFULNL_MSG_PACKET message like the kernel sends
+func packetMessage(group uint16, attrs []netlink.Attribute) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{Type: packetType},
+		Data:   append(nfgenmsg(unix.AF_INET, group), nltest.MustMarshalAttributes(attrs)...),
+	}
+}
+
+func TestDecodePacket(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payload := tcpPacket(t)
+
+	msg := packetMessage(5, []netlink.Attribute{
+		{Type: attrPacketHdr, Data: []byte{0x08, 0x00, unix.NF_INET_LOCAL_IN, 0x0}},
+		{Type: attrMark, Data: binaryutil.BigEndian.PutUint32(42)},
+		{Type: attrTimestamp, Data: append(binaryutil.BigEndian.PutUint64(1600000000), binaryutil.BigEndian.PutUint64(500)...)},
+		{Type: attrIfIndexIn, Data: binaryutil.BigEndian.PutUint32(2)},
+		{Type: attrPayload, Data: payload},
+		{Type: attrPrefix, Data: []byte("ssh drop: \x00")},
+	})
+
+	event, err := decodePacket(msg.Data, now)
+	assert.Nil(t, err)
+	assert.Equal(t, Event{
+		Prefix:             "ssh drop: ",
+		Hook:               unix.NF_INET_LOCAL_IN,
+		HwProtocol:         etherTypeIPv4,
+		Mark:               42,
+		InputInterface:     2,
+		Timestamp:          time.Unix(1600000000, 500*int64(time.Microsecond)),
+		Payload:            payload,
+		SourceAddress:      netip.MustParseAddr("198.51.100.7"),
+		DestinationAddress: netip.MustParseAddr("192.0.2.1"),
+		Protocol:           unix.IPPROTO_TCP,
+		SourcePort:         40000,
+		DestinationPort:    22,
+	}, event)
+}
+
+func TestDecodePacketIPv6(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	// no packet header or timestamp, the IP version is used and the timestamp falls back to now
+	msg := packetMessage(5, []netlink.Attribute{
+		{Type: attrIfIndexOut, Data: binaryutil.BigEndian.PutUint32(3)},
+		{Type: attrPayload, Data: udp6Packet(t)},
+	})
+
+	event, err := decodePacket(msg.Data, now)
+	assert.Nil(t, err)
+	assert.Equal(t, now, event.Timestamp)
+	assert.Equal(t, uint32(3), event.OutputInterface)
+	assert.Equal(t, "", event.Prefix)
+	assert.Equal(t, netip.MustParseAddr("2001:db8::7"), event.SourceAddress)
+	assert.Equal(t, netip.MustParseAddr("2001:db8::1"), event.DestinationAddress)
+	assert.Equal(t, uint8(unix.IPPROTO_UDP), event.Protocol)
+	assert.Equal(t, uint16(5353), event.SourcePort)
+	assert.Equal(t, uint16(53), event.DestinationPort)
+}
+
+func TestDecodePacketTruncated(t *testing.T) {
+	// a snaplen shorter than the headers cuts off the tcp header, the addresses are still there
+	msg := packetMessage(5, []netlink.Attribute{
+		{Type: attrPacketHdr, Data: []byte{0x08, 0x00, unix.NF_INET_LOCAL_IN, 0x0}},
+		{Type: attrPayload, Data: tcpPacket(t)[:24]},
+	})
+
+	event, err := decodePacket(msg.Data, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, netip.MustParseAddr("198.51.100.7"), event.SourceAddress)
+	assert.Equal(t, netip.MustParseAddr("192.0.2.1"), event.DestinationAddress)
+	assert.Equal(t, uint8(unix.IPPROTO_TCP), event.Protocol)
+	assert.Equal(t, uint16(0), event.SourcePort)
+	assert.Equal(t, uint16(0), event.DestinationPort)
+}
+
+func TestDecodePacketInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short message", []byte{0x2, 0x0}},
+		{"bad attributes", append(nfgenmsg(unix.AF_INET, 0), 0xff, 0xff, 0x1)},
+		{"short packet header", packetMessage(0, []netlink.Attribute{{Type: attrPacketHdr, Data: []byte{0x8}}}).Data},
+		{"short timestamp", packetMessage(0, []netlink.Attribute{{Type: attrTimestamp, Data: []byte{0x0, 0x1}}}).Data},
+		{"truncated payload", packetMessage(0, []netlink.Attribute{
+			{Type: attrPacketHdr, Data: []byte{0x08, 0x00, 0x0, 0x0}},
+			{Type: attrPayload, Data: []byte{0x45, 0x0, 0x0}},
+		}).Data},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodePacket(test.data, time.Now())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := []netlink.Message{}
+	received := false
+	c := nltest.Dial(func(req []netlink.Message) ([]netlink.Message, error) {
+		// bind and copy mode config requests, acknowledge them
+		if req != nil {
+			requests = append(requests, req...)
+			return req, nil
+		}
+
+		// a receive with canned packets, then stop
+		if !received {
+			received = true
+			return []netlink.Message{
+				packetMessage(5, []netlink.Attribute{
+					{Type: attrPayload, Data: tcpPacket(t)},
+					{Type: attrPrefix, Data: []byte("ssh drop: \x00")},
+				}),
+				packetMessage(5, []netlink.Attribute{
+					{Type: attrPayload, Data: udp6Packet(t)},
+					{Type: attrPrefix, Data: []byte("unknown\x00")},
+				}),
+			}, nil
+		}
+
+		cancel()
+		return nil, errors.New("interrupted")
+	})
+
+	conn, err := NewConn(c, 5, logger.Default, nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, len(requests))
+	for _, req := range requests {
+		assert.Equal(t, configType, req.Header.Type)
+		assert.Equal(t, netlink.Request|netlink.Acknowledge, req.Header.Flags)
+	}
+	// group 5 bind
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x5, 0x5, 0x0, 0x1, 0x0, 0x1, 0x0, 0x0, 0x0}, requests[0].Data)
+	// copy the whole packet up to 65535 bytes
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x5, 0xa, 0x0, 0x2, 0x0, 0x0, 0x0, 0xff, 0xff, 0x2, 0x0, 0x0, 0x0}, requests[1].Data)
+
+	log, err := rule.Build(expr.VerdictDrop, rule.DestinationPort(22), rule.NFLog(5, 0, "ssh drop: "))
+	assert.Nil(t, err)
+	otherGroup, err := rule.Build(expr.VerdictDrop, rule.NFLog(6, 0, "unknown"))
+	assert.Nil(t, err)
+	conn.Correlate([]rule.RuleData{
+		rule.NewRuleData([]byte("ssh"), log),
+		rule.NewRuleData([]byte("other"), otherGroup),
+	})
+
+	assert.Nil(t, conn.Start(ctx))
+
+	events := []Event{}
+	for event := range conn.Events() {
+		events = append(events, event)
+	}
+
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, []byte("ssh"), events[0].RuleID)
+	assert.Equal(t, uint16(22), events[0].DestinationPort)
+	// only rules logging to this group are correlated
+	assert.Nil(t, events[1].RuleID)
+	assert.Equal(t, uint16(53), events[1].DestinationPort)
+	assert.Equal(t, uint64(0), conn.Dropped())
+}
+
+func TestConnDropsWhenFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := false
+	c := nltest.Dial(func(req []netlink.Message) ([]netlink.Message, error) {
+		if req != nil {
+			return req, nil
+		}
+
+		if !received {
+			received = true
+			msg := packetMessage(1, []netlink.Attribute{{Type: attrPayload, Data: tcpPacket(t)}})
+			return []netlink.Message{msg, msg, msg}, nil
+		}
+
+		cancel()
+		return nil, errors.New("interrupted")
+	})
+
+	conn, err := NewConn(c, 1, logger.Default, nil, WithBufferSize(1))
+	assert.Nil(t, err)
+
+	assert.Nil(t, conn.Start(ctx))
+	assert.Equal(t, uint64(2), conn.Dropped())
+}
+
+func TestCorrelateAmbiguous(t *testing.T) {
+	c := nltest.Dial(func(req []netlink.Message) ([]netlink.Message, error) {
+		return req, nil
+	})
+
+	conn, err := NewConn(c, 1, logger.Default, nil)
+	assert.Nil(t, err)
+
+	first, err := rule.Build(expr.VerdictDrop, rule.NFLog(1, 0, "drop"))
+	assert.Nil(t, err)
+	second, err := rule.Build(expr.VerdictDrop, rule.DestinationPort(22), rule.NFLog(1, 0, "drop"))
+	assert.Nil(t, err)
+	unique, err := rule.Build(expr.VerdictDrop, rule.NFLog(1, 0, "unique"))
+	assert.Nil(t, err)
+
+	conn.Correlate([]rule.RuleData{
+		rule.NewRuleData([]byte{0x1}, first),
+		rule.NewRuleData([]byte{0x2}, second),
+		rule.NewRuleData([]byte{0x3}, unique),
+	})
+
+	assert.Nil(t, conn.RuleID("drop"))
+	assert.Equal(t, []byte{0x3}, conn.RuleID("unique"))
+}
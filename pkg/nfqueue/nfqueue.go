@@ -0,0 +1,306 @@
+//go:build linux
+
+/*
+A library for receiving packets sent to a NFQUEUE by nftables queue rules and issuing verdicts for them
+*/
+package nfqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/ngrok/firewall_toolkit/pkg/logger"
+	m "github.com/ngrok/firewall_toolkit/pkg/metrics"
+)
+
+// nfnetlink_queue message types, commands and copy modes
+// https://git.netfilter.org/libnetfilter_queue/tree/include/libnetfilter_queue/linux_nfnetlink_queue.h
+const (
+	msgPacket  = 0x0
+	msgVerdict = 0x1
+	msgConfig  = 0x2
+
+	attrCfgCmd    = 0x1
+	attrCfgParams = 0x2
+
+	cfgCmdBind   = 0x1
+	cfgCmdUnbind = 0x2
+
+	copyPacket = 0x2
+
+	defaultCopyRange  = 0xffff
+	defaultBufferSize = 1024
+)
+
+// Verdict is what happens to a queued packet, NF_DROP and NF_ACCEPT in linux/netfilter.h
+type Verdict uint32
+
+const (
+	Drop   Verdict = 0x0
+	Accept Verdict = 0x1
+)
+
+// Defines an optional setting for a NFQUEUE consumer
+type Option func(*Conn)
+
+// Represents a consumer bound to a single NFQUEUE
+type Conn struct {
+	conn       *netlink.Conn
+	num        uint16
+	copyRange  uint32
+	bufferSize int
+	overflow   Verdict
+	packets    chan Packet
+	logger     logger.Logger
+	metrics    m.Metrics
+
+	overflowed atomic.Uint64
+}
+
+// Open binds to NFQUEUE num over netlink, rules send packets to it with rule.Queue.
+// Passing a nil metrics object is safe and will result in the "NoOp" client being used.
+func Open(num uint16, logger logger.Logger, metrics m.Metrics, opts ...Option) (*Conn, error) {
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := newConn(c, num, logger, metrics, opts...)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func newConn(c *netlink.Conn, num uint16, logger logger.Logger, metrics m.Metrics, opts ...Option) (*Conn, error) {
+	if metrics == nil {
+		metrics = &statsd.NoOpClient{}
+	}
+
+	conn := &Conn{
+		conn:       c,
+		num:        num,
+		copyRange:  defaultCopyRange,
+		bufferSize: defaultBufferSize,
+		overflow:   Drop,
+		logger:     logger,
+		metrics:    metrics,
+	}
+
+	for _, opt := range opts {
+		opt(conn)
+	}
+
+	conn.packets = make(chan Packet, conn.bufferSize)
+
+	if err := conn.config(cfgCmdAttr(cfgCmdBind)); err != nil {
+		return nil, fmt.Errorf("binding to nfqueue %v failed: %v", num, err)
+	}
+
+	if err := conn.config(cfgParamsAttr(copyPacket, conn.copyRange)); err != nil {
+		return nil, fmt.Errorf("setting copy mode for nfqueue %v failed: %v", num, err)
+	}
+
+	return conn, nil
+}
+
+// WithCopyRange sets the maximum number of bytes of each packet copied to userspace. Defaults to 65535
+func WithCopyRange(copyRange uint32) Option {
+	return func(c *Conn) {
+		c.copyRange = copyRange
+	}
+}
+
+// WithBufferSize sets the size of the packets channel. Defaults to 1024
+func WithBufferSize(size int) Option {
+	return func(c *Conn) {
+		c.bufferSize = size
+	}
+}
+
+// WithOverflowVerdict sets the verdict issued for packets that don't fit in the packets channel, so they aren't held
+// in the kernel waiting for one. Defaults to Drop
+func WithOverflowVerdict(verdict Verdict) Option {
+	return func(c *Conn) {
+		c.overflow = verdict
+	}
+}
+
+// Packets returns the channel packets are sent on, it's closed when Start returns. Every packet has to get a verdict
+// with SetVerdict, until it does the kernel holds on to it.
+func (c *Conn) Packets() <-chan Packet {
+	return c.packets
+}
+
+// Overflowed returns the number of packets that got the overflow verdict because the packets channel was full
+func (c *Conn) Overflowed() uint64 {
+	return c.overflowed.Load()
+}
+
+// Start receives packets from the queue and sends them on the packets channel until the context is done
+func (c *Conn) Start(ctx context.Context) error {
+	c.logger.Infof("starting nfqueue consumer for queue %v", c.num)
+	defer close(c.packets)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// unblock Receive once the context is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := c.conn.SetReadDeadline(time.Now()); err != nil {
+				c.logger.Warnf("error interrupting nfqueue consumer for queue %v: %v", c.num, err)
+			}
+		case <-done:
+		}
+	}()
+
+	for {
+		msgs, err := c.conn.Receive()
+		if ctx.Err() != nil {
+			c.logger.Infof("got context done, stopping nfqueue consumer for queue %v", c.num)
+			return nil
+		}
+
+		if err != nil {
+			// the kernel couldn't deliver messages because we weren't reading fast enough, it drops those packets
+			// itself
+			if errors.Is(err, unix.ENOBUFS) {
+				c.logger.Warnf("nfqueue %v receive buffer overrun, packets were lost", c.num)
+				c.count("nfqueue_overrun", 1)
+				continue
+			}
+			return fmt.Errorf("error receiving from nfqueue %v: %v", c.num, err)
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Type != packetType {
+				continue
+			}
+
+			packet, err := decodePacket(msg.Data, time.Now())
+			if err != nil {
+				c.logger.Warnf("error decoding nfqueue packet from queue %v: %v", c.num, err)
+				c.count("nfqueue_decode_error", 1)
+				continue
+			}
+
+			select {
+			case c.packets <- packet:
+			default:
+				c.overflowed.Add(1)
+				c.count("nfqueue_overflow", 1)
+				if err := c.SetVerdict(packet.ID, c.overflow); err != nil {
+					c.logger.Warnf("error setting overflow verdict for packet %v in nfqueue %v: %v", packet.ID, c.num, err)
+				}
+			}
+		}
+	}
+}
+
+// SetVerdict issues the verdict for the packet with id, it's safe to call while Start is running
+func (c *Conn) SetVerdict(id uint32, verdict Verdict) error {
+	return c.verdict([]netlink.Attribute{verdictHdrAttr(verdict, id)})
+}
+
+// SetVerdictWithMark issues the verdict for the packet with id and sets its mark, so rules after the queue rule can
+// match on what the consumer decided
+func (c *Conn) SetVerdictWithMark(id uint32, verdict Verdict, mark uint32) error {
+	return c.verdict([]netlink.Attribute{
+		verdictHdrAttr(verdict, id),
+		{Type: attrMark, Data: binaryutil.BigEndian.PutUint32(mark)},
+	})
+}
+
+// verdict sends a verdict message for the queue, it isn't acknowledged so it doesn't compete with Start for replies
+func (c *Conn) verdict(attrs []netlink.Attribute) error {
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.conn.Send(netlink.Message{
+		Header: netlink.Header{
+			Type:  verdictType,
+			Flags: netlink.Request,
+		},
+		Data: append(nfgenmsg(unix.AF_UNSPEC, c.num), data...),
+	})
+
+	return err
+}
+
+// Close unbinds from the queue and closes the netlink connection, call it once Start has returned. Packets still
+// waiting for a verdict are dropped by the kernel.
+func (c *Conn) Close() error {
+	if err := c.config(cfgCmdAttr(cfgCmdUnbind)); err != nil {
+		c.logger.Warnf("error unbinding from nfqueue %v: %v", c.num, err)
+	}
+
+	return c.conn.Close()
+}
+
+func (c *Conn) count(name string, value int64) {
+	err := c.metrics.Count(m.Prefix(name), value, []string{fmt.Sprintf("queue:%v", c.num)}, 1)
+	if err != nil {
+		c.logger.Warnf("error sending %v metric: %v", name, err)
+	}
+}
+
+// config sends a config message for the queue and waits for the kernel to acknowledge it
+func (c *Conn) config(attr netlink.Attribute) error {
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{attr})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  configType,
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(nfgenmsg(unix.AF_UNSPEC, c.num), data...),
+	})
+
+	return err
+}
+
+var (
+	packetType  = netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8 | msgPacket)
+	verdictType = netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8 | msgVerdict)
+	configType  = netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8 | msgConfig)
+)
+
+// nfgenmsg is the header of every nfnetlink message, for nfqueue the resource ID is the queue number
+func nfgenmsg(family uint8, num uint16) []byte {
+	return append([]byte{family, unix.NFNETLINK_V0}, binaryutil.BigEndian.PutUint16(num)...)
+}
+
+// NFQA_CFG_CMD, struct nfqnl_msg_config_cmd, the protocol family has been ignored since linux 3.8
+func cfgCmdAttr(cmd uint8) netlink.Attribute {
+	return netlink.Attribute{Type: attrCfgCmd, Data: []byte{cmd, 0x0, 0x0, 0x0}}
+}
+
+// NFQA_CFG_PARAMS, struct nfqnl_msg_config_params
+func cfgParamsAttr(mode uint8, copyRange uint32) netlink.Attribute {
+	return netlink.Attribute{Type: attrCfgParams, Data: append(binaryutil.BigEndian.PutUint32(copyRange), mode)}
+}
+
+// NFQA_VERDICT_HDR, struct nfqnl_msg_verdict_hdr
+func verdictHdrAttr(verdict Verdict, id uint32) netlink.Attribute {
+	return netlink.Attribute{
+		Type: attrVerdictHdr,
+		Data: append(binaryutil.BigEndian.PutUint32(uint32(verdict)), binaryutil.BigEndian.PutUint32(id)...),
+	}
+}
@@ -0,0 +1,204 @@
+//go:build linux
+
+package nfqueue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/ngrok/firewall_toolkit/pkg/logger"
+)
+
+var (
+	// queue 3 bind
+	wantBind = []byte{0x0, 0x0, 0x0, 0x3, 0x8, 0x0, 0x1, 0x0, 0x1, 0x0, 0x0, 0x0}
+	// copy the whole packet up to 65535 bytes
+	wantParams = []byte{0x0, 0x0, 0x0, 0x3, 0x9, 0x0, 0x2, 0x0, 0x0, 0x0, 0xff, 0xff, 0x2, 0x0, 0x0, 0x0}
+)
+
+// testDialWithWant checks the requests sent to the fake netlink connection against want and acknowledges the ones
+// that ask for it, receives get the batches of messages in recv in order then cancel
+func testDialWithWant(t *testing.T, want [][]byte, recv [][]netlink.Message, cancel context.CancelFunc) *netlink.Conn {
+	return nltest.Dial(func(req []netlink.Message) ([]netlink.Message, error) {
+		if req == nil {
+			if len(recv) == 0 {
+				cancel()
+				return nil, errors.New("interrupted")
+			}
+			msgs := recv[0]
+			recv = recv[1:]
+			return msgs, nil
+		}
+
+		for idx, msg := range req {
+			b, err := msg.MarshalBinary()
+			assert.Nil(t, err)
+
+			b = b[16:]
+			if len(want) == 0 {
+				t.Errorf("no want entry for message %d: %#v", idx, b)
+				continue
+			}
+			if got, want := b, want[0]; !bytes.Equal(got, want) {
+				t.Errorf("message %d: got: %#v, want: %#v", idx, got, want)
+			}
+			want = want[1:]
+		}
+
+		if req[0].Header.Flags&netlink.Acknowledge == 0 {
+			return nil, nil
+		}
+		return req, nil
+	})
+}
+
+// packetMessage builds a NFQNL_MSG_PACKET message like the kernel sends
+func packetMessage(num uint16, attrs []netlink.Attribute) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{Type: packetType},
+		Data:   append(nfgenmsg(unix.AF_INET, num), nltest.MustMarshalAttributes(attrs)...),
+	}
+}
+
+func packetHdr(id uint32) netlink.Attribute {
+	return netlink.Attribute{
+		Type: attrPacketHdr,
+		Data: append(binaryutil.BigEndian.PutUint32(id), 0x08, 0x00, unix.NF_INET_LOCAL_IN),
+	}
+}
+
+func TestDecodePacket(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payload := []byte{0x45, 0x0, 0x0, 0x14}
+
+	msg := packetMessage(3, []netlink.Attribute{
+		packetHdr(7),
+		{Type: attrMark, Data: binaryutil.BigEndian.PutUint32(42)},
+		{Type: attrTimestamp, Data: append(binaryutil.BigEndian.PutUint64(1600000000), binaryutil.BigEndian.PutUint64(500)...)},
+		{Type: attrIfIndexIn, Data: binaryutil.BigEndian.PutUint32(2)},
+		{Type: attrPayload, Data: payload},
+	})
+
+	packet, err := decodePacket(msg.Data, now)
+	assert.Nil(t, err)
+	assert.Equal(t, Packet{
+		ID:             7,
+		Hook:           unix.NF_INET_LOCAL_IN,
+		HwProtocol:     0x0800,
+		Mark:           42,
+		InputInterface: 2,
+		Timestamp:      time.Unix(1600000000, 500*int64(time.Microsecond)),
+		Payload:        payload,
+	}, packet)
+
+	// no timestamp, it falls back to now
+	msg = packetMessage(3, []netlink.Attribute{packetHdr(8), {Type: attrIfIndexOut, Data: binaryutil.BigEndian.PutUint32(3)}})
+	packet, err = decodePacket(msg.Data, now)
+	assert.Nil(t, err)
+	assert.Equal(t, now, packet.Timestamp)
+	assert.Equal(t, uint32(3), packet.OutputInterface)
+}
+
+func TestDecodePacketInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short message", []byte{0x2, 0x0}},
+		{"bad attributes", append(nfgenmsg(unix.AF_INET, 0), 0xff, 0xff, 0x1)},
+		{"short packet header", packetMessage(0, []netlink.Attribute{{Type: attrPacketHdr, Data: []byte{0x0, 0x0, 0x0, 0x1}}}).Data},
+		{"missing packet header", packetMessage(0, []netlink.Attribute{{Type: attrPayload, Data: []byte{0x45}}}).Data},
+		{"short timestamp", packetMessage(0, []netlink.Attribute{packetHdr(1), {Type: attrTimestamp, Data: []byte{0x0, 0x1}}}).Data},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodePacket(test.data, time.Now())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	want := [][]byte{
+		wantBind,
+		wantParams,
+		// accept packet 1
+		{0x0, 0x0, 0x0, 0x3, 0xc, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1},
+		// drop packet 2 and mark it 0x10
+		{0x0, 0x0, 0x0, 0x3, 0xc, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x8, 0x0, 0x3, 0x0, 0x0, 0x0, 0x0, 0x10},
+		// unbind
+		{0x0, 0x0, 0x0, 0x3, 0x8, 0x0, 0x1, 0x0, 0x2, 0x0, 0x0, 0x0},
+	}
+	recv := [][]netlink.Message{{
+		packetMessage(3, []netlink.Attribute{packetHdr(1), {Type: attrPayload, Data: []byte{0x45}}}),
+		// not a packet, ignored
+		{Header: netlink.Header{Type: configType}, Data: nfgenmsg(unix.AF_UNSPEC, 3)},
+		// undecodable, skipped
+		packetMessage(3, []netlink.Attribute{{Type: attrPayload, Data: []byte{0x45}}}),
+		packetMessage(3, []netlink.Attribute{packetHdr(2), {Type: attrPayload, Data: []byte{0x60}}}),
+	}}
+
+	conn, err := newConn(testDialWithWant(t, want, recv, cancel), 3, logger.Default, nil)
+	assert.Nil(t, err)
+
+	assert.Nil(t, conn.Start(ctx))
+
+	packets := []Packet{}
+	for packet := range conn.Packets() {
+		packets = append(packets, packet)
+	}
+
+	assert.Equal(t, 2, len(packets))
+	assert.Equal(t, uint32(1), packets[0].ID)
+	assert.Equal(t, uint32(2), packets[1].ID)
+
+	assert.Nil(t, conn.SetVerdict(packets[0].ID, Accept))
+	assert.Nil(t, conn.SetVerdictWithMark(packets[1].ID, Drop, 0x10))
+	assert.Nil(t, conn.Close())
+}
+
+func TestConnOverflow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	want := [][]byte{
+		wantBind,
+		wantParams,
+		// packets that don't fit get the overflow verdict, accept
+		{0x0, 0x0, 0x0, 0x3, 0xc, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2},
+		{0x0, 0x0, 0x0, 0x3, 0xc, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x3},
+	}
+	recv := [][]netlink.Message{{
+		packetMessage(3, []netlink.Attribute{packetHdr(1)}),
+		packetMessage(3, []netlink.Attribute{packetHdr(2)}),
+		packetMessage(3, []netlink.Attribute{packetHdr(3)}),
+	}}
+
+	conn, err := newConn(testDialWithWant(t, want, recv, cancel), 3, logger.Default, nil, WithBufferSize(1), WithOverflowVerdict(Accept))
+	assert.Nil(t, err)
+
+	assert.Nil(t, conn.Start(ctx))
+	assert.Equal(t, uint64(2), conn.Overflowed())
+}
+
+func TestConnBindFails(t *testing.T) {
+	c := nltest.Dial(func(req []netlink.Message) ([]netlink.Message, error) {
+		return nil, unix.EBUSY
+	})
+
+	_, err := newConn(c, 3, logger.Default, nil)
+	assert.Error(t, err)
+}
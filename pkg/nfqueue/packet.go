@@ -0,0 +1,102 @@
+//go:build linux
+
+package nfqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+// nfnetlink_queue attribute types
+// https://git.netfilter.org/libnetfilter_queue/tree/include/libnetfilter_queue/linux_nfnetlink_queue.h
+const (
+	attrPacketHdr  = 0x1
+	attrVerdictHdr = 0x2
+	attrMark       = 0x3
+	attrTimestamp  = 0x4
+	attrIfIndexIn  = 0x5
+	attrIfIndexOut = 0x6
+	attrPayload    = 0xa
+)
+
+const (
+	nfgenmsgLen  = 4
+	packetHdrLen = 7
+	timestampLen = 16
+)
+
+// Packet is a packet waiting in a NFQUEUE for a verdict
+type Packet struct {
+	// the ID to issue the verdict for, see Conn.SetVerdict
+	ID uint32
+	// the netfilter hook the packet was queued from and its ethertype
+	Hook       uint8
+	HwProtocol uint16
+	Mark       uint32
+	// interface indexes, 0 if the packet didn't have one
+	InputInterface  uint32
+	OutputInterface uint32
+	// when the packet was received, if the kernel didn't include a timestamp it's when the packet was decoded
+	Timestamp time.Time
+	// the packet from the network header on, up to the copy range
+	Payload []byte
+}
+
+// decodePacket decodes the data of a NFQNL_MSG_PACKET message, now is used when the kernel didn't include a timestamp
+func decodePacket(data []byte, now time.Time) (Packet, error) {
+	if len(data) < nfgenmsgLen {
+		return Packet{}, fmt.Errorf("message too short, %v < %v", len(data), nfgenmsgLen)
+	}
+
+	ad, err := netlink.NewAttributeDecoder(data[nfgenmsgLen:])
+	if err != nil {
+		return Packet{}, err
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	packet := Packet{Timestamp: now}
+	hasHdr := false
+	for ad.Next() {
+		switch ad.Type() {
+		case attrPacketHdr:
+			hdr := ad.Bytes()
+			if len(hdr) < packetHdrLen {
+				return Packet{}, fmt.Errorf("packet header too short, %v < %v", len(hdr), packetHdrLen)
+			}
+			packet.ID = binary.BigEndian.Uint32(hdr[0:4])
+			packet.HwProtocol = binary.BigEndian.Uint16(hdr[4:6])
+			packet.Hook = hdr[6]
+			hasHdr = true
+		case attrMark:
+			packet.Mark = ad.Uint32()
+		case attrTimestamp:
+			ts := ad.Bytes()
+			if len(ts) < timestampLen {
+				return Packet{}, fmt.Errorf("timestamp too short, %v < %v", len(ts), timestampLen)
+			}
+			sec := binary.BigEndian.Uint64(ts[0:8])
+			usec := binary.BigEndian.Uint64(ts[8:16])
+			packet.Timestamp = time.Unix(int64(sec), int64(usec)*int64(time.Microsecond))
+		case attrIfIndexIn:
+			packet.InputInterface = ad.Uint32()
+		case attrIfIndexOut:
+			packet.OutputInterface = ad.Uint32()
+		case attrPayload:
+			packet.Payload = append([]byte{}, ad.Bytes()...)
+		}
+	}
+
+	if err := ad.Err(); err != nil {
+		return Packet{}, err
+	}
+
+	// without the ID there's no way to issue a verdict
+	if !hasHdr {
+		return Packet{}, fmt.Errorf("packet header missing")
+	}
+
+	return packet, nil
+}
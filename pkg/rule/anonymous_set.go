@@ -0,0 +1,65 @@
+package rule
+
+import (
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// anonymousSet is a set that only exists as part of a single rule, like `ip saddr { 192.0.2.1, 198.51.100.0/24 }` in
+// nft. It is created in the same batch as the rule and the kernel removes it along with the rule.
+type anonymousSet struct {
+	keyType  nftables.SetDatatype
+	elements []nftables.SetElement
+	// the lookup expression in the rule that refers to the set, it gets the name and ID of the set when it's created
+	lookup *expr.Lookup
+}
+
+// isAnonymousSetName returns true if a set name is one the kernel gave to an anonymous set
+func isAnonymousSetName(name string) bool {
+	return strings.HasPrefix(name, "__set")
+}
+
+// anonymousSetsChanged returns true if the elements of the anonymous sets of an existing rule, in the order they are
+// used in the rule, differ from the ones we want
+func anonymousSetsChanged(existing [][]nftables.SetElement, desired []anonymousSet) bool {
+	if len(existing) != len(desired) {
+		return true
+	}
+
+	for i := range desired {
+		if !elementsEqual(existing[i], desired[i].elements) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// elementsEqual compares set elements ignoring their order and any counters
+func elementsEqual(a []nftables.SetElement, b []nftables.SetElement) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	type key struct {
+		key         string
+		intervalEnd bool
+	}
+
+	counts := make(map[key]int, len(a))
+	for _, e := range a {
+		counts[key{string(e.Key), e.IntervalEnd}]++
+	}
+
+	for _, e := range b {
+		k := key{string(e.Key), e.IntervalEnd}
+		if counts[k] == 0 {
+			return false
+		}
+		counts[k]--
+	}
+
+	return true
+}
@@ -0,0 +1,33 @@
+package rule
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymousSetsChanged(t *testing.T) {
+	elements := []nftables.SetElement{
+		{Key: []byte{192, 0, 2, 1}},
+		{Key: []byte{192, 0, 2, 2}, IntervalEnd: true},
+	}
+
+	// the kernel returns elements in its own order
+	reversed := []nftables.SetElement{elements[1], elements[0]}
+
+	assert.False(t, anonymousSetsChanged(nil, nil))
+	assert.False(t, anonymousSetsChanged([][]nftables.SetElement{reversed}, []anonymousSet{{elements: elements}}))
+	assert.True(t, anonymousSetsChanged(nil, []anonymousSet{{elements: elements}}))
+	assert.True(t, anonymousSetsChanged([][]nftables.SetElement{elements[:1]}, []anonymousSet{{elements: elements}}))
+	assert.True(t, anonymousSetsChanged(
+		[][]nftables.SetElement{{{Key: []byte{192, 0, 2, 1}}, {Key: []byte{192, 0, 2, 3}, IntervalEnd: true}}},
+		[]anonymousSet{{elements: elements}},
+	))
+}
+
+func TestIsAnonymousSetName(t *testing.T) {
+	assert.True(t, isAnonymousSetName("__set0"))
+	assert.True(t, isAnonymousSetName("__set%d"))
+	assert.False(t, isAnonymousSetName("allowlist"))
+}
@@ -2,17 +2,38 @@ package rule
 
 import (
 	"errors"
+	"fmt"
 	"net/netip"
+	"time"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 	"github.com/ngrok/firewall_toolkit/pkg/expressions"
+	"github.com/ngrok/firewall_toolkit/pkg/set"
+	"github.com/ngrok/firewall_toolkit/pkg/utils"
 )
 
 type builder struct {
 	family    expressions.AddrFamily
 	transport expressions.TransportProto
 	exprs     []expr.Any
+	// statements that change the packet or connection, they run after every match and before the terminal
+	statements []expr.Any
+	// checks that depend on the whole rule, they run after every match has been applied
+	checks []func(*builder) error
+	// sets created along with the rule, see BuildRuleData
+	anonymousSets []anonymousSet
+	// matches that depend on the family, they're applied once every other match has been, see withFamily
+	deferred []deferredMatch
+}
+
+// deferredMatch is a match that's applied once the family is known, its expressions and statements go where they
+// would have if it had been applied when it was passed
+type deferredMatch struct {
+	match      Match
+	exprs      int
+	statements int
 }
 
 // Defines a Match signature for supply matches to rules to it can modify the
@@ -25,8 +46,57 @@ type Match func(*builder) error
 // order to increase specificity of the rule. Build will return an error if
 // the rule does not make sense. For instance, if you use IPv4 and then attempt
 // to provide IPv6 addresses.
+//
+// Matches on anonymous sets need the sets to be created along with the rule,
+// use BuildRuleData for those.
 func Build(v expr.VerdictKind, matches ...Match) ([]expr.Any, error) {
-	b := builder{}
+	return BuildTerminal(Verdict(v), matches...)
+}
+
+// BuildTerminal builds a rule the same way as Build but ends it with any
+// Terminal, like DNAT or Masquerade, instead of a verdict.
+func BuildTerminal(t Terminal, matches ...Match) ([]expr.Any, error) {
+	b, err := newBuilder(matches...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.anonymousSets) > 0 {
+		return nil, errors.New("rule uses anonymous sets, use BuildRuleData")
+	}
+
+	return b.build(t)
+}
+
+// BuildRuleData builds a rule the same way as Build and returns it as
+// RuleData with the given ID, ready to be added to a RuleTarget. Unlike Build
+// it supports matches on anonymous sets, which are created in the same batch
+// as the rule when it's added or updated.
+func BuildRuleData(id []byte, v expr.VerdictKind, matches ...Match) (RuleData, error) {
+	return BuildTerminalRuleData(id, Verdict(v), matches...)
+}
+
+// BuildTerminalRuleData builds a rule the same way as BuildRuleData but ends
+// it with any Terminal instead of a verdict.
+func BuildTerminalRuleData(id []byte, t Terminal, matches ...Match) (RuleData, error) {
+	b, err := newBuilder(matches...)
+	if err != nil {
+		return RuleData{}, err
+	}
+
+	exprs, err := b.build(t)
+	if err != nil {
+		return RuleData{}, err
+	}
+
+	ruleData := NewRuleData(id, exprs)
+	ruleData.anonymousSets = b.anonymousSets
+
+	return ruleData, nil
+}
+
+func newBuilder(matches ...Match) (*builder, error) {
+	b := &builder{}
 
 	for _, m := range matches {
 		if err := b.with(m); err != nil {
@@ -34,9 +104,26 @@ func Build(v expr.VerdictKind, matches ...Match) ([]expr.Any, error) {
 		}
 	}
 
-	// to allow for space for family, transport, and verdict without needing to
+	if err := b.applyDeferred(); err != nil {
+		return nil, err
+	}
+
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *builder) build(t Terminal) ([]expr.Any, error) {
+	terminal, err := t(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// to allow for space for family, transport, and terminal without needing to
 	// grow the underlying array since we know the capacity ahead of time
-	exprs := make([]expr.Any, 0, len(b.exprs)+3)
+	exprs := make([]expr.Any, 0, len(b.exprs)+len(b.statements)+len(terminal)+4)
 
 	if b.family > 0 {
 		exprfamily, err := expressions.CompareProtocolFamily(byte(b.family))
@@ -56,7 +143,9 @@ func Build(v expr.VerdictKind, matches ...Match) ([]expr.Any, error) {
 
 	exprs = append(exprs, b.exprs...)
 
-	exprs = append(exprs, &expr.Verdict{Kind: v})
+	exprs = append(exprs, b.statements...)
+
+	exprs = append(exprs, terminal...)
 
 	return exprs, nil
 }
@@ -68,6 +157,70 @@ func (b *builder) with(opt Match) error {
 	return nil
 }
 
+// withFamily applies a match whose expressions depend on the family, right away if the family is already known,
+// otherwise once every other match has been applied so AddressFamily can come after it
+func (b *builder) withFamily(m Match) error {
+	if b.family > 0 {
+		return m(b)
+	}
+
+	b.deferred = append(b.deferred, deferredMatch{match: m, exprs: len(b.exprs), statements: len(b.statements)})
+	return nil
+}
+
+// applyDeferred applies the deferred matches in order, splicing what they add in at the position they were passed
+func (b *builder) applyDeferred() error {
+	deferred := b.deferred
+	b.deferred = nil
+
+	// expressions and statements added by earlier deferred matches shift the positions of later ones
+	exprsShift, statementsShift := 0, 0
+	for _, d := range deferred {
+		exprsAt, statementsAt := d.exprs+exprsShift, d.statements+statementsShift
+		exprsTail := append([]expr.Any{}, b.exprs[exprsAt:]...)
+		statementsTail := append([]expr.Any{}, b.statements[statementsAt:]...)
+		b.exprs, b.statements = b.exprs[:exprsAt], b.statements[:statementsAt]
+
+		if err := b.with(d.match); err != nil {
+			return err
+		}
+
+		exprsShift += len(b.exprs) - exprsAt
+		statementsShift += len(b.statements) - statementsAt
+		b.exprs = append(b.exprs, exprsTail...)
+		b.statements = append(b.statements, statementsTail...)
+	}
+
+	return nil
+}
+
+// validate checks the rule as a whole once all matches have been applied
+func (b *builder) validate() error {
+	if b.transport == expressions.ICMP && b.family > 0 && b.family != expressions.IPv4 {
+		return errors.New("icmp transport requires the ipv4 family")
+	}
+
+	if b.transport == expressions.ICMPv6 && b.family > 0 && b.family != expressions.IPv6 {
+		return errors.New("icmpv6 transport requires the ipv6 family")
+	}
+
+	for _, check := range b.checks {
+		if err := check(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requireICMP is a check for matches on the ICMP header, which need the ICMP or ICMPv6 transport
+func requireICMP(b *builder) error {
+	if b.transport != expressions.ICMP && b.transport != expressions.ICMPv6 {
+		return errors.New("icmp match requires the icmp or icmpv6 transport")
+	}
+	return nil
+}
+
 func (b *builder) checkAddrFamily(ip netip.Addr) error {
 	if b.family <= 0 {
 		return nil
@@ -279,3 +432,1035 @@ func LoadConnectionTrackingState(key expr.CtKey) Match {
 		return nil
 	}
 }
+
+// InputInterface adds the name of the interface traffic came in on to the rule to
+// match on. Use InputInterfaceIndex instead for interfaces that are never
+// renamed or recreated since comparing the index is cheaper.
+func InputInterface(name string) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareInputInterfaceName(name)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// InputInterfacePrefix adds the start of the name of the interface traffic came in
+// on to the rule to match on, the equivalent of `iifname "eth*"` in nft.
+func InputInterfacePrefix(prefix string) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareInputInterfacePrefix(prefix)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// InputInterfaceIndex adds the index of the interface traffic came in on to the rule
+// to match on. The index changes if the interface is recreated.
+func InputInterfaceIndex(index uint32) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareInputInterfaceIndex(index)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// InputInterfaceSet adds an nftables named set of interface names or indexes to
+// match the interface traffic came in on against.
+func InputInterfaceSet(set *nftables.Set) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareInputInterfaceSet(set)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// OutputInterface adds the name of the interface traffic is leaving on to the rule
+// to match on. Use OutputInterfaceIndex instead for interfaces that are never
+// renamed or recreated since comparing the index is cheaper.
+func OutputInterface(name string) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareOutputInterfaceName(name)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// OutputInterfacePrefix adds the start of the name of the interface traffic is leaving
+// on to the rule to match on, the equivalent of `oifname "eth*"` in nft.
+func OutputInterfacePrefix(prefix string) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareOutputInterfacePrefix(prefix)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// OutputInterfaceIndex adds the index of the interface traffic is leaving on to the
+// rule to match on. The index changes if the interface is recreated.
+func OutputInterfaceIndex(index uint32) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareOutputInterfaceIndex(index)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// OutputInterfaceSet adds an nftables named set of interface names or indexes to
+// match the interface traffic is leaving on against.
+func OutputInterfaceSet(set *nftables.Set) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareOutputInterfaceSet(set)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// ICMPType adds an ICMP or ICMPv6 type to the rule to match on (ex.
+// `expressions.ICMPEchoRequest`). The rule must use the ICMP or ICMPv6
+// transport.
+func ICMPType(icmpType uint8) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareICMPType(icmpType)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+		b.checks = append(b.checks, requireICMP)
+
+		return nil
+	}
+}
+
+// ICMPCode adds an ICMP or ICMPv6 code to the rule to match on. The rule must
+// use the ICMP or ICMPv6 transport.
+func ICMPCode(code uint8) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareICMPCode(code)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+		b.checks = append(b.checks, requireICMP)
+
+		return nil
+	}
+}
+
+// ICMPTypeSet adds an nftables named set of ICMP or ICMPv6 types to match on.
+// The set key type has to agree with the transport, `icmp_type` for ICMP and
+// `icmpv6_type` for ICMPv6.
+func ICMPTypeSet(set *nftables.Set) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareICMPTypeSet(set)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+		b.checks = append(b.checks, func(b *builder) error {
+			if (set.KeyType == nftables.TypeICMPType && b.transport != expressions.ICMP) ||
+				(set.KeyType == nftables.TypeICMP6Type && b.transport != expressions.ICMPv6) {
+				return errors.New("icmp set key type and rule transport mismatch")
+			}
+			return nil
+		})
+
+		return nil
+	}
+}
+
+// requireTCP is a check for matches on the TCP header, which need the TCP transport
+func requireTCP(b *builder) error {
+	if b.transport != expressions.TCP {
+		return errors.New("tcp match requires the tcp transport")
+	}
+	return nil
+}
+
+// TCPFlags adds a TCP flags comparison to the rule to match on. Only the
+// flags in mask are compared and they have to equal value (ex.
+// `TCPFlags(expressions.TCPFlagSYN|expressions.TCPFlagACK, expressions.TCPFlagSYN)`
+// for SYN without ACK). The rule must use the TCP transport.
+func TCPFlags(mask uint8, value uint8) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareTCPFlags(mask, value)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+		b.checks = append(b.checks, requireTCP)
+
+		return nil
+	}
+}
+
+// TCPSynOnly matches the first packet of a new TCP connection, SYN set and
+// FIN, RST and ACK unset.
+func TCPSynOnly() Match {
+	return TCPFlags(expressions.TCPFlagFIN|expressions.TCPFlagSYN|expressions.TCPFlagRST|expressions.TCPFlagACK, expressions.TCPFlagSYN)
+}
+
+// TCPRst matches TCP packets with RST set.
+func TCPRst() Match {
+	return TCPFlags(expressions.TCPFlagRST, expressions.TCPFlagRST)
+}
+
+// TCPXmasScan matches TCP packets with FIN, PSH and URG all set.
+func TCPXmasScan() Match {
+	xmas := expressions.TCPFlagFIN | expressions.TCPFlagPSH | expressions.TCPFlagURG
+	return TCPFlags(xmas, xmas)
+}
+
+// TCPNullScan matches TCP packets without any of FIN, SYN, RST, PSH, ACK or
+// URG set.
+func TCPNullScan() Match {
+	return TCPFlags(expressions.TCPFlagFIN|expressions.TCPFlagSYN|expressions.TCPFlagRST|expressions.TCPFlagPSH|expressions.TCPFlagACK|expressions.TCPFlagURG, 0)
+}
+
+// SourcePrefix adds a source prefix to the rule to match on (ex.
+// `198.51.100.0/24`). Host bits in the prefix are ignored.
+func SourcePrefix(prefix netip.Prefix) Match {
+	return func(b *builder) error {
+		if err := b.checkAddrFamily(prefix.Addr()); err != nil {
+			return err
+		}
+
+		e, err := expressions.CompareSourcePrefix(prefix)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// DestinationPrefix adds a destination prefix to the rule to match on (ex.
+// `198.51.100.0/24`). Host bits in the prefix are ignored.
+func DestinationPrefix(prefix netip.Prefix) Match {
+	return func(b *builder) error {
+		if err := b.checkAddrFamily(prefix.Addr()); err != nil {
+			return err
+		}
+
+		e, err := expressions.CompareDestinationPrefix(prefix)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// SourcePortRange adds an inclusive range of source ports to the rule to
+// match on.
+func SourcePortRange(start uint16, end uint16) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareSourcePortRange(start, end)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// DestinationPortRange adds an inclusive range of destination ports to the
+// rule to match on.
+func DestinationPortRange(start uint16, end uint16) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareDestinationPortRange(start, end)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// SourceAddressAnonymousSet adds an anonymous set of source addresses,
+// prefixes and ranges to the rule to match on, the equivalent of
+// `ip saddr { 192.0.2.1, 198.51.100.0/24 }` in nft. The set only exists as
+// part of the rule so it needs BuildRuleData. All entries must be of the same
+// IP family.
+func SourceAddressAnonymousSet(list []set.SetData) Match {
+	return func(b *builder) error {
+		return b.addAddressAnonymousSet(list, expressions.CompareSourceAddressSet)
+	}
+}
+
+// DestinationAddressAnonymousSet adds an anonymous set of destination
+// addresses, prefixes and ranges to the rule to match on, the equivalent of
+// `ip daddr { 192.0.2.1, 198.51.100.0/24 }` in nft. The set only exists as
+// part of the rule so it needs BuildRuleData. All entries must be of the same
+// IP family.
+func DestinationAddressAnonymousSet(list []set.SetData) Match {
+	return func(b *builder) error {
+		return b.addAddressAnonymousSet(list, expressions.CompareDestinationAddressSet)
+	}
+}
+
+// SourcePortAnonymousSet adds an anonymous set of source ports and port
+// ranges to the rule to match on, the equivalent of `th sport { 80, 8000-8080 }`
+// in nft. The set only exists as part of the rule so it needs BuildRuleData.
+func SourcePortAnonymousSet(list []set.SetData) Match {
+	return func(b *builder) error {
+		return b.addPortAnonymousSet(list, expressions.CompareSourcePortSet)
+	}
+}
+
+// DestinationPortAnonymousSet adds an anonymous set of destination ports and
+// port ranges to the rule to match on, the equivalent of
+// `th dport { 80, 8000-8080 }` in nft. The set only exists as part of the rule
+// so it needs BuildRuleData.
+func DestinationPortAnonymousSet(list []set.SetData) Match {
+	return func(b *builder) error {
+		return b.addPortAnonymousSet(list, expressions.CompareDestinationPortSet)
+	}
+}
+
+func (b *builder) addAddressAnonymousSet(list []set.SetData, compare func(*nftables.Set) ([]expr.Any, error)) error {
+	if len(list) == 0 {
+		return errors.New("anonymous set has no elements")
+	}
+
+	var first netip.Addr
+	for _, d := range list {
+		var addr netip.Addr
+		switch {
+		case d.Address.IsValid():
+			addr = d.Address
+		case d.AddressRangeStart.IsValid():
+			addr = d.AddressRangeStart
+		case d.Prefix.IsValid():
+			addr = d.Prefix.Addr()
+		default:
+			return fmt.Errorf("anonymous address set entry has no address: %+v", d)
+		}
+
+		if !first.IsValid() {
+			first = addr
+		}
+
+		if addr.Is4() != first.Is4() {
+			return errors.New("anonymous address set mixes ip families")
+		}
+	}
+
+	if err := b.checkAddrFamily(first); err != nil {
+		return err
+	}
+
+	keyType := nftables.TypeIPAddr
+	if first.Is6() {
+		keyType = nftables.TypeIP6Addr
+	}
+
+	return b.addAnonymousSet(keyType, list, compare)
+}
+
+func (b *builder) addPortAnonymousSet(list []set.SetData, compare func(*nftables.Set) ([]expr.Any, error)) error {
+	if len(list) == 0 {
+		return errors.New("anonymous set has no elements")
+	}
+
+	for _, d := range list {
+		if d.Port == 0 && d.PortRangeStart == 0 {
+			return fmt.Errorf("anonymous port set entry has no port: %+v", d)
+		}
+	}
+
+	return b.addAnonymousSet(nftables.TypeInetService, list, compare)
+}
+
+func (b *builder) addAnonymousSet(keyType nftables.SetDatatype, list []set.SetData, compare func(*nftables.Set) ([]expr.Any, error)) error {
+	elements, err := set.SetDataToElements(keyType, list)
+	if err != nil {
+		return err
+	}
+
+	// the lookup gets the name and ID of the real set when it's created, see ruleExprs
+	e, err := compare(&nftables.Set{KeyType: keyType, Anonymous: true, Constant: true, Interval: true})
+	if err != nil {
+		return err
+	}
+
+	lookup, ok := e[len(e)-1].(*expr.Lookup)
+	if !ok {
+		return errors.New("anonymous set comparison doesn't end in a lookup")
+	}
+
+	b.exprs = append(b.exprs, e...)
+	b.anonymousSets = append(b.anonymousSets, anonymousSet{
+		keyType:  keyType,
+		elements: elements,
+		lookup:   lookup,
+	})
+
+	return nil
+}
+
+// Not negates a match, for instance `Not(SourceAddressSet(allowlist))`
+// matches traffic whose source address is not in the set. The match must add
+// exactly one comparison to the rule, the comparison operator is inverted for
+// compares and ranges and lookups are inverted. Matches that don't compare
+// anything, like AddressFamily, or that compare more than one thing return an
+// error.
+func Not(m Match) Match {
+	return func(b *builder) error {
+		start, deferred := len(b.exprs), len(b.deferred)
+		if err := b.with(m); err != nil {
+			return err
+		}
+
+		// matches that depend on the family are negated once they're applied
+		if len(b.deferred) > deferred {
+			if len(b.deferred) > deferred+1 || len(b.exprs) > start {
+				return errors.New("match with more than one comparison can't be negated")
+			}
+			b.deferred[deferred].match = Not(b.deferred[deferred].match)
+			return nil
+		}
+
+		index := -1
+		for i := start; i < len(b.exprs); i++ {
+			switch b.exprs[i].(type) {
+			case *expr.Cmp, *expr.Lookup, *expr.Range:
+				if index != -1 {
+					return errors.New("match with more than one comparison can't be negated")
+				}
+				index = i
+			}
+		}
+
+		if index == -1 {
+			return errors.New("match without a comparison can't be negated")
+		}
+
+		// the expressions are replaced with negated copies so expressions passed in with Any aren't modified
+		switch v := b.exprs[index].(type) {
+		case *expr.Cmp:
+			op, err := negateCmpOp(v.Op)
+			if err != nil {
+				return err
+			}
+			n := *v
+			n.Op = op
+			b.exprs[index] = &n
+		case *expr.Range:
+			op, err := negateCmpOp(v.Op)
+			if err != nil {
+				return err
+			}
+			n := *v
+			n.Op = op
+			b.exprs[index] = &n
+		case *expr.Lookup:
+			n := *v
+			n.Invert = !n.Invert
+			b.exprs[index] = &n
+			for i := range b.anonymousSets {
+				if b.anonymousSets[i].lookup == v {
+					b.anonymousSets[i].lookup = &n
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+func negateCmpOp(op expr.CmpOp) (expr.CmpOp, error) {
+	switch op {
+	case expr.CmpOpEq:
+		return expr.CmpOpNeq, nil
+	case expr.CmpOpNeq:
+		return expr.CmpOpEq, nil
+	case expr.CmpOpLt:
+		return expr.CmpOpGte, nil
+	case expr.CmpOpGte:
+		return expr.CmpOpLt, nil
+	case expr.CmpOpGt:
+		return expr.CmpOpLte, nil
+	case expr.CmpOpLte:
+		return expr.CmpOpGt, nil
+	default:
+		return 0, fmt.Errorf("unknown comparison operator %v", op)
+	}
+}
+
+// Limit adds a packet rate limit to the rule, it matches while traffic is
+// under rate packets per unit plus burst packets. With over set it only
+// matches once the rate is exceeded instead, use that to drop the excess
+// (ex. `Build(expr.VerdictDrop, DestinationPort(22), Limit(10, expr.LimitTimeSecond, 20, true))`).
+func Limit(rate uint64, unit expr.LimitTime, burst uint32, over bool) Match {
+	return func(b *builder) error {
+		e, err := expressions.LimitPackets(rate, unit, burst, over)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e)
+
+		return nil
+	}
+}
+
+// Quota adds a byte quota to the rule, it matches until the rule has seen
+// bytes bytes. With over set it only matches once the quota is used up
+// instead. Use RuleData.Quota to see how much of the quota has been consumed.
+func Quota(bytes uint64, over bool) Match {
+	return func(b *builder) error {
+		e, err := expressions.Quota(bytes, over)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e)
+
+		return nil
+	}
+}
+
+// Log logs traffic that matches the rule to the kernel log at level with
+// prefix before the verdict is applied. To rate limit the logging of dropped
+// traffic, log in a rule of its own with Limit and an expr.VerdictContinue
+// verdict, placed before the drop rule; a limit in the drop rule itself would
+// also stop the drop once it's exceeded.
+func Log(prefix string, level expr.LogLevel) Match {
+	return func(b *builder) error {
+		e, err := expressions.Log(prefix, level)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e)
+
+		return nil
+	}
+}
+
+// NFLog sends traffic that matches the rule to NFLOG group for a userspace
+// collector before the verdict is applied. snaplen limits how many bytes of
+// each packet are copied, 0 copies the whole packet. See Log for rate
+// limiting.
+func NFLog(group uint16, snaplen uint32, prefix string) Match {
+	return func(b *builder) error {
+		e, err := expressions.NFLog(group, snaplen, prefix)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e)
+
+		return nil
+	}
+}
+
+// SourceAddressMeter adds or refreshes the source address of traffic in a
+// dynamic set with the given expressions attached to it, the nft meter
+// pattern. The expressions apply per source address, for instance
+// `SourceAddressMeter(set, time.Minute, &expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeMinute, Over: true})`
+// with a drop verdict drops sources that open more than 10 connections a
+// minute. The set must be created with set.WithDynamic, a timeout of 0 uses
+// the timeout of the set.
+func SourceAddressMeter(set *nftables.Set, timeout time.Duration, exprs ...expr.Any) Match {
+	return func(b *builder) error {
+		if err := b.checkSetKeyTypeFamily(set.KeyType); err != nil {
+			return err
+		}
+
+		e, err := expressions.MeterSourceAddress(set, timeout, exprs...)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// DestinationAddressMeter adds or refreshes the destination address of
+// traffic in a dynamic set with the given expressions attached to it, see
+// SourceAddressMeter.
+func DestinationAddressMeter(set *nftables.Set, timeout time.Duration, exprs ...expr.Any) Match {
+	return func(b *builder) error {
+		if err := b.checkSetKeyTypeFamily(set.KeyType); err != nil {
+			return err
+		}
+
+		e, err := expressions.MeterDestinationAddress(set, timeout, exprs...)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// ConnLimit adds a connection count to the rule, it matches while the rule
+// has seen n connections or fewer. With inverted set it only matches once
+// there are more than n instead, the equivalent of `ct count over n` in nft.
+// The connections are counted for the rule as a whole, use
+// SourceAddressConnLimit to count them per source address.
+func ConnLimit(n uint32, inverted bool) Match {
+	return func(b *builder) error {
+		e, err := expressions.ConnLimit(n, inverted)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e)
+
+		return nil
+	}
+}
+
+// SourceAddressConnLimit counts the connections of each source address of
+// traffic in a dynamic set and matches like ConnLimit on the count of the
+// source (ex. `Build(expr.VerdictDrop, TransportProtocol(expressions.TCP),
+// ConnectionTrackingState(expr.CtStateBitNEW), SourceAddressConnLimit(set, 10, true))`).
+// The set must be created with set.WithDynamic and no timeout, sources are
+// removed once they have no connections left, see NewSourceAddressConnLimit.
+func SourceAddressConnLimit(set *nftables.Set, n uint32, inverted bool) Match {
+	return func(b *builder) error {
+		if err := b.checkSetKeyTypeFamily(set.KeyType); err != nil {
+			return err
+		}
+
+		e, err := expressions.ConnLimitSourceAddress(set, n, inverted)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// NewSourceAddressConnLimit creates the dynamic set SourceAddressConnLimit
+// counts connections in, keyed on source addresses of family, and returns the
+// match on it. The rule has to use the same family.
+func NewSourceAddressConnLimit(c *nftables.Conn, table *nftables.Table, name string, family expressions.AddrFamily, n uint32, inverted bool) (Match, error) {
+	var keyType nftables.SetDatatype
+	switch family {
+	case expressions.IPv4:
+		keyType = nftables.TypeIPAddr
+	case expressions.IPv6:
+		keyType = nftables.TypeIP6Addr
+	default:
+		return nil, errors.New("connection limit set requires the ipv4 or ipv6 family")
+	}
+
+	s, err := set.New(c, table, name, keyType, set.WithDynamic(0))
+	if err != nil {
+		return nil, err
+	}
+
+	return SourceAddressConnLimit(s.Set(), n, inverted), nil
+}
+
+// Mark adds the packet mark of traffic to the rule to match on, only the bits
+// in mask are compared (ex. `Mark(0x100, 0xff00)`), use math.MaxUint32 to
+// compare the whole mark.
+func Mark(value uint32, mask uint32) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareMark(value, mask)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// ConnectionMark adds the connection mark of traffic to the rule to match on,
+// only the bits in mask are compared, see Mark.
+func ConnectionMark(value uint32, mask uint32) Match {
+	return func(b *builder) error {
+		e, err := expressions.CompareConnectionMark(value, mask)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// SetMark sets the bits in mask of the packet mark of traffic that matches
+// the rule to value and leaves the others as they are, for policy routing
+// with fwmark rules. Like the other statements it runs after every match of
+// the rule, wherever it's passed.
+func SetMark(value uint32, mask uint32) Match {
+	return func(b *builder) error {
+		e, err := expressions.SetMark(value, mask)
+		if err != nil {
+			return err
+		}
+		b.statements = append(b.statements, e...)
+
+		return nil
+	}
+}
+
+// SetConnectionMark sets the bits in mask of the connection mark of traffic
+// that matches the rule to value, see SetMark.
+func SetConnectionMark(value uint32, mask uint32) Match {
+	return func(b *builder) error {
+		e, err := expressions.SetConnectionMark(value, mask)
+		if err != nil {
+			return err
+		}
+		b.statements = append(b.statements, e...)
+
+		return nil
+	}
+}
+
+// SaveMark copies the packet mark of traffic that matches the rule to its
+// connection mark, so RestoreMark can put it back on the packets that follow.
+func SaveMark() Match {
+	return func(b *builder) error {
+		b.statements = append(b.statements, expressions.SaveMark()...)
+		return nil
+	}
+}
+
+// RestoreMark copies the connection mark of traffic that matches the rule to
+// its packet mark, see SaveMark.
+func RestoreMark() Match {
+	return func(b *builder) error {
+		b.statements = append(b.statements, expressions.RestoreMark()...)
+		return nil
+	}
+}
+
+// SocketUID adds the user ID of the socket that sent traffic to the rule to
+// match on. Only locally generated traffic has a socket so the rule has to be
+// in a chain on the output or postrouting hook, RuleTarget refuses it
+// anywhere else.
+func SocketUID(uid uint32) Match {
+	return func(b *builder) error {
+		b.exprs = append(b.exprs, expressions.CompareSocketUID(uid)...)
+		return nil
+	}
+}
+
+// SocketGID adds the group ID of the socket that sent traffic to the rule to
+// match on, see SocketUID.
+func SocketGID(gid uint32) Match {
+	return func(b *builder) error {
+		b.exprs = append(b.exprs, expressions.CompareSocketGID(gid)...)
+		return nil
+	}
+}
+
+// SocketCgroupV2 adds the cgroup v2 of the socket that sent traffic to the
+// rule to match on, the equivalent of `socket cgroupv2 level N "path"` in nft
+// where N is the depth of path. Sockets in cgroups below path match too. The
+// path, absolute or relative to utils.CgroupV2Root, is resolved to its ID on
+// the local filesystem when the rule is built, so the cgroup has to exist and
+// the rule has to be rebuilt if it's recreated. The rule has to be in a chain
+// on the output hook, RuleTarget refuses it anywhere else.
+func SocketCgroupV2(path string) Match {
+	return func(b *builder) error {
+		id, level, err := utils.ResolveCgroupV2(path)
+		if err != nil {
+			return err
+		}
+
+		e, err := expressions.CompareSocketCgroupV2(id, level)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, e...)
+
+		return nil
+	}
+}
+
+// ReversePathFilter matches traffic that fails a strict reverse path check,
+// traffic whose source address the host has no route back to through the
+// interface it came in on, for anti-spoofing on hosts with several
+// interfaces (ex. `Build(expr.VerdictDrop, ReversePathFilter())`). The
+// packet mark is part of the lookup so it follows policy routing. It works in
+// ip, ip6 and inet tables, the rule has to be in a chain on the prerouting,
+// input or forward hook.
+func ReversePathFilter() Match {
+	return func(b *builder) error {
+		b.exprs = append(b.exprs, expressions.ReversePathFilter()...)
+		return nil
+	}
+}
+
+// Payload adds a comparison of length bytes of traffic at offset from base to
+// the rule to match on, for header fields without a match of their own. Only
+// the bits in mask are compared unless it's nil (ex.
+// `Payload(expr.PayloadBaseNetworkHeader, expressions.IPv4TOSOffset, 1, []byte{0xfc}, []byte{46 << 2}, expr.CmpOpEq)`
+// for IPv4 traffic marked EF). Network header offsets depend on the family,
+// use AddressFamily so the rule only sees traffic of the family the offsets
+// are for.
+func Payload(base expr.PayloadBase, offset uint32, length uint32, mask []byte, value []byte, op expr.CmpOp) Match {
+	return func(b *builder) error {
+		return b.addPayload(base, offset, length, mask, value, op)
+	}
+}
+
+func (b *builder) addPayload(base expr.PayloadBase, offset uint32, length uint32, mask []byte, value []byte, op expr.CmpOp) error {
+	e, err := expressions.ComparePayload(base, offset, length, mask, value, op)
+	if err != nil {
+		return err
+	}
+	b.exprs = append(b.exprs, e...)
+
+	return nil
+}
+
+// errFamilyRequired is returned by matches on fields whose offset depends on the family when the rule doesn't set it
+func errFamilyRequired(field string) error {
+	return fmt.Errorf("%v match requires the ipv4 or ipv6 family", field)
+}
+
+// TTL adds the IPv4 TTL or IPv6 hop limit of traffic to the rule to compare
+// with ttl using op (ex. `TTL(expr.CmpOpLte, 1)`). The family decides which
+// field is compared so the rule has to use AddressFamily.
+func TTL(op expr.CmpOp, ttl uint8) Match {
+	return func(b *builder) error {
+		return b.withFamily(func(b *builder) error {
+			switch b.family {
+			case expressions.IPv4:
+				return b.addPayload(expr.PayloadBaseNetworkHeader, expressions.IPv4TTLOffset, expressions.IPv4TTLLen, nil, []byte{ttl}, op)
+			case expressions.IPv6:
+				return b.addPayload(expr.PayloadBaseNetworkHeader, expressions.IPv6HopLimitOffset, expressions.IPv6HopLimitLen, nil, []byte{ttl}, op)
+			default:
+				return errFamilyRequired("ttl")
+			}
+		})
+	}
+}
+
+// DSCP adds the DSCP of traffic, from the IPv4 TOS or the IPv6 traffic class,
+// to the rule to match on (ex. `DSCP(46)` for EF). The rule has to use
+// AddressFamily.
+func DSCP(dscp uint8) Match {
+	return func(b *builder) error {
+		if dscp > 0x3f {
+			return fmt.Errorf("invalid dscp %v", dscp)
+		}
+
+		return b.withFamily(func(b *builder) error {
+			switch b.family {
+			case expressions.IPv4:
+				return b.addPayload(
+					expr.PayloadBaseNetworkHeader, expressions.IPv4TOSOffset, expressions.IPv4TOSLen,
+					[]byte{expressions.IPv4DSCPMask}, []byte{dscp << 2}, expr.CmpOpEq,
+				)
+			case expressions.IPv6:
+				return b.addPayload(
+					expr.PayloadBaseNetworkHeader, expressions.IPv6TrafficClassOffset, expressions.IPv6TrafficClassLen,
+					binaryutil.BigEndian.PutUint16(expressions.IPv6DSCPMask), binaryutil.BigEndian.PutUint16(uint16(dscp)<<6), expr.CmpOpEq,
+				)
+			default:
+				return errFamilyRequired("dscp")
+			}
+		})
+	}
+}
+
+// IPLength adds the length of traffic to the rule to compare with length
+// using op, the total length with the header for IPv4 and the payload length
+// without it for IPv6, like `ip length` and `ip6 length` in nft. The rule
+// has to use AddressFamily.
+func IPLength(op expr.CmpOp, length uint16) Match {
+	return func(b *builder) error {
+		return b.withFamily(func(b *builder) error {
+			switch b.family {
+			case expressions.IPv4:
+				return b.addPayload(expr.PayloadBaseNetworkHeader, expressions.IPv4LengthOffset, expressions.IPv4LengthLen, nil, binaryutil.BigEndian.PutUint16(length), op)
+			case expressions.IPv6:
+				return b.addPayload(expr.PayloadBaseNetworkHeader, expressions.IPv6PayloadLengthOffset, expressions.IPv6PayloadLengthLen, nil, binaryutil.BigEndian.PutUint16(length), op)
+			default:
+				return errFamilyRequired("length")
+			}
+		})
+	}
+}
+
+// FragmentOffset adds the IPv4 fragment offset of traffic, in 8 byte units,
+// to the rule to compare with offset using op (ex.
+// `FragmentOffset(expr.CmpOpNeq, 0)` for fragments other than the first).
+// IPv6 keeps it in an extension header so the rule has to use the IPv4
+// family.
+func FragmentOffset(op expr.CmpOp, offset uint16) Match {
+	return func(b *builder) error {
+		if offset > expressions.IPv4FragOffsetMask {
+			return fmt.Errorf("invalid fragment offset %v", offset)
+		}
+
+		return b.withFamily(func(b *builder) error {
+			if b.family != expressions.IPv4 {
+				return errors.New("fragment offset match requires the ipv4 family")
+			}
+
+			return b.addPayload(
+				expr.PayloadBaseNetworkHeader, expressions.IPv4FragOffsetOffset, expressions.IPv4FragOffsetLen,
+				binaryutil.BigEndian.PutUint16(expressions.IPv4FragOffsetMask), binaryutil.BigEndian.PutUint16(offset), op,
+			)
+		})
+	}
+}
+
+// requireUDP is a check for matches on UDP payloads, which need the UDP transport
+func requireUDP(b *builder) error {
+	if b.transport != expressions.UDP {
+		return errors.New("udp payload match requires the udp transport")
+	}
+	return nil
+}
+
+// UDPPayload adds the bytes of the UDP payload of traffic at offset to the
+// rule to match on, for application signatures. Only the bits in mask are
+// compared unless it's nil and at most 16 bytes can be compared at a time,
+// use more than one UDPPayload for longer signatures. The rule must use the
+// UDP transport.
+func UDPPayload(offset uint32, mask []byte, value []byte) Match {
+	return func(b *builder) error {
+		err := b.addPayload(expr.PayloadBaseTransportHeader, expressions.UDPHeaderLen+offset, uint32(len(value)), mask, value, expr.CmpOpEq)
+		if err != nil {
+			return err
+		}
+		b.checks = append(b.checks, requireUDP)
+
+		return nil
+	}
+}
+
+// addStatement adds expressions that change traffic to the statements of the rule
+func (b *builder) addStatement(e []expr.Any, err error) error {
+	if err != nil {
+		return err
+	}
+	b.statements = append(b.statements, e...)
+
+	return nil
+}
+
+// SetTTL sets the IPv4 TTL or IPv6 hop limit of traffic that matches the rule
+// to ttl, to normalize it so hosts behind the rule can't be told apart by it.
+// The IPv4 header checksum is updated along with it. The family decides which
+// field is written so the rule has to use AddressFamily.
+func SetTTL(ttl uint8) Match {
+	return func(b *builder) error {
+		return b.withFamily(func(b *builder) error {
+			switch b.family {
+			case expressions.IPv4:
+				// the checksum is summed over 16 bit words, write the word the
+				// TTL shares with the protocol and keep the protocol as it is
+				return b.addStatement(expressions.SetPayload(
+					expr.PayloadBaseNetworkHeader, expressions.IPv4TTLOffset, 2, []byte{0xff, 0x00}, []byte{ttl, 0x00},
+					expr.CsumTypeInet, expressions.IPv4ChecksumOffset, 0,
+				))
+			case expressions.IPv6:
+				return b.addStatement(expressions.SetPayload(
+					expr.PayloadBaseNetworkHeader, expressions.IPv6HopLimitOffset, expressions.IPv6HopLimitLen, nil, []byte{ttl},
+					expr.CsumTypeNone, 0, 0,
+				))
+			default:
+				return errFamilyRequired("ttl")
+			}
+		})
+	}
+}
+
+// SetDSCP sets the DSCP of traffic that matches the rule to dscp, in the IPv4
+// TOS or the IPv6 traffic class, for QoS re-marking (ex. `SetDSCP(46)` for
+// EF). The ECN bits and the IPv4 header checksum are kept right. The rule has
+// to use AddressFamily.
+func SetDSCP(dscp uint8) Match {
+	return func(b *builder) error {
+		if dscp > 0x3f {
+			return fmt.Errorf("invalid dscp %v", dscp)
+		}
+
+		return b.withFamily(func(b *builder) error {
+			switch b.family {
+			case expressions.IPv4:
+				// the TOS is the second byte of the first word of the header,
+				// widen the write to the whole word for the checksum
+				return b.addStatement(expressions.SetPayload(
+					expr.PayloadBaseNetworkHeader, 0, 2,
+					binaryutil.BigEndian.PutUint16(uint16(expressions.IPv4DSCPMask)), binaryutil.BigEndian.PutUint16(uint16(dscp)<<2),
+					expr.CsumTypeInet, expressions.IPv4ChecksumOffset, 0,
+				))
+			case expressions.IPv6:
+				return b.addStatement(expressions.SetPayload(
+					expr.PayloadBaseNetworkHeader, expressions.IPv6TrafficClassOffset, expressions.IPv6TrafficClassLen,
+					binaryutil.BigEndian.PutUint16(expressions.IPv6DSCPMask), binaryutil.BigEndian.PutUint16(uint16(dscp)<<6),
+					expr.CsumTypeNone, 0, 0,
+				))
+			default:
+				return errFamilyRequired("dscp")
+			}
+		})
+	}
+}
+
+// SetMSS sets the MSS option of TCP SYN packets that match the rule to mss
+// when it's higher, for tunnels with a known overhead. The kernel never raises
+// the MSS and updates the TCP checksum itself. The rule must use the TCP
+// transport.
+func SetMSS(mss uint16) Match {
+	return func(b *builder) error {
+		if err := b.addStatement(expressions.SetTCPMSS(mss)); err != nil {
+			return err
+		}
+
+		return TCPFlags(expressions.TCPFlagSYN, expressions.TCPFlagSYN)(b)
+	}
+}
+
+// ClampMSSToPMTU clamps the MSS option of TCP SYN packets that match the rule
+// to the MTU of their route, so connections through tunnels don't stall on
+// segments the path can't carry (ex.
+// `Build(expr.VerdictAccept, TransportProtocol(expressions.TCP), ClampMSSToPMTU())`
+// in a forward chain). The route is only known after routing so the rule has
+// to be in a chain on the forward, output or postrouting hook, RuleTarget
+// refuses it anywhere else. The rule must use the TCP transport.
+func ClampMSSToPMTU() Match {
+	return func(b *builder) error {
+		b.statements = append(b.statements, expressions.ClampTCPMSSToPMTU()...)
+		return TCPFlags(expressions.TCPFlagSYN, expressions.TCPFlagSYN)(b)
+	}
+}
@@ -1,13 +1,20 @@
 package rule
 
 import (
+	"math"
 	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
 	"github.com/ngrok/firewall_toolkit/pkg/expressions"
+	"github.com/ngrok/firewall_toolkit/pkg/set"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func TestBuilder(t *testing.T) {
@@ -117,7 +124,771 @@ func TestBuilder(t *testing.T) {
 		rD := NewRuleData([]byte{0xd, 0xe, 0xa, 0xd}, res)
 
 		// we only test the private add since we don't yet have a good way to test responses from netlink, only messages to netlink
-		add(c, table, chain, rD)
+		add(c, table, chain, rD, rD.ID)
 		assert.Nil(t, c.Flush())
 	})
 }
+
+func TestBuilderInterfaces(t *testing.T) {
+	t.Run("names, prefixes and indexes", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictDrop,
+
+			InputInterface("eth0"),
+			InputInterfacePrefix("eth"),
+			InputInterfaceIndex(2),
+			OutputInterface("eth1"),
+			OutputInterfacePrefix("wg"),
+			OutputInterfaceIndex(3),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 13)
+		assert.Equal(t, &expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1}, exprs[0])
+		assert.Equal(t, &expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1}, exprs[2])
+		assert.Equal(t, &expr.Meta{Key: expr.MetaKeyIIF, Register: 1}, exprs[4])
+		assert.Equal(t, &expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1}, exprs[6])
+		assert.Equal(t, &expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1}, exprs[8])
+		assert.Equal(t, &expr.Meta{Key: expr.MetaKeyOIF, Register: 1}, exprs[10])
+		assert.IsType(t, &expr.Verdict{}, exprs[12])
+	})
+
+	t.Run("sets", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictAccept,
+
+			InputInterfaceSet(&nftables.Set{Name: "in", KeyType: nftables.TypeIFName}),
+			OutputInterfaceSet(&nftables.Set{Name: "out", KeyType: nftables.TypeIFIndex}),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 5)
+		assert.IsType(t, &expr.Lookup{}, exprs[1])
+		assert.IsType(t, &expr.Lookup{}, exprs[3])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := Build(expr.VerdictAccept, InputInterface(""))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictAccept, OutputInterface("averyveryverylongname"))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictAccept, InputInterfaceIndex(0))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictAccept, OutputInterfaceSet(&nftables.Set{Name: "bad", KeyType: nftables.TypeIPAddr}))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderICMP(t *testing.T) {
+	t.Run("type and code", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictDrop,
+
+			AddressFamily(expressions.IPv4),
+			TransportProtocol(expressions.ICMP),
+
+			ICMPType(expressions.ICMPRedirect),
+			ICMPCode(1),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 9)
+		assert.Equal(t, &expr.Cmp{Register: 1, Data: []byte{0x1}}, exprs[3])
+		assert.Equal(t, &expr.Cmp{Register: 1, Data: []byte{0x5}}, exprs[5])
+		assert.Equal(t, &expr.Cmp{Register: 1, Data: []byte{0x1}}, exprs[7])
+	})
+
+	t.Run("matches before the transport", func(t *testing.T) {
+		_, err := Build(
+			expr.VerdictAccept,
+
+			ICMPTypeSet(&nftables.Set{Name: "nd", KeyType: nftables.TypeICMP6Type}),
+
+			AddressFamily(expressions.IPv6),
+			TransportProtocol(expressions.ICMPv6),
+		)
+		assert.NoError(t, err)
+	})
+
+	t.Run("icmpv6 with ipv4", func(t *testing.T) {
+		_, err := Build(
+			expr.VerdictAccept,
+
+			AddressFamily(expressions.IPv4),
+			TransportProtocol(expressions.ICMPv6),
+
+			ICMPType(expressions.ICMPv6NeighborSolicitation),
+		)
+		assert.Error(t, err)
+	})
+
+	t.Run("icmp with ipv6", func(t *testing.T) {
+		_, err := Build(
+			expr.VerdictAccept,
+
+			AddressFamily(expressions.IPv6),
+			TransportProtocol(expressions.ICMP),
+		)
+		assert.Error(t, err)
+	})
+
+	t.Run("type without icmp transport", func(t *testing.T) {
+		_, err := Build(
+			expr.VerdictAccept,
+
+			TransportProtocol(expressions.TCP),
+
+			ICMPType(expressions.ICMPEchoRequest),
+		)
+		assert.Error(t, err)
+	})
+
+	t.Run("set key type mismatch", func(t *testing.T) {
+		_, err := Build(
+			expr.VerdictAccept,
+
+			TransportProtocol(expressions.ICMPv6),
+
+			ICMPTypeSet(&nftables.Set{Name: "bad", KeyType: nftables.TypeICMPType}),
+		)
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderTCPFlags(t *testing.T) {
+	t.Run("syn only", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictDrop,
+
+			TransportProtocol(expressions.TCP),
+
+			TCPSynOnly(),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 6)
+		assert.Equal(t, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{0x17}, Xor: []byte{0x0}}, exprs[3])
+		assert.Equal(t, &expr.Cmp{Register: 1, Data: []byte{0x2}}, exprs[4])
+	})
+
+	t.Run("presets", func(t *testing.T) {
+		for _, m := range []Match{TCPRst(), TCPXmasScan(), TCPNullScan()} {
+			_, err := Build(expr.VerdictDrop, TransportProtocol(expressions.TCP), m)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("requires tcp", func(t *testing.T) {
+		_, err := Build(expr.VerdictDrop, TCPSynOnly())
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictDrop, TransportProtocol(expressions.UDP), TCPRst())
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid flags", func(t *testing.T) {
+		_, err := Build(expr.VerdictDrop, TransportProtocol(expressions.TCP), TCPFlags(expressions.TCPFlagSYN, expressions.TCPFlagACK))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderRangesAndPrefixes(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictAccept,
+
+			AddressFamily(expressions.IPv6),
+			TransportProtocol(expressions.TCP),
+
+			SourcePrefix(netip.MustParsePrefix("2001:db8::/32")),
+			DestinationPrefix(netip.MustParsePrefix("2001:db8:1::/48")),
+			SourcePortRange(1024, 65535),
+			DestinationPortRange(8000, 8080),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 15)
+		assert.IsType(t, &expr.Bitwise{}, exprs[5])
+		assert.IsType(t, &expr.Bitwise{}, exprs[8])
+		assert.IsType(t, &expr.Range{}, exprs[11])
+		assert.IsType(t, &expr.Range{}, exprs[13])
+	})
+
+	t.Run("prefix family mismatch", func(t *testing.T) {
+		_, err := Build(
+			expr.VerdictAccept,
+
+			AddressFamily(expressions.IPv4),
+
+			SourcePrefix(netip.MustParsePrefix("2001:db8::/32")),
+		)
+		assert.Error(t, err)
+	})
+
+	t.Run("bad port range", func(t *testing.T) {
+		_, err := Build(expr.VerdictAccept, DestinationPortRange(8080, 8000))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderAnonymousSets(t *testing.T) {
+	addrs, err := set.AddressStringsToSetData([]string{"192.0.2.1", "198.51.100.0/24"})
+	assert.Nil(t, err)
+
+	ports, err := set.PortStringsToSetData([]string{"80", "8000-8080"})
+	assert.Nil(t, err)
+
+	t.Run("build rule data", func(t *testing.T) {
+		ruleData, err := BuildRuleData(
+			[]byte{0xd, 0xe, 0xa, 0xd},
+			expr.VerdictAccept,
+
+			AddressFamily(expressions.IPv4),
+			TransportProtocol(expressions.TCP),
+
+			SourceAddressAnonymousSet(addrs),
+			DestinationPortAnonymousSet(ports),
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0xd, 0xe, 0xa, 0xd}, ruleData.ID)
+		assert.Len(t, ruleData.Expressions, 9)
+		assert.Len(t, ruleData.anonymousSets, 2)
+
+		assert.Equal(t, nftables.TypeIPAddr, ruleData.anonymousSets[0].keyType)
+		assert.Same(t, ruleData.Expressions[5], ruleData.anonymousSets[0].lookup)
+		assert.Equal(t, []nftables.SetElement{
+			{Key: []byte{192, 0, 2, 1}},
+			{Key: []byte{192, 0, 2, 2}, IntervalEnd: true},
+			{Key: []byte{198, 51, 100, 0}},
+			{Key: []byte{198, 51, 101, 0}, IntervalEnd: true},
+		}, ruleData.anonymousSets[0].elements)
+
+		assert.Equal(t, nftables.TypeInetService, ruleData.anonymousSets[1].keyType)
+		assert.Same(t, ruleData.Expressions[7], ruleData.anonymousSets[1].lookup)
+	})
+
+	t.Run("build needs rule data", func(t *testing.T) {
+		_, err := Build(expr.VerdictAccept, SourceAddressAnonymousSet(addrs))
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := BuildRuleData([]byte{0x1}, expr.VerdictAccept, SourceAddressAnonymousSet([]set.SetData{}))
+		assert.Error(t, err)
+
+		_, err = BuildRuleData([]byte{0x1}, expr.VerdictAccept, SourceAddressAnonymousSet(ports))
+		assert.Error(t, err)
+
+		_, err = BuildRuleData([]byte{0x1}, expr.VerdictAccept, DestinationPortAnonymousSet(addrs))
+		assert.Error(t, err)
+
+		mixed, err := set.AddressStringsToSetData([]string{"192.0.2.1", "2001:db8::1"})
+		assert.Nil(t, err)
+		_, err = BuildRuleData([]byte{0x1}, expr.VerdictAccept, DestinationAddressAnonymousSet(mixed))
+		assert.Error(t, err)
+
+		_, err = BuildRuleData([]byte{0x1}, expr.VerdictAccept, AddressFamily(expressions.IPv6), SourceAddressAnonymousSet(addrs))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderNot(t *testing.T) {
+	t.Run("compare", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictDrop,
+
+			Not(SourceAddress(netip.MustParseAddr("192.0.2.1"))),
+			Not(Not(DestinationPort(443))),
+			Not(ConnectionTrackingState(expr.CtStateBitESTABLISHED)),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 7)
+		assert.Equal(t, expr.CmpOpNeq, exprs[1].(*expr.Cmp).Op)
+		assert.Equal(t, expr.CmpOpEq, exprs[3].(*expr.Cmp).Op)
+		assert.Equal(t, expr.CmpOpEq, exprs[5].(*expr.Cmp).Op)
+	})
+
+	t.Run("lookup and range", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictDrop,
+
+			Not(SourceAddressSet(&nftables.Set{Name: "allowlist", KeyType: nftables.TypeIPAddr})),
+			Not(DestinationPortRange(8000, 8080)),
+		)
+		assert.NoError(t, err)
+		assert.True(t, exprs[1].(*expr.Lookup).Invert)
+		assert.Equal(t, expr.CmpOpNeq, exprs[3].(*expr.Range).Op)
+	})
+
+	t.Run("anonymous set", func(t *testing.T) {
+		addrs, err := set.AddressStringsToSetData([]string{"192.0.2.1"})
+		assert.Nil(t, err)
+
+		ruleData, err := BuildRuleData([]byte{0x1}, expr.VerdictDrop, Not(SourceAddressAnonymousSet(addrs)))
+		assert.NoError(t, err)
+		assert.True(t, ruleData.anonymousSets[0].lookup.Invert)
+		assert.Same(t, ruleData.Expressions[1], ruleData.anonymousSets[0].lookup)
+	})
+
+	t.Run("any is not modified", func(t *testing.T) {
+		cmp := &expr.Cmp{Op: expr.CmpOpLt, Register: 1, Data: []byte{0x1}}
+		exprs, err := Build(expr.VerdictDrop, Not(Any(expressions.Meta(expr.MetaKeyMARK, 1), cmp)))
+		assert.NoError(t, err)
+		assert.Equal(t, expr.CmpOpGte, exprs[1].(*expr.Cmp).Op)
+		assert.Equal(t, expr.CmpOpLt, cmp.Op)
+	})
+
+	t.Run("can't be negated", func(t *testing.T) {
+		_, err := Build(expr.VerdictDrop, Not(AddressFamily(expressions.IPv4)))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictDrop, Not(Any(expressions.Counter())))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictDrop, Not(Any(&expr.Cmp{}, &expr.Cmp{})))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderLimitAndQuota(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictAccept,
+
+			TransportProtocol(expressions.TCP),
+
+			DestinationPort(22),
+			Limit(10, expr.LimitTimeSecond, 20, false),
+			Quota(1<<30, false),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 7)
+		assert.Equal(t, &expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeSecond, Burst: 20}, exprs[4])
+		assert.Equal(t, &expr.Quota{Bytes: 1 << 30}, exprs[5])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := Build(expr.VerdictAccept, Limit(0, expr.LimitTimeSecond, 0, false))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictAccept, Quota(0, false))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderMeter(t *testing.T) {
+	meter := &nftables.Set{Name: "ssh_meter", KeyType: nftables.TypeIPAddr, Dynamic: true, HasTimeout: true}
+	limit := &expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeMinute, Over: true}
+
+	t.Run("success", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictDrop,
+
+			AddressFamily(expressions.IPv4),
+			TransportProtocol(expressions.TCP),
+
+			DestinationPort(22),
+			ConnectionTrackingState(expr.CtStateBitNEW),
+			SourceAddressMeter(meter, time.Minute, limit),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 11)
+		assert.IsType(t, &expr.Payload{}, exprs[8])
+		assert.Equal(t, &expr.Dynset{SrcRegKey: 1, SetName: "ssh_meter", Operation: 1, Timeout: time.Minute, Exprs: []expr.Any{limit}}, exprs[9])
+	})
+
+	t.Run("family mismatch", func(t *testing.T) {
+		_, err := Build(expr.VerdictDrop, AddressFamily(expressions.IPv6), DestinationAddressMeter(meter, 0, limit))
+		assert.Error(t, err)
+	})
+
+	t.Run("not dynamic", func(t *testing.T) {
+		_, err := Build(expr.VerdictDrop, SourceAddressMeter(&nftables.Set{Name: "static", KeyType: nftables.TypeIPAddr}, 0, limit))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderLog(t *testing.T) {
+	t.Run("log", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictContinue,
+
+			TransportProtocol(expressions.TCP),
+
+			DestinationPort(22),
+			Limit(10, expr.LimitTimeSecond, 5, false),
+			Log("ssh: ", expr.LogLevelInfo),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 7)
+		assert.Equal(t, &expr.Log{Key: 1<<unix.NFTA_LOG_LEVEL | 1<<unix.NFTA_LOG_PREFIX, Level: expr.LogLevelInfo, Data: []byte("ssh: ")}, exprs[5])
+		assert.Equal(t, &expr.Verdict{Kind: expr.VerdictContinue}, exprs[6])
+	})
+
+	t.Run("nflog", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictDrop, NFLog(2, 64, "drop"))
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 2)
+		assert.Equal(t, &expr.Log{Key: 1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_SNAPLEN | 1<<unix.NFTA_LOG_PREFIX, Group: 2, Snaplen: 64, Data: []byte("drop")}, exprs[0])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := Build(expr.VerdictDrop, Log("drop", expr.LogLevel(42)))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictDrop, NFLog(1, 0, strings.Repeat("a", 128)))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderMark(t *testing.T) {
+	t.Run("match", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictAccept, Mark(0x100, 0xff00), Not(ConnectionMark(0x1, math.MaxUint32)))
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(0xff00), Xor: []byte{0x0, 0x0, 0x0, 0x0}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0x100)},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0x1)},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}, exprs)
+	})
+
+	t.Run("statements run after matches", func(t *testing.T) {
+		exprs, err := Build(
+			expr.VerdictAccept,
+
+			SetMark(0x2, math.MaxUint32),
+			SaveMark(),
+			TransportProtocol(expressions.TCP),
+			DestinationPort(443),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 9)
+		assert.Equal(t, []expr.Any{
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(0x2)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}, exprs[4:])
+	})
+
+	t.Run("masked set and restore", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictContinue, SetConnectionMark(0x10, 0xf0), RestoreMark())
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(0xffffff0f), Xor: binaryutil.NativeEndian.PutUint32(0x10)},
+			&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+			&expr.Verdict{Kind: expr.VerdictContinue},
+		}, exprs)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := Build(expr.VerdictAccept, Mark(0x1, 0))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictAccept, SetMark(0x100, 0xff))
+		assert.Error(t, err)
+
+		// statements don't compare anything
+		_, err = Build(expr.VerdictAccept, Not(SetMark(0x1, 0x1)))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderSocket(t *testing.T) {
+	exprs, err := Build(expr.VerdictDrop, SocketUID(1000), Not(SocketGID(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(1000)},
+		&expr.Meta{Key: expr.MetaKeySKGID, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}, exprs)
+
+	_, err = Build(expr.VerdictDrop, SocketCgroupV2("fwtk-test.slice/missing.service"))
+	assert.Error(t, err)
+}
+
+func TestBuilderReversePathFilter(t *testing.T) {
+	exprs, err := Build(expr.VerdictDrop, AddressFamily(expressions.IPv6), ReversePathFilter())
+	assert.NoError(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Fib{Register: 1, ResultOIF: true, FlagSADDR: true, FlagMARK: true, FlagIIF: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x0, 0x0, 0x0, 0x0}},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}, exprs[2:])
+}
+
+func TestBuilderConnLimit(t *testing.T) {
+	t.Run("rule", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictDrop, TransportProtocol(expressions.TCP), DestinationPort(22), ConnLimit(100, true))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Connlimit{Count: 100, Flags: expr.NFT_CONNLIMIT_F_INV}, exprs[len(exprs)-2])
+
+		_, err = Build(expr.VerdictDrop, ConnLimit(0, false))
+		assert.Error(t, err)
+	})
+
+	t.Run("per source", func(t *testing.T) {
+		connlimit := &nftables.Set{Name: "ssh_connlimit", KeyType: nftables.TypeIPAddr, Dynamic: true}
+
+		exprs, err := Build(
+			expr.VerdictDrop,
+
+			AddressFamily(expressions.IPv4),
+			TransportProtocol(expressions.TCP),
+
+			DestinationPort(22),
+			ConnectionTrackingState(expr.CtStateBitNEW),
+			SourceAddressConnLimit(connlimit, 10, true),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 11)
+		assert.Equal(t, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4}, exprs[8])
+		assert.Equal(t, &expr.Dynset{SrcRegKey: 1, SetName: "ssh_connlimit", Operation: 0, Exprs: []expr.Any{&expr.Connlimit{Count: 10, Flags: 1}}}, exprs[9])
+
+		_, err = Build(expr.VerdictDrop, AddressFamily(expressions.IPv6), SourceAddressConnLimit(connlimit, 10, true))
+		assert.Error(t, err)
+	})
+
+	t.Run("new set", func(t *testing.T) {
+		c, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+			return req, nil
+		}))
+		assert.NoError(t, err)
+		table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+
+		m, err := NewSourceAddressConnLimit(c, table, "connlimit6", expressions.IPv6, 10, true)
+		assert.NoError(t, err)
+
+		exprs, err := Build(expr.VerdictDrop, AddressFamily(expressions.IPv6), m)
+		assert.NoError(t, err)
+		dynset, ok := exprs[3].(*expr.Dynset)
+		assert.True(t, ok)
+		assert.Equal(t, "connlimit6", dynset.SetName)
+		assert.Equal(t, uint32(unix.NFT_DYNSET_OP_ADD), dynset.Operation)
+
+		_, err = NewSourceAddressConnLimit(c, table, "connlimit", expressions.AnyFamily, 10, true)
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderPayload(t *testing.T) {
+	t.Run("generic", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictAccept, Payload(expr.PayloadBaseNetworkHeader, expressions.IPv4TOSOffset, 1, []byte{0xfc}, []byte{46 << 2}, expr.CmpOpEq))
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 1, Len: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{0xfc}, Xor: []byte{0x0}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0xb8}},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}, exprs)
+
+		_, err = Build(expr.VerdictAccept, Payload(expr.PayloadBaseNetworkHeader, 0, 2, nil, []byte{0x1}, expr.CmpOpEq))
+		assert.Error(t, err)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictDrop, AddressFamily(expressions.IPv4), TTL(expr.CmpOpLte, 1))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 1}, exprs[2])
+		assert.Equal(t, &expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: []byte{0x1}}, exprs[3])
+
+		exprs, err = Build(expr.VerdictDrop, AddressFamily(expressions.IPv6), Not(TTL(expr.CmpOpEq, 255)))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 7, Len: 1}, exprs[2])
+		assert.Equal(t, &expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0xff}}, exprs[3])
+
+		// the family has to be known to pick the field
+		_, err = Build(expr.VerdictDrop, TTL(expr.CmpOpLte, 1))
+		assert.Error(t, err)
+	})
+
+	t.Run("family after", func(t *testing.T) {
+		first := &expr.Counter{Packets: 1}
+		second := &expr.Counter{Packets: 2}
+
+		exprs, err := Build(
+			expr.VerdictDrop,
+			Any(first), Not(TTL(expr.CmpOpEq, 64)), Any(second), IPLength(expr.CmpOpGt, 1500), AddressFamily(expressions.IPv6),
+		)
+		assert.NoError(t, err)
+
+		// the matches are applied where they were passed once the family is known
+		assert.Equal(t, []expr.Any{
+			first,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 7, Len: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0x40}},
+			second,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 4, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpGt, Register: 1, Data: []byte{0x05, 0xdc}},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		}, exprs[2:])
+
+		familyFirst, err := Build(
+			expr.VerdictDrop,
+			AddressFamily(expressions.IPv6), Any(first), Not(TTL(expr.CmpOpEq, 64)), Any(second), IPLength(expr.CmpOpGt, 1500),
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, familyFirst, exprs)
+
+		exprs, err = Build(expr.VerdictDrop, DSCP(46), FragmentOffset(expr.CmpOpNeq, 0), AddressFamily(expressions.IPv4))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0xb8}, exprs[4].(*expr.Cmp).Data)
+		assert.Equal(t, []byte{0x0, 0x0}, exprs[7].(*expr.Cmp).Data)
+
+		_, err = Build(expr.VerdictDrop, FragmentOffset(expr.CmpOpNeq, 0), AddressFamily(expressions.IPv6))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictDrop, Not(Any(first)), AddressFamily(expressions.IPv6))
+		assert.Error(t, err)
+	})
+
+	t.Run("dscp", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictAccept, AddressFamily(expressions.IPv4), DSCP(46))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{0xfc}, Xor: []byte{0x0}}, exprs[3])
+		assert.Equal(t, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0xb8}}, exprs[4])
+
+		exprs, err = Build(expr.VerdictAccept, AddressFamily(expressions.IPv6), DSCP(46))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 0, Len: 2}, exprs[2])
+		assert.Equal(t, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 2, Mask: []byte{0x0f, 0xc0}, Xor: []byte{0x0, 0x0}}, exprs[3])
+		assert.Equal(t, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x0b, 0x80}}, exprs[4])
+
+		_, err = Build(expr.VerdictAccept, AddressFamily(expressions.IPv4), DSCP(64))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictAccept, DSCP(46))
+		assert.Error(t, err)
+	})
+
+	t.Run("length and fragments", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictDrop, AddressFamily(expressions.IPv4), IPLength(expr.CmpOpGt, 1500), FragmentOffset(expr.CmpOpNeq, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpGt, Register: 1, Data: []byte{0x05, 0xdc}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 6, Len: 2},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 2, Mask: []byte{0x1f, 0xff}, Xor: []byte{0x0, 0x0}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0x0, 0x0}},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		}, exprs[2:])
+
+		exprs, err = Build(expr.VerdictDrop, AddressFamily(expressions.IPv6), IPLength(expr.CmpOpLt, 8))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 4, Len: 2}, exprs[2])
+
+		_, err = Build(expr.VerdictDrop, AddressFamily(expressions.IPv6), FragmentOffset(expr.CmpOpNeq, 0))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictDrop, AddressFamily(expressions.IPv4), FragmentOffset(expr.CmpOpEq, 0x2000))
+		assert.Error(t, err)
+	})
+
+	t.Run("udp payload", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictDrop, TransportProtocol(expressions.UDP), DestinationPort(443), UDPPayload(0, []byte{0xc0}, []byte{0xc0}))
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 8, Len: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{0xc0}, Xor: []byte{0x0}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0xc0}},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		}, exprs[4:])
+
+		_, err = Build(expr.VerdictDrop, TransportProtocol(expressions.TCP), UDPPayload(0, nil, []byte{0x1}))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictDrop, TransportProtocol(expressions.UDP), UDPPayload(0, nil, nil))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderMangle(t *testing.T) {
+	t.Run("ttl", func(t *testing.T) {
+		_, err := Build(expr.VerdictAccept, SetTTL(64))
+		assert.Error(t, err)
+
+		exprs, err := Build(expr.VerdictAccept, AddressFamily(expressions.IPv4), SetTTL(64))
+		assert.NoError(t, err)
+		familyAfter, err := Build(expr.VerdictAccept, SetTTL(64), AddressFamily(expressions.IPv4))
+		assert.NoError(t, err)
+		assert.Equal(t, exprs, familyAfter)
+		assert.Equal(t, []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 2},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 2, Mask: []byte{0x00, 0xff}, Xor: []byte{0x40, 0x00}},
+			&expr.Payload{OperationType: expr.PayloadWrite, SourceRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 2, CsumType: expr.CsumTypeInet, CsumOffset: 10},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}, exprs[2:])
+
+		exprs, err = Build(expr.VerdictAccept, AddressFamily(expressions.IPv6), SetTTL(64))
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{
+			&expr.Immediate{Register: 1, Data: []byte{0x40}},
+			&expr.Payload{OperationType: expr.PayloadWrite, SourceRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 7, Len: 1},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}, exprs[2:])
+	})
+
+	t.Run("dscp", func(t *testing.T) {
+		// statements come after the matches wherever they're passed
+		exprs, err := Build(expr.VerdictAccept, AddressFamily(expressions.IPv4), SetDSCP(46), DestinationPort(5060), TransportProtocol(expressions.UDP))
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 0, Len: 2},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 2, Mask: []byte{0xff, 0x03}, Xor: []byte{0x00, 0xb8}},
+			&expr.Payload{OperationType: expr.PayloadWrite, SourceRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 0, Len: 2, CsumType: expr.CsumTypeInet, CsumOffset: 10},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}, exprs[6:])
+
+		exprs, err = Build(expr.VerdictAccept, AddressFamily(expressions.IPv6), SetDSCP(46))
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 0, Len: 2},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 2, Mask: []byte{0xf0, 0x3f}, Xor: []byte{0x0b, 0x80}},
+			&expr.Payload{OperationType: expr.PayloadWrite, SourceRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 0, Len: 2},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}, exprs[2:])
+
+		_, err = Build(expr.VerdictAccept, AddressFamily(expressions.IPv4), SetDSCP(64))
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictAccept, SetDSCP(46))
+		assert.Error(t, err)
+
+		// statements that depend on the family stay in the order they were passed
+		exprs, err = Build(expr.VerdictAccept, SetDSCP(46), SetMark(0x1, 0xffffffff), AddressFamily(expressions.IPv6))
+		assert.NoError(t, err)
+		assert.IsType(t, &expr.Payload{}, exprs[2])
+		assert.Equal(t, &expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(0x1)}, exprs[5])
+	})
+
+	t.Run("mss", func(t *testing.T) {
+		exprs, err := Build(expr.VerdictAccept, TransportProtocol(expressions.TCP), ClampMSSToPMTU())
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{0x02}, Xor: []byte{0x00}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x02}},
+			&expr.Rt{Register: 1, Key: expr.RtTCPMSS},
+			&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 2, Size: 2},
+			&expr.Exthdr{SourceRegister: 1, Type: 2, Offset: 2, Len: 2, Op: expr.ExthdrOpTcpopt},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}, exprs[2:])
+
+		exprs, err = Build(expr.VerdictAccept, TransportProtocol(expressions.TCP), SetMSS(1400))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Immediate{Register: 1, Data: []byte{0x05, 0x78}}, exprs[5])
+
+		_, err = Build(expr.VerdictAccept, TransportProtocol(expressions.UDP), ClampMSSToPMTU())
+		assert.Error(t, err)
+
+		_, err = Build(expr.VerdictAccept, TransportProtocol(expressions.TCP), SetMSS(0))
+		assert.Error(t, err)
+	})
+}
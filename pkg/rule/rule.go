@@ -8,58 +8,155 @@ package rule
 import (
 	"bytes"
 	"fmt"
+	"slices"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
 )
 
 // RuleTarget represents a location to manipulate nftables rules
 type RuleTarget struct {
 	table *nftables.Table
 	chain *nftables.Chain
+	owner string
+	// chains rules can jump or go to that may not be in the kernel yet
+	chains []*nftables.Chain
 }
 
+// Defines an optional setting for a rule target
+type RuleTargetOption func(*RuleTarget)
+
 // Create a new location to manipulate nftables rules
-func NewRuleTarget(table *nftables.Table, chain *nftables.Chain) RuleTarget {
-	return RuleTarget{
+func NewRuleTarget(table *nftables.Table, chain *nftables.Chain, opts ...RuleTargetOption) RuleTarget {
+	ruleTarget := RuleTarget{
 		table: table,
 		chain: chain,
 	}
+
+	for _, opt := range opts {
+		opt(&ruleTarget)
+	}
+
+	return ruleTarget
+}
+
+// WithOwner namespaces the IDs of rules managed by a rule target with an owner that is stored in the rule user
+// data. Add, Delete, Exists, Get and Update will only see rules that carry the owner, any other rules in the chain,
+// like ones added by hand with nft or by other tools, are left alone.
+//
+// Rules added before the owner was set only carry their raw ID. To migrate them, Add, Delete, Exists and Update adopt
+// a raw ID rule when its ID is one they were given: Update replaces it to add the owner, Add sees it as already there
+// and Delete removes it. Raw ID rules whose ID isn't given, like rules dropped from the list passed to Update, are left
+// alone and have to be deleted by ID. Get and GetForeign don't know which IDs to adopt so they see every raw ID rule as
+// foreign.
+//
+// Without an owner every rule in the chain is considered to be managed by the rule target.
+func WithOwner(owner string) RuleTargetOption {
+	return func(r *RuleTarget) {
+		r.owner = owner
+	}
+}
+
+// WithChains lets rules jump or go to chains that are added in the same batch as the rules, like regular chains
+// created with RegularChain before the first flush. Jump and goto targets that aren't one of these chains are checked
+// against the chains that already exist in the table.
+func WithChains(chains ...*nftables.Chain) RuleTargetOption {
+	return func(r *RuleTarget) {
+		r.chains = append(r.chains, chains...)
+	}
 }
 
 // Add a rule with a given ID to a specific table and chain, returns true if the rule was added
+//
+// The rule is put in the chain according to its Placement, by default it is appended to the end of the chain.
 func (r *RuleTarget) Add(c *nftables.Conn, ruleData RuleData) (bool, error) {
-	exists, err := r.Exists(c, ruleData)
+	rules, _, err := r.getRules(c, ruleData.ID)
 	if err != nil {
 		return false, err
 	}
 
-	if exists {
+	if rule := findRuleByID(ruleData.ID, rules); rule.Table != nil {
 		return false, nil
 	}
 
-	add(c, r.table, r.chain, ruleData)
+	if err := validateChain(r.table, r.chain, ruleData.Expressions); err != nil {
+		return false, fmt.Errorf("rule %x can't be added to chain: %v", ruleData.ID, err)
+	}
+
+	if err := r.validateJumps(c, []RuleData{ruleData}); err != nil {
+		return false, err
+	}
+
+	userData, err := r.userData(ruleData)
+	if err != nil {
+		return false, err
+	}
+
+	if err := place(c, r.table, r.chain, ruleData, userData, rules); err != nil {
+		return false, err
+	}
+
 	return true, nil
 }
 
-func add(c *nftables.Conn, table *nftables.Table, chain *nftables.Chain, ruleData RuleData) {
+func add(c *nftables.Conn, table *nftables.Table, chain *nftables.Chain, ruleData RuleData, userData []byte) error {
+	exprs, err := ruleExprs(c, table, ruleData)
+	if err != nil {
+		return err
+	}
+
 	c.AddRule(&nftables.Rule{
 		Table:    table,
 		Chain:    chain,
-		Exprs:    ruleData.Expressions,
-		UserData: ruleData.ID,
+		Exprs:    exprs,
+		UserData: userData,
 	})
+
+	return nil
+}
+
+func place(c *nftables.Conn, table *nftables.Table, chain *nftables.Chain, ruleData RuleData, userData []byte, existingRules []*nftables.Rule) error {
+	insert, position, err := ruleData.Placement.resolve(existingRules)
+	if err != nil {
+		return err
+	}
+
+	if !insert && position == 0 {
+		return add(c, table, chain, ruleData, userData)
+	}
+
+	exprs, err := ruleExprs(c, table, ruleData)
+	if err != nil {
+		return err
+	}
+
+	rule := &nftables.Rule{
+		Table:    table,
+		Chain:    chain,
+		Position: position,
+		Exprs:    exprs,
+		UserData: userData,
+	}
+
+	if insert {
+		c.InsertRule(rule)
+	} else {
+		c.AddRule(rule)
+	}
+
+	return nil
 }
 
 // Delete a rule with a given ID from a specific table and chain, returns true if the rule was deleted
 func (r *RuleTarget) Delete(c *nftables.Conn, ruleData RuleData) (bool, error) {
-	rules, err := c.GetRules(r.table, r.chain)
+	rules, _, err := r.getRules(c, ruleData.ID)
 	if err != nil {
 		return false, err
 	}
 
 	rule := findRuleByID(ruleData.ID, rules)
 
-	if rule.Table.Name == "" {
+	if rule.Table == nil {
 		// if the rule we get back is empty (the final return in findRuleByID) we didn't find it
 		return false, nil
 	}
@@ -73,7 +170,7 @@ func (r *RuleTarget) Delete(c *nftables.Conn, ruleData RuleData) (bool, error) {
 
 // Determine if a rule with a given ID exists in a specific table and chain
 func (r *RuleTarget) Exists(c *nftables.Conn, ruleData RuleData) (bool, error) {
-	rules, err := c.GetRules(r.table, r.chain)
+	rules, _, err := r.getRules(c, ruleData.ID)
 	if err != nil {
 		return false, err
 	}
@@ -88,37 +185,149 @@ func (r *RuleTarget) Exists(c *nftables.Conn, ruleData RuleData) (bool, error) {
 	return true, nil
 }
 
-// Compare existing and incoming rule IDs adding/removing the difference
+// Compare existing and incoming rule IDs adding/removing the difference, replacing rules whose expressions changed
+// and moving rules so the chain is in the same order as the incoming rules
 //
-// First return value is true if the number of rules has changed, false if there were no updates. The second
-// and third return values indicate the number of rules added or removed, respectively.
-func (r *RuleTarget) Update(c *nftables.Conn, rules []RuleData) (bool, int, int, error) {
-	var modified bool
-	existingRules, err := c.GetRules(r.table, r.chain)
+// First return value is true if the chain has changed, false if there were no updates. The second, third and fourth
+// return values indicate the number of rules added, removed or replaced, respectively. Rules that were only moved
+// aren't counted.
+//
+// Expressions are compared after ignoring values the kernel keeps updating, like counters, so a rule is only
+// replaced when what it matches or does changed. Replaced rules keep their handle and position. Expressions the
+// nftables library can't read back from the kernel, like socket and rt, are left out of the comparison.
+//
+// Moves are a delete and an insert so all the changes have to be flushed together, nftables applies a flush as a
+// single transaction so traffic never sees a partially updated chain. Placement is ignored since the order of the
+// incoming rules decides where each rule goes.
+//
+// Rules that aren't managed by this rule target (see WithOwner) are never touched, rules are placed around them.
+// Managed rules whose comment changed or that still use the old raw ID user data are replaced to rewrite it, with an
+// owner this is how raw ID rules with one of the incoming IDs are migrated.
+func (r *RuleTarget) Update(c *nftables.Conn, rules []RuleData) (bool, int, int, int, error) {
+	ids := make([][]byte, len(rules))
+	for i, ruleData := range rules {
+		ids[i] = ruleData.ID
+	}
+
+	existingRules, _, err := r.getRules(c, ids...)
 	if err != nil {
-		return false, 0, 0, fmt.Errorf("error getting existing rules for update: %v", err)
+		return false, 0, 0, 0, fmt.Errorf("error getting existing rules for update: %v", err)
 	}
 
-	addRDList, removeRDList := genRuleDelta(existingRules, rules)
+	anonymousSets, err := r.getAnonymousSetElements(c, existingRules)
+	if err != nil {
+		return false, 0, 0, 0, fmt.Errorf("error getting anonymous sets for update: %v", err)
+	}
 
-	if len(removeRDList) > 0 {
-		for _, rule := range removeRDList {
-			err := c.DelRule(rule)
-			if err != nil {
-				return false, 0, 0, err
+	plan, err := genRulePlan(r.table.Family, existingRules, rules, anonymousSets)
+	if err != nil {
+		return false, 0, 0, 0, err
+	}
+
+	// encode and validate everything up front so a bad ID, comment or expression doesn't leave a partial update queued
+	userData := make(map[string][]byte, len(rules))
+	for _, ruleData := range rules {
+		if err := validateChain(r.table, r.chain, ruleData.Expressions); err != nil {
+			return false, 0, 0, 0, fmt.Errorf("rule %x can't be added to chain: %v", ruleData.ID, err)
+		}
+
+		encoded, err := r.userData(ruleData)
+		if err != nil {
+			return false, 0, 0, 0, err
+		}
+		userData[string(ruleData.ID)] = encoded
+	}
+
+	if err := r.validateJumps(c, rules); err != nil {
+		return false, 0, 0, 0, err
+	}
+
+	for _, rule := range plan.remove {
+		if err := c.DelRule(rule); err != nil {
+			return false, 0, 0, 0, err
+		}
+	}
+
+	for _, replaced := range plan.replace {
+		exprs, err := ruleExprs(c, r.table, replaced.ruleData)
+		if err != nil {
+			return false, 0, 0, 0, err
+		}
+
+		c.ReplaceRule(&nftables.Rule{
+			Table:    r.table,
+			Chain:    r.chain,
+			Handle:   replaced.handle,
+			Exprs:    exprs,
+			UserData: userData[string(replaced.ruleData.ID)],
+		})
+	}
+
+	for _, planned := range plan.place {
+		exprs, err := ruleExprs(c, r.table, planned.ruleData)
+		if err != nil {
+			return false, 0, 0, 0, err
+		}
+
+		rule := &nftables.Rule{
+			Table:    r.table,
+			Chain:    r.chain,
+			Position: planned.position,
+			Exprs:    exprs,
+			UserData: userData[string(planned.ruleData.ID)],
+		}
+
+		if planned.insert {
+			c.InsertRule(rule)
+		} else {
+			c.AddRule(rule)
+		}
+	}
+
+	modified := len(plan.remove) > 0 || len(plan.replace) > 0 || len(plan.place) > 0
+	return modified, plan.added, plan.removed, len(plan.replace), nil
+}
+
+// validateJumps checks that the chains the rules jump or go to exist, either in the kernel or in the chains passed with
+// WithChains. The chains in the kernel are only listed if a rule jumps somewhere else so other rule targets don't pay
+// for it.
+func (r *RuleTarget) validateJumps(c *nftables.Conn, rules []RuleData) error {
+	known := []*nftables.Chain{}
+	for _, chain := range r.chains {
+		if chain.Table == nil || chain.Table.Name == r.table.Name {
+			known = append(known, chain)
+		}
+	}
+
+	unknown := false
+	for _, ruleData := range rules {
+		for _, target := range jumpTargets(ruleData.Expressions) {
+			if !slices.ContainsFunc(known, func(c *nftables.Chain) bool { return c.Name == target }) {
+				unknown = true
 			}
-			modified = true
 		}
 	}
 
-	if len(addRDList) > 0 {
-		for _, rule := range addRDList {
-			add(c, r.table, r.chain, rule)
-			modified = true
+	if unknown {
+		chains, err := c.ListChainsOfTableFamily(r.table.Family)
+		if err != nil {
+			return fmt.Errorf("error listing chains to validate jumps: %v", err)
+		}
+
+		for _, chain := range chains {
+			if chain.Table.Name == r.table.Name {
+				known = append(known, chain)
+			}
 		}
 	}
 
-	return modified, len(addRDList), len(removeRDList), nil
+	for _, ruleData := range rules {
+		if err := validateJumps(r.chain, known, ruleData.Expressions); err != nil {
+			return fmt.Errorf("rule %x has an invalid jump: %v", ruleData.ID, err)
+		}
+	}
+
+	return nil
 }
 
 // Get the nftables table and chain associated with this RuleTarget
@@ -127,27 +336,162 @@ func (r *RuleTarget) GetTableAndChain() (*nftables.Table, *nftables.Chain) {
 }
 
 // Get the rule data associated with a table and chain
+//
+// Only rules managed by this rule target are returned, positions are relative to the other managed rules.
 func (r *RuleTarget) Get(c *nftables.Conn) ([]RuleData, error) {
-	rules, err := c.GetRules(r.table, r.chain)
+	rules, _, err := r.getRules(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return rulesToRuleData(rules), nil
+}
+
+// Get the rules in the table and chain that aren't managed by this rule target, they are never modified by it
+//
+// This is always empty for a rule target without an owner. Positions are relative to the other foreign rules.
+func (r *RuleTarget) GetForeign(c *nftables.Conn) ([]RuleData, error) {
+	_, foreign, err := r.getRules(c)
 	if err != nil {
 		return nil, err
 	}
 
+	return rulesToRuleData(foreign), nil
+}
+
+func rulesToRuleData(rules []*nftables.Rule) []RuleData {
 	ruleData := make([]RuleData, len(rules))
 	for i, rule := range rules {
+		decoded := decodeUserData(rule.UserData)
 		ruleData[i] = RuleData{
-			ID:          rule.UserData,
+			ID:          decoded.id,
+			Comment:     decoded.comment,
 			Expressions: rule.Exprs,
+			Handle:      rule.Handle,
+			Position:    i,
 		}
 	}
 
-	return ruleData, nil
+	return ruleData
+}
+
+// getRules returns the rules in the chain split into ones managed by this rule target and foreign ones, raw ID rules
+// with one of the ids are adopted as managed
+func (r *RuleTarget) getRules(c *nftables.Conn, ids ...[]byte) ([]*nftables.Rule, []*nftables.Rule, error) {
+	rules, err := c.GetRules(r.table, r.chain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owned, foreign := r.splitRules(rules, ids...)
+	return owned, foreign, nil
+}
+
+func (r *RuleTarget) splitRules(rules []*nftables.Rule, ids ...[]byte) (owned []*nftables.Rule, foreign []*nftables.Rule) {
+	if r.owner == "" {
+		return rules, nil
+	}
+
+	adopt := func(id []byte) bool {
+		return len(id) > 0 && slices.ContainsFunc(ids, func(i []byte) bool { return bytes.Equal(i, id) })
+	}
+
+	for _, rule := range rules {
+		decoded := decodeUserData(rule.UserData)
+		if (!decoded.legacy && decoded.owner == r.owner) || (decoded.legacy && adopt(decoded.id)) {
+			owned = append(owned, rule)
+		} else {
+			foreign = append(foreign, rule)
+		}
+	}
+
+	return owned, foreign
+}
+
+// userData returns the rule user data for a rule, including the owner if there is one
+func (r *RuleTarget) userData(ruleData RuleData) ([]byte, error) {
+	return encodeUserData(ruleData.ID, r.owner, ruleData.comment())
+}
+
+// getAnonymousSetElements returns the elements of the anonymous sets used by each rule, keyed by rule handle and in
+// the order the sets are used in the rule
+func (r *RuleTarget) getAnonymousSetElements(c *nftables.Conn, rules []*nftables.Rule) (map[uint64][][]nftables.SetElement, error) {
+	sets := map[uint64][][]nftables.SetElement{}
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			lookup, ok := e.(*expr.Lookup)
+			if !ok || !isAnonymousSetName(lookup.SetName) {
+				continue
+			}
+
+			set, err := c.GetSetByName(r.table, lookup.SetName)
+			if err != nil {
+				return nil, fmt.Errorf("error getting anonymous set %v: %v", lookup.SetName, err)
+			}
+
+			elements, err := c.GetSetElements(set)
+			if err != nil {
+				return nil, fmt.Errorf("error getting elements of anonymous set %v: %v", lookup.SetName, err)
+			}
+
+			sets[rule.Handle] = append(sets[rule.Handle], elements)
+		}
+	}
+
+	return sets, nil
+}
+
+// ruleExprs adds the anonymous sets of a rule to the current batch and returns the rule expressions with their
+// lookups pointed at the new sets
+func ruleExprs(c *nftables.Conn, table *nftables.Table, ruleData RuleData) ([]expr.Any, error) {
+	if len(ruleData.anonymousSets) == 0 {
+		return ruleData.Expressions, nil
+	}
+
+	lookups := make(map[*expr.Lookup]*expr.Lookup, len(ruleData.anonymousSets))
+	for _, anonymous := range ruleData.anonymousSets {
+		set := &nftables.Set{
+			Table:     table,
+			KeyType:   anonymous.keyType,
+			Anonymous: true,
+			Constant:  true,
+			Interval:  true,
+		}
+
+		if err := c.AddSet(set, anonymous.elements); err != nil {
+			return nil, fmt.Errorf("error adding anonymous set: %v", err)
+		}
+
+		lookup := *anonymous.lookup
+		lookup.SetName = set.Name
+		lookup.SetID = set.ID
+		lookups[anonymous.lookup] = &lookup
+	}
+
+	// the expressions are copied rather than updated in place so the rule data can be sent again
+	exprs := make([]expr.Any, len(ruleData.Expressions))
+	for i, e := range ruleData.Expressions {
+		exprs[i] = e
+		if lookup, ok := e.(*expr.Lookup); ok {
+			if replacement, ok := lookups[lookup]; ok {
+				exprs[i] = replacement
+			}
+		}
+	}
+
+	return exprs, nil
 }
 
 func genRuleDelta(existingRules []*nftables.Rule, newRules []RuleData) (add []RuleData, remove []*nftables.Rule) {
 	existingRuleMap := make(map[string]*nftables.Rule)
 	for _, existingRule := range existingRules {
-		existingRuleMap[string(existingRule.UserData)] = existingRule
+		id := string(decodeUserData(existingRule.UserData).id)
+		if _, exists := existingRuleMap[id]; exists {
+			// only the first rule with a given ID is tracked, any duplicates are removed
+			remove = append(remove, existingRule)
+			continue
+		}
+		existingRuleMap[id] = existingRule
 	}
 
 	for _, ruleData := range newRules {
@@ -167,7 +511,7 @@ func genRuleDelta(existingRules []*nftables.Rule, newRules []RuleData) (add []Ru
 
 func findRuleByID(id []byte, rules []*nftables.Rule) *nftables.Rule {
 	for _, rule := range rules {
-		if bytes.Equal(rule.UserData, id) {
+		if bytes.Equal(decodeUserData(rule.UserData).id, id) {
 			return rule
 		}
 	}
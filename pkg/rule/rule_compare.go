@@ -0,0 +1,114 @@
+//go:build linux
+
+package rule
+
+import (
+	"bytes"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// exprsEqual compares the expressions of an existing rule, as read back from the kernel, with the desired expressions
+// ignoring state the kernel keeps for a rule, like counters and quota usage, and identifiers that are only meaningful
+// inside a single netlink batch, like set IDs
+//
+// The library can't decode every expression it encodes, some are dropped (like socket, rt and byteorder) and some
+// lose fields (like the source register of a ct write). The desired expressions are put through the same decoder the
+// existing ones came out of so both sides lose the same things, then both are compared in their marshalled form. A
+// change that is only in what the decoder drops isn't seen, the rule has to change in some other way to be replaced.
+func exprsEqual(family nftables.TableFamily, existing []expr.Any, desired []expr.Any) bool {
+	decoded, err := decodeExprs(byte(family), desired)
+	if err != nil {
+		return false
+	}
+
+	if len(existing) != len(decoded) {
+		return false
+	}
+
+	for i := range existing {
+		a, err := expr.Marshal(byte(family), normalizeExpr(existing[i]))
+		if err != nil {
+			return false
+		}
+
+		b, err := expr.Marshal(byte(family), normalizeExpr(decoded[i]))
+		if err != nil {
+			return false
+		}
+
+		if !bytes.Equal(a, b) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeExprs marshals expressions and decodes them again with the decoder the library uses for rules read from the
+// kernel. It isn't exported but dynset decodes its list of expressions with it, which is the same format as the list
+// of expressions of a rule.
+func decodeExprs(family byte, exprs []expr.Any) ([]expr.Any, error) {
+	if len(exprs) == 0 {
+		return []expr.Any{}, nil
+	}
+
+	elems := make([]netlink.Attribute, len(exprs))
+	for i, e := range exprs {
+		data, err := expr.Marshal(family, e)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM, Data: data}
+	}
+
+	list, err := netlink.MarshalAttributes(elems)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{{Type: expr.NFTA_DYNSET_EXPRESSIONS, Data: list}})
+	if err != nil {
+		return nil, err
+	}
+
+	dynset := &expr.Dynset{}
+	if err := expr.Unmarshal(family, data, dynset); err != nil {
+		return nil, err
+	}
+
+	return dynset.Exprs, nil
+}
+
+// normalizeExpr returns a copy of the expression with any kernel managed or batch local values zeroed
+func normalizeExpr(e expr.Any) expr.Any {
+	switch v := e.(type) {
+	case *expr.Counter:
+		return &expr.Counter{}
+	case *expr.Quota:
+		n := *v
+		n.Consumed = 0
+		return &n
+	case *expr.Lookup:
+		n := *v
+		n.SetID = 0
+		// anonymous sets are named by the kernel, their elements are compared separately
+		if isAnonymousSetName(n.SetName) {
+			n.SetName = ""
+		}
+		return &n
+	case *expr.Dynset:
+		n := *v
+		n.SetID = 0
+		n.Exprs = make([]expr.Any, len(v.Exprs))
+		for i, nested := range v.Exprs {
+			n.Exprs[i] = normalizeExpr(nested)
+		}
+		return &n
+	default:
+		return e
+	}
+}
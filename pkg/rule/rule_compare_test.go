@@ -0,0 +1,92 @@
+//go:build linux
+
+package rule
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/ngrok/firewall_toolkit/pkg/expressions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExprsEqual(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	chain := &nftables.Chain{Name: "input", Table: table}
+	set := &nftables.Set{ID: 5, Name: "testset", KeyType: nftables.TypeIPAddr}
+
+	desired, err := Build(
+		expr.VerdictDrop,
+		AddressFamily(expressions.IPv4),
+		SourceAddressSet(set),
+		Any(expressions.Counter()),
+	)
+	assert.Nil(t, err)
+
+	// what we get back from the kernel, no set id and counters that have been going up
+	kernelExprs, err := Build(
+		expr.VerdictDrop,
+		AddressFamily(expressions.IPv4),
+		SourceAddressSet(&nftables.Set{Name: "testset", KeyType: nftables.TypeIPAddr}),
+		Any(&expr.Counter{Bytes: 9000, Packets: 1000}),
+	)
+	assert.Nil(t, err)
+	fromKernel := testDecodeExprs(t, table, chain, kernelExprs)
+	assert.Equal(t, &expr.Counter{Bytes: 9000, Packets: 1000}, fromKernel[len(fromKernel)-2])
+
+	assert.True(t, exprsEqual(table.Family, fromKernel, desired))
+
+	changedVerdict, err := Build(
+		expr.VerdictAccept,
+		AddressFamily(expressions.IPv4),
+		SourceAddressSet(set),
+		Any(expressions.Counter()),
+	)
+	assert.Nil(t, err)
+	assert.False(t, exprsEqual(table.Family, fromKernel, changedVerdict))
+
+	changedSet, err := Build(
+		expr.VerdictDrop,
+		AddressFamily(expressions.IPv4),
+		SourceAddressSet(&nftables.Set{Name: "otherset", KeyType: nftables.TypeIPAddr}),
+		Any(expressions.Counter()),
+	)
+	assert.Nil(t, err)
+	assert.False(t, exprsEqual(table.Family, fromKernel, changedSet))
+
+	assert.False(t, exprsEqual(table.Family, fromKernel, desired[1:]))
+}
+
+func TestExprsEqualQuota(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	chain := &nftables.Chain{Name: "input", Table: table}
+
+	fromKernel := testDecodeExprs(t, table, chain, []expr.Any{&expr.Quota{Bytes: 100, Consumed: 50}})
+
+	assert.True(t, exprsEqual(table.Family, fromKernel, []expr.Any{&expr.Quota{Bytes: 100}}))
+	assert.False(t, exprsEqual(table.Family, fromKernel, []expr.Any{&expr.Quota{Bytes: 200}}))
+}
+
+func TestExprsEqualLossyDecode(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	chain := &nftables.Chain{Name: "input", Table: table}
+
+	// the library doesn't decode socket expressions, only the comparison comes back
+	desired, err := expressions.CompareSocketCgroupV2(1234, 2)
+	assert.Nil(t, err)
+	fromKernel := testDecodeExprs(t, table, chain, desired)
+	assert.Equal(t, 1, len(fromKernel))
+
+	assert.True(t, exprsEqual(table.Family, fromKernel, desired))
+
+	changed, err := expressions.CompareSocketCgroupV2(4321, 2)
+	assert.Nil(t, err)
+	assert.False(t, exprsEqual(table.Family, fromKernel, changed))
+}
+
+func TestNormalizeExprDoesNotModify(t *testing.T) {
+	counter := &expr.Counter{Bytes: 9000, Packets: 1000}
+	normalizeExpr(counter)
+	assert.Equal(t, &expr.Counter{Bytes: 9000, Packets: 1000}, counter)
+}
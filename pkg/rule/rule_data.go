@@ -13,7 +13,15 @@ type RuleData struct {
 	// we do this so we can give each rule a specific id across hosts and etc
 	// handles are less deterministic without setting them explicitly and lack context (only ints)
 	ID []byte
-	// FIXME: we'll probably want stuff like position and handle at some point
+	// a human readable comment stored alongside the ID, nft list ruleset shows it. defaults to the ID
+	Comment string
+	// the kernel assigned handle and zero based index of the rule in its chain, these are only set on rules returned by Get
+	Handle   uint64
+	Position int
+	// where Add should put the rule in the chain, the zero value appends it to the end
+	Placement Placement
+	// sets that only exist for this rule, see BuildRuleData
+	anonymousSets []anonymousSet
 }
 
 // Create a new RuleData from an ID and list of nftables expressions
@@ -36,3 +44,26 @@ func (d RuleData) Counters() (*uint64, *uint64, error) {
 
 	return nil, nil, fmt.Errorf("no counter expression found for rule %s", d.ID)
 }
+
+// comment returns the comment written to the rule user data
+func (d RuleData) comment() string {
+	if d.Comment == "" {
+		return defaultComment(d.ID)
+	}
+
+	return d.Comment
+}
+
+// Quota returns the number of bytes consumed and the total bytes of the first quota expression in the rule
+func (d RuleData) Quota() (*uint64, *uint64, error) {
+	for _, ex := range d.Expressions {
+		switch v := ex.(type) {
+		case *expr.Quota:
+			consumed := v.Consumed
+			bytes := v.Bytes
+			return &consumed, &bytes, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("no quota expression found for rule %s", d.ID)
+}
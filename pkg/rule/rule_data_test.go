@@ -46,3 +46,26 @@ func TestCountersNoExpressions(t *testing.T) {
 	assert.Nil(t, resBytes)
 	assert.Nil(t, resPackets)
 }
+
+func TestQuota(t *testing.T) {
+	id := []byte{0xd, 0xe, 0xa, 0xd}
+	expressions := []expr.Any{&expr.Counter{}, &expr.Quota{Bytes: 1024, Consumed: 512}}
+
+	rd := NewRuleData(id, expressions)
+	resConsumed, resBytes, resError := rd.Quota()
+
+	assert.Nil(t, resError)
+	assert.EqualValues(t, 512, *resConsumed)
+	assert.EqualValues(t, 1024, *resBytes)
+}
+
+func TestQuotaNoExpressions(t *testing.T) {
+	id := []byte{0xd, 0xe, 0xa, 0xd}
+
+	rd := NewRuleData(id, []expr.Any{&expr.Counter{}})
+	resConsumed, resBytes, resError := rd.Quota()
+
+	assert.NotNil(t, resError)
+	assert.Nil(t, resConsumed)
+	assert.Nil(t, resBytes)
+}
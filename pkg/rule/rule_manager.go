@@ -19,6 +19,9 @@ import (
 
 type RulesUpdateFunc func() ([]RuleData, error)
 
+// Defines an optional setting for a rule manager
+type ManagerOption func(*ManagedRules)
+
 // Represents a table/chain ruleset managed by the manager goroutine
 type ManagedRules struct {
 	conn            *nftables.Conn
@@ -27,9 +30,10 @@ type ManagedRules struct {
 	interval        time.Duration
 	logger          logger.Logger
 	metrics         m.Metrics
+	reportForeign   bool
 }
 
-func ManagerInit(ruleTarget RuleTarget, f RulesUpdateFunc, interval time.Duration, logger logger.Logger, metrics m.Metrics) (ManagedRules, error) {
+func ManagerInit(ruleTarget RuleTarget, f RulesUpdateFunc, interval time.Duration, logger logger.Logger, metrics m.Metrics, opts ...ManagerOption) (ManagedRules, error) {
 	c, err := nftables.New()
 	if err != nil {
 		return ManagedRules{}, err
@@ -39,14 +43,28 @@ func ManagerInit(ruleTarget RuleTarget, f RulesUpdateFunc, interval time.Duratio
 		metrics = &statsd.NoOpClient{}
 	}
 
-	return ManagedRules{
+	managedRules := ManagedRules{
 		conn:            c,
 		ruleTarget:      ruleTarget,
 		rulesUpdateFunc: f,
 		interval:        interval,
 		logger:          logger,
 		metrics:         metrics,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(&managedRules)
+	}
+
+	return managedRules, nil
+}
+
+// WithForeignRuleReporting makes the manager report the number of rules in the chain that aren't managed by its rule
+// target, see WithOwner
+func WithForeignRuleReporting() ManagerOption {
+	return func(r *ManagedRules) {
+		r.reportForeign = true
+	}
 }
 
 // Start the rule manager goroutine
@@ -72,9 +90,14 @@ func (r *ManagedRules) Start(ctx context.Context) error {
 			} else {
 				for _, rule := range rules {
 					r.emitUsageCounters(rule)
+					r.emitQuotaUsage(rule)
 				}
 			}
 
+			if r.reportForeign {
+				r.emitForeignRules()
+			}
+
 			ruleData, err := r.rulesUpdateFunc()
 			if err != nil {
 				r.logger.Errorf("error with rules update function for table/chain %v/%v: %v", r.ruleTarget.table.Name, r.ruleTarget.chain.Name, err)
@@ -92,7 +115,7 @@ func (r *ManagedRules) Start(ctx context.Context) error {
 				r.logger.Warnf("error sending manager_loop_update_func metric: %v", err)
 			}
 
-			flush, added, deleted, err := r.ruleTarget.Update(r.conn, ruleData)
+			flush, added, deleted, replaced, err := r.ruleTarget.Update(r.conn, ruleData)
 			if err != nil {
 				r.logger.Errorf("error updating rules: %v", err)
 
@@ -128,6 +151,10 @@ func (r *ManagedRules) Start(ctx context.Context) error {
 			if err != nil {
 				r.logger.Warnf("error sending manager_loop_update_data_deleted metric: %v", err)
 			}
+			err = r.metrics.Count(m.Prefix("manager_loop_update_data_replaced"), int64(replaced), r.genTags([]string{}), 1)
+			if err != nil {
+				r.logger.Warnf("error sending manager_loop_update_data_replaced metric: %v", err)
+			}
 			err = r.metrics.Count(m.Prefix("manager_loop_flush"), 1, r.genTags([]string{"success:true"}), 1)
 			if err != nil {
 				r.logger.Warnf("error sending manager_loop_flush metric: %v", err)
@@ -166,3 +193,36 @@ func (r *ManagedRules) emitUsageCounters(ruleData RuleData) {
 		r.logger.Warnf("error sending fwng-agent.packets metric: %v", err)
 	}
 }
+
+func (r *ManagedRules) emitQuotaUsage(ruleData RuleData) {
+	consumed, bytes, err := ruleData.Quota()
+	if err != nil {
+		// most rules don't have a quota
+		return
+	}
+	err = r.metrics.Gauge(m.Prefix("fwng-agent.quota_consumed"), float64(*consumed), r.genTags([]string{fmt.Sprintf("id:%x", ruleData.ID)}), 1)
+	if err != nil {
+		r.logger.Warnf("error sending fwng-agent.quota_consumed metric: %v", err)
+	}
+	err = r.metrics.Gauge(m.Prefix("fwng-agent.quota_bytes"), float64(*bytes), r.genTags([]string{fmt.Sprintf("id:%x", ruleData.ID)}), 1)
+	if err != nil {
+		r.logger.Warnf("error sending fwng-agent.quota_bytes metric: %v", err)
+	}
+}
+
+func (r *ManagedRules) emitForeignRules() {
+	foreign, err := r.ruleTarget.GetForeign(r.conn)
+	if err != nil {
+		r.logger.Warnf("error getting foreign rules for table/chain %v/%v: %v", r.ruleTarget.table.Name, r.ruleTarget.chain.Name, err)
+		return
+	}
+
+	for _, rule := range foreign {
+		r.logger.Debugf("foreign rule %v with handle %v in table/chain %v/%v", rule.Position, rule.Handle, r.ruleTarget.table.Name, r.ruleTarget.chain.Name)
+	}
+
+	err = r.metrics.Gauge(m.Prefix("manager_loop_foreign_rules"), float64(len(foreign)), r.genTags([]string{}), 1)
+	if err != nil {
+		r.logger.Warnf("error sending manager_loop_foreign_rules metric: %v", err)
+	}
+}
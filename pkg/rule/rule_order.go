@@ -0,0 +1,180 @@
+package rule
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+// plannedRule is a rule that has to be created to make a chain match the desired rules
+type plannedRule struct {
+	ruleData RuleData
+	// true to insert the rule before position, false to add it after position
+	insert bool
+	// handle of the rule to place relative to, 0 with insert false appends to the end of the chain
+	position uint64
+}
+
+// replacedRule is an existing rule whose expressions or user data have to be replaced in place
+type replacedRule struct {
+	ruleData RuleData
+	handle   uint64
+}
+
+// rulePlan is the list of changes needed to make a chain match the desired rules, in order
+type rulePlan struct {
+	// existing rules to delete, this includes the old copies of moved rules
+	remove []*nftables.Rule
+	// existing rules that are in the right place but whose expressions or comment changed
+	replace []replacedRule
+	// rules to create in the order they have to be sent
+	place []plannedRule
+	// the number of rules that were added, removed and moved
+	added   int
+	removed int
+	moved   int
+}
+
+// genRulePlan works out the changes needed to make the chain contain exactly the desired rules in the desired order
+//
+// Rules are matched by ID. The longest run of existing rules that are already in the desired relative order are left
+// where they are, and replaced in place if their expressions changed, every other desired rule is (re)created around
+// them. Nftables has no way to move a rule so a move is a delete
+// of the old rule and an insert of a new one, both are sent in the same batch and applied in a single transaction so
+// there is never a point where the rule is missing or in two places.
+//
+// anonymousSets holds the elements of the anonymous sets used by existing rules, keyed by handle, so rules whose
+// anonymous sets changed are replaced too. family is the family of the table, expressions are compared in the form
+// they're marshalled to for it.
+func genRulePlan(family nftables.TableFamily, existingRules []*nftables.Rule, desiredRules []RuleData, anonymousSets map[uint64][][]nftables.SetElement) (rulePlan, error) {
+	plan := rulePlan{}
+
+	desiredIndex := make(map[string]int, len(desiredRules))
+	for i, ruleData := range desiredRules {
+		if _, exists := desiredIndex[string(ruleData.ID)]; exists {
+			return rulePlan{}, fmt.Errorf("duplicate rule id %x", ruleData.ID)
+		}
+		desiredIndex[string(ruleData.ID)] = i
+	}
+
+	add, remove := genRuleDelta(existingRules, desiredRules)
+	plan.remove = remove
+	plan.added = len(add)
+	plan.removed = len(remove)
+
+	removed := make(map[*nftables.Rule]struct{}, len(remove))
+	for _, existingRule := range remove {
+		removed[existingRule] = struct{}{}
+	}
+
+	// the existing rules we want to keep in chain order, along with where they should be in the desired order
+	candidates := []*nftables.Rule{}
+	candidateIndexes := []int{}
+	for _, existingRule := range existingRules {
+		if _, ok := removed[existingRule]; ok {
+			continue
+		}
+		candidates = append(candidates, existingRule)
+		candidateIndexes = append(candidateIndexes, desiredIndex[string(decodeUserData(existingRule.UserData).id)])
+	}
+
+	// anything that isn't part of the longest increasing run of desired indexes is out of order and has to move
+	kept := make(map[int]*nftables.Rule, len(candidates))
+	inOrder := longestIncreasingSubsequence(candidateIndexes)
+	for i, existingRule := range candidates {
+		if inOrder[i] {
+			kept[candidateIndexes[i]] = existingRule
+			continue
+		}
+		plan.remove = append(plan.remove, existingRule)
+		plan.moved++
+	}
+
+	// every rule that isn't kept is inserted before the next kept rule. rules after the last kept rule are added
+	// directly after it instead of being appended to the end of the chain so they stay next to the other managed rules
+	// even when there are foreign rules after them. since each add goes directly after the last kept rule they have to
+	// be sent in reverse order. without any kept rules everything is appended in order.
+	nextKept := make([]uint64, len(desiredRules))
+	var next uint64
+	for i := len(desiredRules) - 1; i >= 0; i-- {
+		nextKept[i] = next
+		if existingRule, ok := kept[i]; ok {
+			next = existingRule.Handle
+		}
+	}
+
+	var lastKept uint64
+	tail := []plannedRule{}
+	for i, ruleData := range desiredRules {
+		if existingRule, ok := kept[i]; ok {
+			if !exprsEqual(family, existingRule.Exprs, ruleData.Expressions) ||
+				userDataChanged(existingRule.UserData, ruleData) ||
+				anonymousSetsChanged(anonymousSets[existingRule.Handle], ruleData.anonymousSets) {
+				plan.replace = append(plan.replace, replacedRule{ruleData: ruleData, handle: existingRule.Handle})
+			}
+			lastKept = existingRule.Handle
+			continue
+		}
+
+		if nextKept[i] == 0 && lastKept != 0 {
+			tail = append(tail, plannedRule{ruleData: ruleData, insert: false, position: lastKept})
+			continue
+		}
+
+		plan.place = append(plan.place, plannedRule{
+			ruleData: ruleData,
+			insert:   nextKept[i] != 0,
+			position: nextKept[i],
+		})
+	}
+
+	for i := len(tail) - 1; i >= 0; i-- {
+		plan.place = append(plan.place, tail[i])
+	}
+
+	return plan, nil
+}
+
+// userDataChanged returns true if the user data of an existing rule has to be rewritten, either because the comment
+// changed or because it's still in the old raw ID format
+func userDataChanged(existing []byte, ruleData RuleData) bool {
+	decoded := decodeUserData(existing)
+	return decoded.legacy || decoded.comment != ruleData.comment()
+}
+
+// longestIncreasingSubsequence returns which elements of seq are part of a longest strictly increasing subsequence
+func longestIncreasingSubsequence(seq []int) []bool {
+	// tails[k] is the index in seq of the smallest tail of an increasing subsequence of length k+1
+	tails := []int{}
+	prev := make([]int, len(seq))
+
+	for i, v := range seq {
+		k := sort.Search(len(tails), func(j int) bool {
+			return seq[tails[j]] >= v
+		})
+
+		if k > 0 {
+			prev[i] = tails[k-1]
+		} else {
+			prev[i] = -1
+		}
+
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+
+	in := make([]bool, len(seq))
+	if len(tails) == 0 {
+		return in
+	}
+
+	for i := tails[len(tails)-1]; i >= 0; i = prev[i] {
+		in[i] = true
+	}
+
+	return in
+}
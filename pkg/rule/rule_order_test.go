@@ -0,0 +1,213 @@
+package rule
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenRulePlan(t *testing.T) {
+	a := &nftables.Rule{Handle: 1, UserData: []byte{0xa}}
+	b := &nftables.Rule{Handle: 2, UserData: []byte{0xb}}
+	c := &nftables.Rule{Handle: 3, UserData: []byte{0xc}}
+	d := &nftables.Rule{Handle: 4, UserData: []byte{0xd}}
+
+	rd := func(id byte) RuleData {
+		return RuleData{ID: []byte{id}}
+	}
+
+	tests := []struct {
+		name        string
+		existing    []*nftables.Rule
+		desired     []RuleData
+		wantRemove  []*nftables.Rule
+		wantPlace   []plannedRule
+		wantAdded   int
+		wantRemoved int
+		wantMoved   int
+	}{
+		{
+			"no changes",
+			[]*nftables.Rule{a, b, c},
+			[]RuleData{rd(0xa), rd(0xb), rd(0xc)},
+			nil,
+			nil,
+			0, 0, 0,
+		},
+		{
+			"empty chain appends in order",
+			[]*nftables.Rule{},
+			[]RuleData{rd(0xa), rd(0xb)},
+			nil,
+			[]plannedRule{{rd(0xa), false, 0}, {rd(0xb), false, 0}},
+			2, 0, 0,
+		},
+		{
+			"new rule at the top",
+			[]*nftables.Rule{a, b},
+			[]RuleData{rd(0xe), rd(0xa), rd(0xb)},
+			nil,
+			[]plannedRule{{rd(0xe), true, 1}},
+			1, 0, 0,
+		},
+		{
+			"new rules in the middle",
+			[]*nftables.Rule{a, b},
+			[]RuleData{rd(0xa), rd(0xe), rd(0xf), rd(0xb)},
+			nil,
+			[]plannedRule{{rd(0xe), true, 2}, {rd(0xf), true, 2}},
+			2, 0, 0,
+		},
+		{
+			"new rule at the end",
+			[]*nftables.Rule{a, b},
+			[]RuleData{rd(0xa), rd(0xb), rd(0xe)},
+			nil,
+			[]plannedRule{{rd(0xe), false, 2}},
+			1, 0, 0,
+		},
+		{
+			"new rules at the end go after the last kept rule in reverse",
+			[]*nftables.Rule{a, b},
+			[]RuleData{rd(0xa), rd(0xb), rd(0xe), rd(0xf)},
+			nil,
+			[]plannedRule{{rd(0xf), false, 2}, {rd(0xe), false, 2}},
+			2, 0, 0,
+		},
+		{
+			"move the last rule to the top",
+			[]*nftables.Rule{a, b, c, d},
+			[]RuleData{rd(0xd), rd(0xa), rd(0xb), rd(0xc)},
+			[]*nftables.Rule{d},
+			[]plannedRule{{rd(0xd), true, 1}},
+			0, 0, 1,
+		},
+		{
+			"swap two rules",
+			[]*nftables.Rule{a, b, c},
+			[]RuleData{rd(0xa), rd(0xc), rd(0xb)},
+			[]*nftables.Rule{b},
+			[]plannedRule{{rd(0xb), false, 3}},
+			0, 0, 1,
+		},
+		{
+			"reverse",
+			[]*nftables.Rule{a, b, c},
+			[]RuleData{rd(0xc), rd(0xb), rd(0xa)},
+			[]*nftables.Rule{a, b},
+			[]plannedRule{{rd(0xa), false, 3}, {rd(0xb), false, 3}},
+			0, 0, 2,
+		},
+		{
+			"remove and add",
+			[]*nftables.Rule{a, b, c},
+			[]RuleData{rd(0xa), rd(0xe), rd(0xc)},
+			[]*nftables.Rule{b},
+			[]plannedRule{{rd(0xe), true, 3}},
+			1, 1, 0,
+		},
+		{
+			"duplicate existing rule",
+			[]*nftables.Rule{a, b, {Handle: 5, UserData: []byte{0xa}}},
+			[]RuleData{rd(0xa), rd(0xb)},
+			[]*nftables.Rule{{Handle: 5, UserData: []byte{0xa}}},
+			nil,
+			0, 1, 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan, err := genRulePlan(nftables.TableFamilyINet, test.existing, test.desired, nil)
+			assert.Nil(t, err)
+			assert.ElementsMatch(t, test.wantRemove, plan.remove)
+			assert.Equal(t, test.wantPlace, plan.place)
+			assert.Equal(t, test.wantAdded, plan.added)
+			assert.Equal(t, test.wantRemoved, plan.removed)
+			assert.Equal(t, test.wantMoved, plan.moved)
+		})
+	}
+}
+
+func TestGenRulePlanDuplicateID(t *testing.T) {
+	_, err := genRulePlan(nftables.TableFamilyINet, []*nftables.Rule{}, []RuleData{{ID: []byte{0xa}}, {ID: []byte{0xa}}}, nil)
+	assert.Error(t, err)
+}
+
+func TestLongestIncreasingSubsequence(t *testing.T) {
+	assert.Equal(t, []bool{}, longestIncreasingSubsequence([]int{}))
+	assert.Equal(t, []bool{true, true, true}, longestIncreasingSubsequence([]int{0, 1, 2}))
+	assert.Equal(t, []bool{false, true, true, true}, longestIncreasingSubsequence([]int{3, 0, 1, 2}))
+	assert.Equal(t, []bool{true, false, true, true, false, true}, longestIncreasingSubsequence([]int{0, 4, 1, 2, 5, 3}))
+}
+
+func TestGenRulePlanReplace(t *testing.T) {
+	// the comment is the default one for the ID so only the expressions decide what is replaced
+	existing := []*nftables.Rule{
+		{Handle: 1, UserData: []byte{0x0, 0x8, 0x66, 0x77, 0x74, 0x6b, 0x3a, 0x30, 0x61, 0x0, 0xf0, 0x1, 0xa}, Exprs: []expr.Any{&expr.Counter{Bytes: 100, Packets: 1}, &expr.Verdict{Kind: expr.VerdictAccept}}},
+		{Handle: 2, UserData: []byte{0x0, 0x8, 0x66, 0x77, 0x74, 0x6b, 0x3a, 0x30, 0x62, 0x0, 0xf0, 0x1, 0xb}, Exprs: []expr.Any{&expr.Counter{Bytes: 100, Packets: 1}, &expr.Verdict{Kind: expr.VerdictAccept}}},
+	}
+
+	desired := []RuleData{
+		{ID: []byte{0xa}, Expressions: []expr.Any{&expr.Counter{}, &expr.Verdict{Kind: expr.VerdictAccept}}},
+		{ID: []byte{0xb}, Expressions: []expr.Any{&expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}}},
+	}
+
+	plan, err := genRulePlan(nftables.TableFamilyINet, existing, desired, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, plan.remove)
+	assert.Empty(t, plan.place)
+	assert.Equal(t, []replacedRule{{ruleData: desired[1], handle: 2}}, plan.replace)
+}
+
+func TestGenRulePlanRewriteUserData(t *testing.T) {
+	existing := []*nftables.Rule{
+		// old raw ID format
+		{Handle: 1, UserData: []byte{0xa}},
+		// TLVs with the comment "hi"
+		{Handle: 2, UserData: []byte{0x0, 0x3, 0x68, 0x69, 0x0, 0xf0, 0x1, 0xb}},
+		{Handle: 3, UserData: []byte{0x0, 0x3, 0x68, 0x69, 0x0, 0xf0, 0x1, 0xc}},
+	}
+
+	desired := []RuleData{
+		{ID: []byte{0xa}, Comment: "hi"},
+		{ID: []byte{0xb}, Comment: "hi"},
+		{ID: []byte{0xc}, Comment: "bye"},
+	}
+
+	plan, err := genRulePlan(nftables.TableFamilyINet, existing, desired, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, plan.remove)
+	assert.Empty(t, plan.place)
+	assert.Equal(t, []replacedRule{{ruleData: desired[0], handle: 1}, {ruleData: desired[2], handle: 3}}, plan.replace)
+}
+
+func TestGenRulePlanAnonymousSets(t *testing.T) {
+	userData := func(id byte) []byte {
+		return []byte{0x0, 0x8, 0x66, 0x77, 0x74, 0x6b, 0x3a, 0x30, 0x30 + id, 0x0, 0xf0, 0x1, id}
+	}
+
+	elements := []nftables.SetElement{{Key: []byte{192, 0, 2, 1}}, {Key: []byte{192, 0, 2, 2}, IntervalEnd: true}}
+	changed := []nftables.SetElement{{Key: []byte{192, 0, 2, 1}}, {Key: []byte{192, 0, 2, 3}, IntervalEnd: true}}
+
+	existing := []*nftables.Rule{
+		{Handle: 1, UserData: userData(1), Exprs: []expr.Any{&expr.Lookup{SourceRegister: 1, SetName: "__set0"}}},
+		{Handle: 2, UserData: userData(2), Exprs: []expr.Any{&expr.Lookup{SourceRegister: 1, SetName: "__set1"}}},
+	}
+
+	desired := []RuleData{
+		{ID: []byte{1}, Expressions: []expr.Any{&expr.Lookup{SourceRegister: 1}}, anonymousSets: []anonymousSet{{elements: elements}}},
+		{ID: []byte{2}, Expressions: []expr.Any{&expr.Lookup{SourceRegister: 1}}, anonymousSets: []anonymousSet{{elements: elements}}},
+	}
+
+	plan, err := genRulePlan(nftables.TableFamilyINet, existing, desired, map[uint64][][]nftables.SetElement{
+		1: {elements},
+		2: {changed},
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, plan.remove)
+	assert.Empty(t, plan.place)
+	assert.Equal(t, []replacedRule{{ruleData: desired[1], handle: 2}}, plan.replace)
+}
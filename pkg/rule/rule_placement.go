@@ -0,0 +1,81 @@
+package rule
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+)
+
+type placementKind int
+
+const (
+	placeAppend placementKind = iota
+	placeTop
+	placeIndex
+	placeBefore
+	placeAfter
+)
+
+// Placement describes where a rule should be put in a chain when it is added. The zero value appends the rule to
+// the end of the chain.
+type Placement struct {
+	kind  placementKind
+	index int
+	id    []byte
+}
+
+// PlaceAppend puts the rule at the end of the chain
+func PlaceAppend() Placement {
+	return Placement{kind: placeAppend}
+}
+
+// PlaceTop puts the rule at the start of the chain
+func PlaceTop() Placement {
+	return Placement{kind: placeTop}
+}
+
+// PlaceAtIndex puts the rule at a zero based index in the chain, moving the rule currently at that index and
+// everything after it down. An index past the end of the chain appends the rule.
+func PlaceAtIndex(index int) Placement {
+	return Placement{kind: placeIndex, index: index}
+}
+
+// PlaceBefore puts the rule directly before the rule with the given ID
+func PlaceBefore(id []byte) Placement {
+	return Placement{kind: placeBefore, id: id}
+}
+
+// PlaceAfter puts the rule directly after the rule with the given ID
+func PlaceAfter(id []byte) Placement {
+	return Placement{kind: placeAfter, id: id}
+}
+
+// resolve the placement against the rules currently in the chain
+//
+// The first return value is true if the rule should be inserted (placed before the position) rather than added
+// (placed after the position), the second is the handle of the rule to place it relative to. A position of 0 means
+// the start of the chain for inserts and the end of the chain for adds.
+func (p Placement) resolve(existingRules []*nftables.Rule) (bool, uint64, error) {
+	switch p.kind {
+	case placeAppend:
+		return false, 0, nil
+	case placeTop:
+		return true, 0, nil
+	case placeIndex:
+		if p.index < 0 {
+			return false, 0, fmt.Errorf("invalid rule index %v", p.index)
+		}
+		if p.index >= len(existingRules) {
+			return false, 0, nil
+		}
+		return true, existingRules[p.index].Handle, nil
+	case placeBefore, placeAfter:
+		rule := findRuleByID(p.id, existingRules)
+		if rule.Table == nil {
+			return false, 0, fmt.Errorf("no rule with id %x to place relative to", p.id)
+		}
+		return p.kind == placeBefore, rule.Handle, nil
+	default:
+		return false, 0, fmt.Errorf("unknown rule placement %v", p.kind)
+	}
+}
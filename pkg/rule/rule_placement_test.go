@@ -0,0 +1,106 @@
+//go:build linux
+
+package rule
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/ngrok/firewall_toolkit/pkg/expressions"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestPlacementResolve(t *testing.T) {
+	table := &nftables.Table{Name: "testtable"}
+	rules := []*nftables.Rule{
+		{Table: table, Handle: 10, UserData: []byte{0x1}},
+		{Table: table, Handle: 20, UserData: []byte{0xa}},
+		{Table: table, Handle: 30, UserData: []byte{0xb}},
+	}
+
+	tests := []struct {
+		name         string
+		placement    Placement
+		wantInsert   bool
+		wantPosition uint64
+		wantErr      bool
+	}{
+		{"zero value", Placement{}, false, 0, false},
+		{"append", PlaceAppend(), false, 0, false},
+		{"top", PlaceTop(), true, 0, false},
+		{"index start", PlaceAtIndex(0), true, 10, false},
+		{"index middle", PlaceAtIndex(2), true, 30, false},
+		{"index past end", PlaceAtIndex(3), false, 0, false},
+		{"index negative", PlaceAtIndex(-1), false, 0, true},
+		{"before", PlaceBefore([]byte{0xa}), true, 20, false},
+		{"after", PlaceAfter([]byte{0xa}), false, 20, false},
+		{"before missing", PlaceBefore([]byte{0x5}), false, 0, true},
+		{"after missing", PlaceAfter([]byte{0x5}), false, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			insert, position, err := test.placement.resolve(rules)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.wantInsert, insert)
+			assert.Equal(t, test.wantPosition, position)
+		})
+	}
+}
+
+func TestPlaceRuleAfter(t *testing.T) {
+	table := &nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   "testtable",
+	}
+
+	chain := &nftables.Chain{
+		Table: table,
+		Name:  "testchain",
+	}
+
+	want := [][]byte{
+		// start batch
+		{0x0, 0x0, 0x0, 0xa},
+		// 0xd, 0xe, 0xa, 0xd is our ID followed by the position attribute with the handle 0x2a
+		{0x1, 0x0, 0x0, 0x0, 0xe, 0x0, 0x1, 0x0, 0x74, 0x65, 0x73, 0x74, 0x74, 0x61, 0x62, 0x6c, 0x65, 0x0, 0x0, 0x0, 0xe, 0x0, 0x2, 0x0, 0x74, 0x65, 0x73, 0x74, 0x63, 0x68, 0x61, 0x69, 0x6e, 0x0, 0x0, 0x0, 0x54, 0x0, 0x4, 0x80, 0x24, 0x0, 0x1, 0x80, 0x9, 0x0, 0x1, 0x0, 0x6d, 0x65, 0x74, 0x61, 0x0, 0x0, 0x0, 0x0, 0x14, 0x0, 0x2, 0x80, 0x8, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0xf, 0x8, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2c, 0x0, 0x1, 0x80, 0x8, 0x0, 0x1, 0x0, 0x63, 0x6d, 0x70, 0x0, 0x20, 0x0, 0x2, 0x80, 0x8, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x1, 0x8, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0xc, 0x0, 0x3, 0x80, 0x5, 0x0, 0x1, 0x0, 0x2, 0x0, 0x0, 0x0, 0x8, 0x0, 0x7, 0x0, 0xd, 0xe, 0xa, 0xd, 0xc, 0x0, 0x6, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2a},
+		// end batch
+		{0x0, 0x0, 0x0, 0xa},
+	}
+
+	c := testDialWithWant(t, want)
+
+	res, err := expressions.CompareProtocolFamily(unix.NFPROTO_IPV4)
+	assert.Nil(t, err)
+	rD := NewRuleData([]byte{0xd, 0xe, 0xa, 0xd}, res)
+	rD.Placement = PlaceAfter([]byte{0xc, 0xa, 0xf, 0xe})
+
+	existing := []*nftables.Rule{{Table: table, Chain: chain, Handle: 0x2a, UserData: []byte{0xc, 0xa, 0xf, 0xe}}}
+
+	assert.Nil(t, place(c, table, chain, rD, rD.ID, existing))
+	assert.Nil(t, c.Flush())
+}
+
+func TestPlaceRuleMissing(t *testing.T) {
+	table := &nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   "testtable",
+	}
+
+	chain := &nftables.Chain{
+		Table: table,
+		Name:  "testchain",
+	}
+
+	c := testDialWithWant(t, [][]byte{})
+
+	rD := NewRuleData([]byte{0xd, 0xe, 0xa, 0xd}, nil)
+	rD.Placement = PlaceBefore([]byte{0xc, 0xa, 0xf, 0xe})
+
+	assert.Error(t, place(c, table, chain, rD, rD.ID, []*nftables.Rule{}))
+}
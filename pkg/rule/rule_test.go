@@ -7,8 +7,12 @@ import (
 	"testing"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
 	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
 	"github.com/ngrok/firewall_toolkit/pkg/expressions"
+	"github.com/ngrok/firewall_toolkit/pkg/set"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/sys/unix"
 )
@@ -40,14 +44,24 @@ func TestAddRule(t *testing.T) {
 	rD := NewRuleData([]byte{0xd, 0xe, 0xa, 0xd}, res)
 
 	// we only test the private add since we don't yet have a good way to test responses from netlink, only messages to netlink
-	add(c, table, chain, rD)
+	add(c, table, chain, rD, rD.ID)
 	assert.Nil(t, c.Flush())
 }
 
 func testDialWithWant(t *testing.T, want [][]byte) *nftables.Conn {
+	return testDialWithKernel(t, nil, want)
+}
+
+// testDialWithKernel is testDialWithWant for code that reads the chain before changing it, rule and chain dumps are
+// answered with the matching messages in kernel, see testKernelMessages
+func testDialWithKernel(t *testing.T, kernel []netlink.Message, want [][]byte) *nftables.Conn {
 	// slightly modified version of https://github.com/google/nftables/blob/main/nftables_test.go#L297
 	c, err := nftables.New(nftables.WithTestDial(
 		func(req []netlink.Message) ([]netlink.Message, error) {
+			if len(req) == 1 && req[0].Header.Flags&netlink.Dump != 0 {
+				return testDump(req[0], kernel), nil
+			}
+
 			for idx, msg := range req {
 				b, err := msg.MarshalBinary()
 				assert.Nil(t, err)
@@ -73,6 +87,102 @@ func testDialWithWant(t *testing.T, want [][]byte) *nftables.Conn {
 	return c
 }
 
+var (
+	testNewRuleType  = netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWRULE)
+	testGetRuleType  = netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_GETRULE)
+	testNewChainType = netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWCHAIN)
+	testGetChainType = netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_GETCHAIN)
+)
+
+// testDump answers a rule or chain dump with the rules or chains in kernel as a multipart message
+func testDump(req netlink.Message, kernel []netlink.Message) []netlink.Message {
+	var want netlink.HeaderType
+	switch req.Header.Type {
+	case testGetRuleType:
+		want = testNewRuleType
+	case testGetChainType:
+		want = testNewChainType
+	}
+
+	reply := []netlink.Message{}
+	for _, msg := range kernel {
+		if msg.Header.Type == want {
+			msg.Header.Flags = netlink.Multi
+			msg.Header.Sequence = req.Header.Sequence
+			msg.Header.PID = req.Header.PID
+			reply = append(reply, msg)
+		}
+	}
+
+	return append(reply, netlink.Message{Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi}})
+}
+
+// testKernelMessages returns the rules and chains add creates as the kernel would dump them, from the messages the
+// library marshals for them. Rules get handles in the order they were added starting at 1.
+func testKernelMessages(t *testing.T, add func(c *nftables.Conn)) []netlink.Message {
+	msgs := []netlink.Message{}
+	c, err := nftables.New(nftables.WithTestDial(
+		func(req []netlink.Message) ([]netlink.Message, error) {
+			for _, msg := range req {
+				switch msg.Header.Type {
+				case testNewRuleType:
+					handle := nltest.MustMarshalAttributes([]netlink.Attribute{
+						{Type: unix.NFTA_RULE_HANDLE, Data: binaryutil.BigEndian.PutUint64(uint64(len(msgs) + 1))},
+					})
+					msg.Data = append(append([]byte{}, msg.Data...), handle...)
+					msgs = append(msgs, msg)
+				case testNewChainType:
+					msgs = append(msgs, msg)
+				}
+			}
+			return req, nil
+		}))
+	assert.Nil(t, err)
+
+	add(c)
+	assert.Nil(t, c.Flush())
+
+	return msgs
+}
+
+// testWantMessages returns the messages the library sends for the batch add queues, to check another conn sends the
+// same with testDialWithWant
+func testWantMessages(t *testing.T, add func(c *nftables.Conn)) [][]byte {
+	want := [][]byte{}
+	c, err := nftables.New(nftables.WithTestDial(
+		func(req []netlink.Message) ([]netlink.Message, error) {
+			for _, msg := range req {
+				b, err := msg.MarshalBinary()
+				assert.Nil(t, err)
+
+				if len(b) < 16 {
+					continue
+				}
+				want = append(want, b[16:])
+			}
+			return req, nil
+		}))
+	assert.Nil(t, err)
+
+	add(c)
+	assert.Nil(t, c.Flush())
+
+	return want
+}
+
+// testDecodeExprs returns expressions the way they're read back from the kernel after being added in a rule
+func testDecodeExprs(t *testing.T, table *nftables.Table, chain *nftables.Chain, exprs []expr.Any) []expr.Any {
+	kernel := testKernelMessages(t, func(c *nftables.Conn) {
+		c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	})
+
+	rules, err := testDialWithKernel(t, kernel, nil).GetRules(table, chain)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rules))
+
+	return rules[0].Exprs
+}
+
 func TestFindRuleByID(t *testing.T) {
 	rules := []*nftables.Rule{
 		{UserData: []byte{0x1}},
@@ -174,3 +284,326 @@ func TestManagerGetRuleTarget(t *testing.T) {
 	assert.Equal(t, table, rtTable)
 	assert.Equal(t, chain, rtChain)
 }
+
+func TestUserDataOwner(t *testing.T) {
+	table := &nftables.Table{Name: "testtable"}
+	chain := &nftables.Chain{Table: table, Name: "testchain"}
+	rD := RuleData{ID: []byte{0xd, 0xe, 0xa, 0xd}, Comment: "hi"}
+
+	noOwner := NewRuleTarget(table, chain)
+	userData, err := noOwner.userData(rD)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x3, 0x68, 0x69, 0x0, 0xf0, 0x4, 0xd, 0xe, 0xa, 0xd}, userData)
+
+	owned := NewRuleTarget(table, chain, WithOwner("fwtk"))
+	userData, err = owned.userData(rD)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x3, 0x68, 0x69, 0x0, 0xf0, 0x4, 0xd, 0xe, 0xa, 0xd, 0xf1, 0x5, 0x66, 0x77, 0x74, 0x6b, 0x0}, userData)
+}
+
+func TestSplitRules(t *testing.T) {
+	table := &nftables.Table{Name: "testtable"}
+	chain := &nftables.Chain{Table: table, Name: "testchain"}
+
+	rules := []*nftables.Rule{
+		// raw IDs, without an owner
+		{Table: table, Handle: 1, UserData: []byte{0x66, 0x77, 0x74, 0x6b, 0x0, 0xd, 0xe, 0xa, 0xd}},
+		{Table: table, Handle: 2, UserData: []byte{0xc, 0xa, 0xf, 0xe}},
+		{Table: table, Handle: 3},
+		{Table: table, Handle: 4, UserData: []byte{0x6f, 0x74, 0x68, 0x65, 0x72, 0x0, 0xd, 0xe, 0xa, 0xd}},
+		// TLVs owned by fwtk, owned by other and without an owner
+		{Table: table, Handle: 5, UserData: []byte{0xf0, 0x4, 0xb, 0xe, 0xe, 0xf, 0xf1, 0x5, 0x66, 0x77, 0x74, 0x6b, 0x0}},
+		{Table: table, Handle: 6, UserData: []byte{0xf0, 0x1, 0xa, 0xf1, 0x6, 0x6f, 0x74, 0x68, 0x65, 0x72, 0x0}},
+		{Table: table, Handle: 7, UserData: []byte{0xf0, 0x1, 0xb}},
+	}
+
+	t.Run("no owner", func(t *testing.T) {
+		ruleTarget := NewRuleTarget(table, chain)
+		owned, foreign := ruleTarget.splitRules(rules)
+		assert.Equal(t, rules, owned)
+		assert.Empty(t, foreign)
+	})
+
+	t.Run("owner", func(t *testing.T) {
+		ruleTarget := NewRuleTarget(table, chain, WithOwner("fwtk"))
+		owned, foreign := ruleTarget.splitRules(rules)
+
+		// only rules with the owner in their user data TLVs are managed, raw IDs never carry an owner
+		assert.Equal(t, []*nftables.Rule{rules[4]}, owned)
+		assert.Equal(t, []*nftables.Rule{rules[0], rules[1], rules[2], rules[3], rules[5], rules[6]}, foreign)
+	})
+
+	t.Run("owner adopting raw IDs", func(t *testing.T) {
+		ruleTarget := NewRuleTarget(table, chain, WithOwner("fwtk"))
+		owned, foreign := ruleTarget.splitRules(rules, []byte{0xc, 0xa, 0xf, 0xe}, []byte{0xb}, []byte{})
+
+		// raw IDs that were asked for are adopted, TLVs keep their owner and rules without user data are never adopted
+		assert.Equal(t, []*nftables.Rule{rules[1], rules[4]}, owned)
+		assert.Equal(t, []*nftables.Rule{rules[0], rules[2], rules[3], rules[5], rules[6]}, foreign)
+	})
+}
+
+func TestRuleExprsAnonymousSets(t *testing.T) {
+	table := &nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   "testtable",
+	}
+
+	c, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		return req, nil
+	}))
+	assert.Nil(t, err)
+
+	addrs, err := set.AddressStringsToSetData([]string{"192.0.2.1"})
+	assert.Nil(t, err)
+
+	rD, err := BuildRuleData([]byte{0xd, 0xe, 0xa, 0xd}, expr.VerdictAccept, SourceAddressAnonymousSet(addrs))
+	assert.Nil(t, err)
+
+	exprs, err := ruleExprs(c, table, rD)
+	assert.Nil(t, err)
+	assert.Len(t, exprs, len(rD.Expressions))
+
+	lookup, ok := exprs[1].(*expr.Lookup)
+	assert.True(t, ok)
+	assert.Equal(t, "__set%d", lookup.SetName)
+	assert.NotZero(t, lookup.SetID)
+
+	// the rule data is left as is so it can be sent again
+	assert.Equal(t, "", rD.anonymousSets[0].lookup.SetName)
+	assert.Zero(t, rD.anonymousSets[0].lookup.SetID)
+}
+
+// testUpdateUnchanged checks Update doesn't touch a chain that already has the rules, read back from the kernel the
+// way the library decodes them
+func testUpdateUnchanged(t *testing.T, target RuleTarget, rules []RuleData) {
+	table, chain := target.GetTableAndChain()
+	kernel := testKernelMessages(t, func(c *nftables.Conn) {
+		for _, ruleData := range rules {
+			userData, err := target.userData(ruleData)
+			assert.Nil(t, err)
+			c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: ruleData.Expressions, UserData: userData})
+		}
+	})
+
+	c := testDialWithKernel(t, kernel, nil)
+	modified, added, removed, replaced, err := target.Update(c, rules)
+	assert.Nil(t, err)
+	assert.False(t, modified)
+	assert.Equal(t, []int{0, 0, 0}, []int{added, removed, replaced})
+}
+
+func TestUpdateMarkUnchanged(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: "testtable"}
+	prerouting := &nftables.Chain{Table: table, Name: "prerouting", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPrerouting}
+
+	setMark, err := BuildRuleData([]byte{0x1}, expr.VerdictAccept, DestinationPort(443), TransportProtocol(expressions.TCP), SetMark(0x100, 0xff00))
+	assert.Nil(t, err)
+	setConnMark, err := BuildRuleData([]byte{0x2}, expr.VerdictAccept, Mark(0x100, 0xff00), SetConnectionMark(0x1, 0xffffffff))
+	assert.Nil(t, err)
+	saveMark, err := BuildRuleData([]byte{0x3}, expr.VerdictAccept, SaveMark())
+	assert.Nil(t, err)
+	restoreMark, err := BuildRuleData([]byte{0x4}, expr.VerdictAccept, RestoreMark())
+	assert.Nil(t, err)
+
+	// the library doesn't decode the source register of ct writes
+	decoded := testDecodeExprs(t, table, prerouting, saveMark.Expressions)
+	assert.Equal(t, &expr.Ct{Key: expr.CtKeyMARK}, decoded[1])
+
+	testUpdateUnchanged(t, NewRuleTarget(table, prerouting), []RuleData{setMark, setConnMark, saveMark, restoreMark})
+}
+
+func TestUpdateSocketUnchanged(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: "testtable"}
+	output := &nftables.Chain{Table: table, Name: "output", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookOutput}
+
+	// what SocketCgroupV2 builds, without needing the cgroup to exist
+	cgroup, err := expressions.CompareSocketCgroupV2(1234, 2)
+	assert.Nil(t, err)
+	cgroupRule, err := BuildRuleData([]byte{0x1}, expr.VerdictDrop, Any(cgroup...))
+	assert.Nil(t, err)
+	uidRule, err := BuildRuleData([]byte{0x2}, expr.VerdictAccept, SocketUID(1000), SocketGID(1000))
+	assert.Nil(t, err)
+
+	// the library drops the socket expression
+	decoded := testDecodeExprs(t, table, output, cgroupRule.Expressions)
+	assert.Equal(t, len(cgroupRule.Expressions)-1, len(decoded))
+
+	testUpdateUnchanged(t, NewRuleTarget(table, output), []RuleData{cgroupRule, uidRule})
+}
+
+func TestUpdateMangleUnchanged(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: "testtable"}
+	forward := &nftables.Chain{Table: table, Name: "forward", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward}
+
+	clamp, err := BuildRuleData([]byte{0x1}, expr.VerdictAccept, TransportProtocol(expressions.TCP), ClampMSSToPMTU())
+	assert.Nil(t, err)
+	mss, err := BuildRuleData([]byte{0x2}, expr.VerdictAccept, TransportProtocol(expressions.TCP), SetMSS(1400))
+	assert.Nil(t, err)
+	dscp, err := BuildRuleData([]byte{0x3}, expr.VerdictAccept, SetDSCP(46), SetTTL(64), AddressFamily(expressions.IPv4))
+	assert.Nil(t, err)
+
+	// the library drops rt and byteorder, only the exthdr write comes back
+	decoded := testDecodeExprs(t, table, forward, clamp.Expressions)
+	assert.Equal(t, len(clamp.Expressions)-2, len(decoded))
+
+	testUpdateUnchanged(t, NewRuleTarget(table, forward), []RuleData{clamp, mss, dscp})
+}
+
+func TestUpdateJump(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: "testtable"}
+	input := &nftables.Chain{Table: table, Name: "input", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput}
+
+	jump, err := BuildTerminalRuleData([]byte{0xd, 0xe, 0xa, 0xd}, Jump("ssh"), TransportProtocol(expressions.TCP), DestinationPort(22))
+	assert.Nil(t, err)
+
+	target := NewRuleTarget(table, input)
+	userData, err := target.userData(jump)
+	assert.Nil(t, err)
+
+	addJump := func(c *nftables.Conn) {
+		c.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: jump.Expressions, UserData: userData})
+	}
+
+	t.Run("chain in the same batch", func(t *testing.T) {
+		want := testWantMessages(t, func(c *nftables.Conn) {
+			RegularChain(c, table, "ssh")
+			addJump(c)
+		})
+
+		c := testDialWithKernel(t, nil, want)
+		ssh := RegularChain(c, table, "ssh")
+
+		// the chain isn't in the kernel until the batch is flushed
+		_, _, _, _, err := target.Update(c, []RuleData{jump})
+		assert.Error(t, err)
+
+		target := NewRuleTarget(table, input, WithChains(ssh))
+		modified, added, removed, replaced, err := target.Update(c, []RuleData{jump})
+		assert.Nil(t, err)
+		assert.True(t, modified)
+		assert.Equal(t, []int{1, 0, 0}, []int{added, removed, replaced})
+		assert.Nil(t, c.Flush())
+	})
+
+	t.Run("chain in the kernel", func(t *testing.T) {
+		kernel := testKernelMessages(t, func(c *nftables.Conn) {
+			RegularChain(c, table, "ssh")
+		})
+
+		c := testDialWithKernel(t, kernel, testWantMessages(t, addJump))
+		modified, added, _, _, err := target.Update(c, []RuleData{jump})
+		assert.Nil(t, err)
+		assert.True(t, modified)
+		assert.Equal(t, 1, added)
+		assert.Nil(t, c.Flush())
+	})
+
+	t.Run("rule in the kernel", func(t *testing.T) {
+		kernel := testKernelMessages(t, func(c *nftables.Conn) {
+			RegularChain(c, table, "ssh")
+			addJump(c)
+		})
+
+		c := testDialWithKernel(t, kernel, nil)
+		modified, added, removed, replaced, err := target.Update(c, []RuleData{jump})
+		assert.Nil(t, err)
+		assert.False(t, modified)
+		assert.Equal(t, []int{0, 0, 0}, []int{added, removed, replaced})
+	})
+
+	t.Run("missing chain", func(t *testing.T) {
+		kernel := testKernelMessages(t, func(c *nftables.Conn) {
+			RegularChain(c, table, "http")
+		})
+
+		c := testDialWithKernel(t, kernel, nil)
+		_, _, _, _, err := target.Update(c, []RuleData{jump})
+		assert.Error(t, err)
+
+		added, err := target.Add(c, jump)
+		assert.Error(t, err)
+		assert.False(t, added)
+	})
+}
+
+func TestUpdateMigrateOwner(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: "testtable"}
+	input := &nftables.Chain{Table: table, Name: "input", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput}
+
+	ssh, err := BuildRuleData([]byte{0xd, 0xe, 0xa, 0xd}, expr.VerdictDrop, TransportProtocol(expressions.TCP), DestinationPort(22))
+	assert.Nil(t, err)
+	http, err := BuildRuleData([]byte{0xc, 0xa, 0xf, 0xe}, expr.VerdictDrop, TransportProtocol(expressions.TCP), DestinationPort(80))
+	assert.Nil(t, err)
+	hand, err := BuildRuleData([]byte{}, expr.VerdictAccept, TransportProtocol(expressions.UDP))
+	assert.Nil(t, err)
+
+	target := NewRuleTarget(table, input, WithOwner("fwtk"))
+
+	// a chain written before the owner was set, the rules only carry their raw ID
+	legacy := testKernelMessages(t, func(c *nftables.Conn) {
+		c.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: ssh.Expressions, UserData: ssh.ID})
+		c.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: hand.Expressions})
+		c.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: http.Expressions, UserData: http.ID})
+	})
+
+	t.Run("legacy rules are adopted", func(t *testing.T) {
+		c := testDialWithKernel(t, legacy, nil)
+		for _, ruleData := range []RuleData{ssh, http} {
+			exists, err := target.Exists(c, ruleData)
+			assert.Nil(t, err)
+			assert.True(t, exists)
+
+			added, err := target.Add(c, ruleData)
+			assert.Nil(t, err)
+			assert.False(t, added)
+		}
+
+		// the rules aren't known to be managed until their IDs are given
+		foreign, err := target.GetForeign(c)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(foreign))
+	})
+
+	t.Run("update adds the owner in place", func(t *testing.T) {
+		want := testWantMessages(t, func(c *nftables.Conn) {
+			for i, ruleData := range []RuleData{ssh, http} {
+				userData, err := target.userData(ruleData)
+				assert.Nil(t, err)
+				// the rules keep their handles, around the rule added by hand
+				handle := uint64(1 + 2*i)
+				c.ReplaceRule(&nftables.Rule{Table: table, Chain: input, Handle: handle, Exprs: ruleData.Expressions, UserData: userData})
+			}
+		})
+
+		c := testDialWithKernel(t, legacy, want)
+		modified, added, removed, replaced, err := target.Update(c, []RuleData{ssh, http})
+		assert.Nil(t, err)
+		assert.True(t, modified)
+		assert.Equal(t, []int{0, 0, 2}, []int{added, removed, replaced})
+		assert.Nil(t, c.Flush())
+	})
+
+	t.Run("migrated chain is unchanged", func(t *testing.T) {
+		migrated := testKernelMessages(t, func(c *nftables.Conn) {
+			sshUserData, err := target.userData(ssh)
+			assert.Nil(t, err)
+			httpUserData, err := target.userData(http)
+			assert.Nil(t, err)
+
+			c.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: ssh.Expressions, UserData: sshUserData})
+			c.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: hand.Expressions})
+			c.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: http.Expressions, UserData: httpUserData})
+		})
+
+		c := testDialWithKernel(t, migrated, nil)
+		modified, added, removed, replaced, err := target.Update(c, []RuleData{ssh, http})
+		assert.Nil(t, err)
+		assert.False(t, modified)
+		assert.Equal(t, []int{0, 0, 0}, []int{added, removed, replaced})
+
+		foreign, err := target.GetForeign(c)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(foreign))
+	})
+}
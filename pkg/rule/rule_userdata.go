@@ -0,0 +1,124 @@
+package rule
+
+import (
+	"bytes"
+	"fmt"
+	"unicode"
+
+	"github.com/google/nftables/userdata"
+)
+
+// Rule user data is a list of NFTNL_UDATA TLVs, the same format nft uses. nft only understands the comment type and
+// skips everything else so the fwtk types are picked well clear of the ones libnftnl defines for rules.
+// https://git.netfilter.org/libnftnl/tree/include/libnftnl/udata.h
+const (
+	userDataTypeComment = userdata.TypeComment
+	userDataTypeID      = userdata.Type(0xf0)
+	userDataTypeOwner   = userdata.Type(0xf1)
+
+	// NFT_USERDATA_MAXLEN
+	userDataMaxLen = 256
+	// a single TLV can hold at most 255 bytes since the length is a single byte
+	userDataMaxValueLen = 255
+)
+
+// ruleUserData is the decoded user data of a rule
+type ruleUserData struct {
+	id      []byte
+	owner   string
+	comment string
+	// true if the user data is in the old format where it only held the raw ID
+	legacy bool
+}
+
+// encodeUserData encodes a rule ID, owner and comment into rule user data, an empty owner or comment is left out
+func encodeUserData(id []byte, owner string, comment string) ([]byte, error) {
+	if len(id) > userDataMaxValueLen {
+		return nil, fmt.Errorf("rule id %x is too long, %v > %v", id, len(id), userDataMaxValueLen)
+	}
+
+	// strings are NUL terminated
+	if len(owner)+1 > userDataMaxValueLen {
+		return nil, fmt.Errorf("rule owner %v is too long, %v > %v", owner, len(owner)+1, userDataMaxValueLen)
+	}
+
+	if len(comment)+1 > userDataMaxValueLen {
+		return nil, fmt.Errorf("rule comment %v is too long, %v > %v", comment, len(comment)+1, userDataMaxValueLen)
+	}
+
+	data := []byte{}
+	if comment != "" {
+		data = userdata.AppendString(data, userDataTypeComment, comment)
+	}
+	data = userdata.Append(data, userDataTypeID, id)
+	if owner != "" {
+		data = userdata.AppendString(data, userDataTypeOwner, owner)
+	}
+
+	if len(data) > userDataMaxLen {
+		return nil, fmt.Errorf("rule user data for %x is too long, %v > %v", id, len(data), userDataMaxLen)
+	}
+
+	return data, nil
+}
+
+// decodeUserData decodes rule user data
+//
+// User data that isn't a valid list of TLVs with an ID in it is treated as the old format and the whole thing is used
+// as the ID. This keeps rules created before the TLV format was introduced working, as well as rules added by other
+// tools, and is why a rule with only a comment added by nft is identified by its raw user data.
+func decodeUserData(data []byte) ruleUserData {
+	tlvs, ok := parseUserData(data)
+	if !ok {
+		return ruleUserData{id: data, legacy: true}
+	}
+
+	decoded := ruleUserData{
+		comment: string(bytes.TrimSuffix(tlvs[userDataTypeComment], []byte{0x0})),
+		owner:   string(bytes.TrimSuffix(tlvs[userDataTypeOwner], []byte{0x0})),
+	}
+
+	id, ok := tlvs[userDataTypeID]
+	if !ok {
+		decoded.id = data
+		decoded.legacy = true
+		return decoded
+	}
+	decoded.id = id
+
+	return decoded
+}
+
+// parseUserData splits user data into TLVs, returns false if the data isn't entirely made up of valid TLVs
+func parseUserData(data []byte) (map[userdata.Type][]byte, bool) {
+	tlvs := map[userdata.Type][]byte{}
+
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, false
+		}
+
+		typ := userdata.Type(data[0])
+		length := int(data[1])
+		if len(data) < 2+length {
+			return nil, false
+		}
+
+		tlvs[typ] = data[2 : 2+length]
+		data = data[2+length:]
+	}
+
+	return tlvs, true
+}
+
+// defaultComment is the comment used for a rule without one so nft shows something readable, the ID as is if it's
+// printable, otherwise as hex
+func defaultComment(id []byte) string {
+	for _, r := range string(id) {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return fmt.Sprintf("fwtk:%x", id)
+		}
+	}
+
+	return fmt.Sprintf("fwtk:%s", id)
+}
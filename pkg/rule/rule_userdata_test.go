@@ -0,0 +1,78 @@
+package rule
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeUserData(t *testing.T) {
+	userData, err := encodeUserData([]byte{0xd, 0xe, 0xa, 0xd}, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xf0, 0x4, 0xd, 0xe, 0xa, 0xd}, userData)
+
+	userData, err = encodeUserData([]byte{0xd, 0xe, 0xa, 0xd}, "fwtk", "hi")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x3, 0x68, 0x69, 0x0, 0xf0, 0x4, 0xd, 0xe, 0xa, 0xd, 0xf1, 0x5, 0x66, 0x77, 0x74, 0x6b, 0x0}, userData)
+
+	_, err = encodeUserData(make([]byte, 256), "", "")
+	assert.Error(t, err)
+
+	_, err = encodeUserData([]byte{0xd}, "", strings.Repeat("a", 255))
+	assert.Error(t, err)
+
+	// each TLV fits but all together they are over the kernel limit
+	_, err = encodeUserData(make([]byte, 200), "", strings.Repeat("a", 100))
+	assert.Error(t, err)
+}
+
+func TestDecodeUserData(t *testing.T) {
+	tests := []struct {
+		name     string
+		userData []byte
+		want     ruleUserData
+	}{
+		{
+			"tlvs",
+			[]byte{0x0, 0x3, 0x68, 0x69, 0x0, 0xf0, 0x4, 0xd, 0xe, 0xa, 0xd, 0xf1, 0x5, 0x66, 0x77, 0x74, 0x6b, 0x0},
+			ruleUserData{id: []byte{0xd, 0xe, 0xa, 0xd}, owner: "fwtk", comment: "hi"},
+		},
+		{
+			"tlvs in any order",
+			[]byte{0xf0, 0x4, 0xd, 0xe, 0xa, 0xd, 0x0, 0x3, 0x68, 0x69, 0x0},
+			ruleUserData{id: []byte{0xd, 0xe, 0xa, 0xd}, comment: "hi"},
+		},
+		{
+			"legacy raw id",
+			[]byte{0xd, 0xe, 0xa, 0xd},
+			ruleUserData{id: []byte{0xd, 0xe, 0xa, 0xd}, legacy: true},
+		},
+		{
+			"legacy truncated tlv",
+			[]byte{0x0, 0x5, 0x68},
+			ruleUserData{id: []byte{0x0, 0x5, 0x68}, legacy: true},
+		},
+		{
+			"comment added by nft without an id",
+			[]byte{0x0, 0x3, 0x68, 0x69, 0x0},
+			ruleUserData{id: []byte{0x0, 0x3, 0x68, 0x69, 0x0}, comment: "hi", legacy: true},
+		},
+		{
+			"empty",
+			nil,
+			ruleUserData{legacy: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, decodeUserData(test.userData))
+		})
+	}
+}
+
+func TestDefaultComment(t *testing.T) {
+	assert.Equal(t, "fwtk:ssh", defaultComment([]byte("ssh")))
+	assert.Equal(t, "fwtk:0d0e0a0d", defaultComment([]byte{0xd, 0xe, 0xa, 0xd}))
+}
@@ -0,0 +1,432 @@
+package rule
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/ngrok/firewall_toolkit/pkg/expressions"
+	"golang.org/x/sys/unix"
+)
+
+// Defines a Terminal signature for the statement that ends a rule, like a
+// verdict or NAT. It can check the rule the builder put together before
+// returning its expressions.
+type Terminal func(*builder) ([]expr.Any, error)
+
+// Verdict ends the rule with a verdict, Build(v, ...) is the same as
+// BuildTerminal(Verdict(v), ...).
+func Verdict(v expr.VerdictKind) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		return []expr.Any{&expr.Verdict{Kind: v}}, nil
+	}
+}
+
+// DNAT rewrites the destination address of traffic that matches the rule to
+// addr, and the destination port to port unless it's 0. The rule has to be in
+// a nat chain on the prerouting or output hook.
+func DNAT(addr netip.Addr, port uint16) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		if err := b.checkNAT(addr, port); err != nil {
+			return nil, err
+		}
+
+		return expressions.DNAT(addr, port)
+	}
+}
+
+// SNAT rewrites the source address of traffic that matches the rule to addr,
+// and the source port to port unless it's 0. The rule has to be in a nat
+// chain on the postrouting or input hook.
+func SNAT(addr netip.Addr, port uint16) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		if err := b.checkNAT(addr, port); err != nil {
+			return nil, err
+		}
+
+		return expressions.SNAT(addr, port)
+	}
+}
+
+// Masquerade rewrites the source address of traffic that matches the rule to
+// the address of the interface it leaves on. The rule has to be in a nat
+// chain on the postrouting hook.
+func Masquerade() Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		return []expr.Any{expressions.Masquerade()}, nil
+	}
+}
+
+// Redirect sends traffic that matches the rule to the local machine, to port
+// unless it's 0. The rule has to be in a nat chain on the prerouting or
+// output hook.
+func Redirect(port uint16) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		if err := b.checkNATPort(port); err != nil {
+			return nil, err
+		}
+
+		return expressions.Redirect(port), nil
+	}
+}
+
+// Reject answers traffic that matches the rule the way nft's plain reject
+// does, with an ICMP or ICMPv6 port unreachable message for the family of the
+// rule, or an ICMPx port unreachable message if the rule doesn't have one,
+// which only inet tables support.
+func Reject() Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		switch b.family {
+		case expressions.IPv4:
+			return []expr.Any{expressions.RejectICMP(expressions.ICMPPortUnreachable)}, nil
+		case expressions.IPv6:
+			return []expr.Any{expressions.RejectICMP(expressions.ICMPv6PortUnreachable)}, nil
+		default:
+			e, err := expressions.RejectICMPx(expressions.ICMPxPortUnreachable)
+			if err != nil {
+				return nil, err
+			}
+			return []expr.Any{e}, nil
+		}
+	}
+}
+
+// RejectTCPReset answers traffic that matches the rule with a TCP reset, the
+// rule has to use the TCP transport.
+func RejectTCPReset() Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		if b.transport != expressions.TCP {
+			return nil, errors.New("reject with tcp reset requires the tcp transport")
+		}
+
+		return []expr.Any{expressions.RejectTCPReset()}, nil
+	}
+}
+
+// RejectICMP answers traffic that matches the rule with an ICMP destination
+// unreachable message with code (ex. expressions.ICMPAdminProhibited), the
+// rule has to use the IPv4 family.
+func RejectICMP(code uint8) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		if b.family != expressions.IPv4 {
+			return nil, errors.New("reject with icmp requires the ipv4 family")
+		}
+
+		if code > expressions.ICMPUnreachableCodesMax {
+			return nil, fmt.Errorf("invalid icmp destination unreachable code %v", code)
+		}
+
+		return []expr.Any{expressions.RejectICMP(code)}, nil
+	}
+}
+
+// RejectICMPv6 answers traffic that matches the rule with an ICMPv6
+// destination unreachable message with code (ex.
+// expressions.ICMPv6AdminProhibited), the rule has to use the IPv6 family.
+func RejectICMPv6(code uint8) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		if b.family != expressions.IPv6 {
+			return nil, errors.New("reject with icmpv6 requires the ipv6 family")
+		}
+
+		if code > expressions.ICMPv6UnreachableCodesMax {
+			return nil, fmt.Errorf("invalid icmpv6 destination unreachable code %v", code)
+		}
+
+		return []expr.Any{expressions.RejectICMP(code)}, nil
+	}
+}
+
+// RejectICMPx answers traffic that matches the rule with the ICMP or ICMPv6
+// destination unreachable message for the ICMPx code (ex.
+// expressions.ICMPxAdminProhibited), depending on the family of the traffic.
+// Only inet tables support it.
+func RejectICMPx(code uint8) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		e, err := expressions.RejectICMPx(code)
+		if err != nil {
+			return nil, err
+		}
+
+		return []expr.Any{e}, nil
+	}
+}
+
+// Queue sends traffic that matches the rule to the userspace program
+// listening on queue num, see the nfqueue package. With
+// expr.QueueFlagBypass traffic is accepted when nothing is listening,
+// otherwise it's dropped.
+func Queue(num uint16, flags expr.QueueFlag) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		e, err := expressions.Queue(num, 1, flags)
+		if err != nil {
+			return nil, err
+		}
+
+		return []expr.Any{e}, nil
+	}
+}
+
+// QueueRange sends traffic that matches the rule to the queues start through
+// end, spreading it across them by flow, or by CPU with
+// expr.QueueFlagFanout. Flags are the same as Queue's.
+func QueueRange(start uint16, end uint16, flags expr.QueueFlag) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		if end < start {
+			return nil, fmt.Errorf("invalid queue range %v-%v", start, end)
+		}
+
+		e, err := expressions.Queue(start, end-start+1, flags)
+		if err != nil {
+			return nil, err
+		}
+
+		return []expr.Any{e}, nil
+	}
+}
+
+// Jump continues evaluating traffic that matches the rule in the regular
+// chain, traffic that isn't accepted or dropped there comes back to the rule
+// after this one. The chain has to exist in the same table before the rule is
+// added, or be passed to the RuleTarget with WithChains when it's created in
+// the same batch, see RegularChain.
+func Jump(chain string) Terminal {
+	return chainVerdict(expr.VerdictJump, chain)
+}
+
+// Goto continues evaluating traffic that matches the rule in the regular
+// chain like Jump, but doesn't come back to this chain. Traffic that isn't
+// accepted or dropped there gets the verdict of the chain that jumped here,
+// or the base chain's policy.
+func Goto(chain string) Terminal {
+	return chainVerdict(expr.VerdictGoto, chain)
+}
+
+func chainVerdict(kind expr.VerdictKind, chain string) Terminal {
+	return func(b *builder) ([]expr.Any, error) {
+		if chain == "" {
+			return nil, errors.New("jump or goto requires a chain name")
+		}
+
+		if len(chain) >= nftNameMaxLen {
+			return nil, fmt.Errorf("chain name %v is too long, %v >= %v", chain, len(chain), nftNameMaxLen)
+		}
+
+		return []expr.Any{&expr.Verdict{Kind: kind, Chain: chain}}, nil
+	}
+}
+
+// NFT_NAME_MAXLEN, including the NUL terminator
+const nftNameMaxLen = 256
+
+func (b *builder) checkNAT(addr netip.Addr, port uint16) error {
+	if !addr.IsValid() {
+		return errors.New("invalid nat address")
+	}
+
+	if err := b.checkAddrFamily(addr); err != nil {
+		return err
+	}
+
+	return b.checkNATPort(port)
+}
+
+// checkNATPort makes sure a port is only rewritten for traffic that has one
+func (b *builder) checkNATPort(port uint16) error {
+	if port != 0 && b.transport != expressions.TCP && b.transport != expressions.UDP {
+		return errors.New("nat to a port requires the tcp or udp transport")
+	}
+	return nil
+}
+
+// NATChain adds a nat chain to the table on hook with the priority nft uses
+// for it, dstnat for prerouting and output and srcnat for postrouting and
+// input. Use it for rules with the DNAT, SNAT, Masquerade and Redirect
+// terminals.
+func NATChain(c *nftables.Conn, table *nftables.Table, name string, hook *nftables.ChainHook) (*nftables.Chain, error) {
+	switch table.Family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6, nftables.TableFamilyINet:
+	default:
+		return nil, fmt.Errorf("nat chains aren't supported in table family %v", table.Family)
+	}
+
+	var priority *nftables.ChainPriority
+	switch {
+	case hook == nil:
+		return nil, errors.New("nat chain requires a hook")
+	case *hook == *nftables.ChainHookPrerouting, *hook == *nftables.ChainHookOutput:
+		priority = nftables.ChainPriorityNATDest
+	case *hook == *nftables.ChainHookPostrouting, *hook == *nftables.ChainHookInput:
+		priority = nftables.ChainPriorityNATSource
+	default:
+		return nil, fmt.Errorf("nat chains aren't supported on hook %v", *hook)
+	}
+
+	return c.AddChain(&nftables.Chain{
+		Name:     name,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  hook,
+		Priority: priority,
+	}), nil
+}
+
+// RegularChain adds a regular chain to the table, one without a hook that's
+// only evaluated when a rule jumps or goes to it with Jump or Goto. Adding a
+// chain that already exists leaves it and its rules as they are, so it's safe
+// to call on every run. Manage its rules with a RuleTarget like any other
+// chain. Rules that jump to it before the batch it's added in is flushed need
+// it passed to their RuleTarget with WithChains.
+func RegularChain(c *nftables.Conn, table *nftables.Table, name string) *nftables.Chain {
+	return c.AddChain(&nftables.Chain{
+		Name:  name,
+		Table: table,
+	})
+}
+
+// validateChain checks that the expressions of a rule can be used in the table and chain. NAT statements are only
+// allowed in nat chains on the hooks they apply to, reject statements can't be used after routing or with a type
+// the table family doesn't support, socket matches need locally generated traffic, fib lookups need the interfaces
+// they use and MSS clamping needs the route. Hooks of regular chains aren't checked since it depends on the chains
+// that jump to them.
+func validateChain(table *nftables.Table, chain *nftables.Chain, exprs []expr.Any) error {
+	for _, e := range exprs {
+		if v, ok := e.(*expr.Reject); ok {
+			if err := validateReject(table, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	if chain == nil || chain.Hooknum == nil {
+		return nil
+	}
+
+	for _, e := range exprs {
+		var hooks []*nftables.ChainHook
+		var name string
+		nat := true
+
+		switch v := e.(type) {
+		case *expr.NAT:
+			if v.Type == expr.NATTypeDestNAT {
+				name, hooks = "dnat", []*nftables.ChainHook{nftables.ChainHookPrerouting, nftables.ChainHookOutput}
+			} else {
+				name, hooks = "snat", []*nftables.ChainHook{nftables.ChainHookPostrouting, nftables.ChainHookInput}
+			}
+		case *expr.Masq:
+			name, hooks = "masquerade", []*nftables.ChainHook{nftables.ChainHookPostrouting}
+		case *expr.Redir:
+			name, hooks = "redirect", []*nftables.ChainHook{nftables.ChainHookPrerouting, nftables.ChainHookOutput}
+		case *expr.Reject:
+			name, hooks = "reject", []*nftables.ChainHook{nftables.ChainHookPrerouting, nftables.ChainHookInput, nftables.ChainHookForward, nftables.ChainHookOutput}
+			nat = false
+		case *expr.Meta:
+			if v.SourceRegister || (v.Key != expr.MetaKeySKUID && v.Key != expr.MetaKeySKGID) {
+				continue
+			}
+			name, hooks = "socket owner match", []*nftables.ChainHook{nftables.ChainHookOutput, nftables.ChainHookPostrouting}
+			nat = false
+		case *expr.Fib:
+			// the kernel only allows output interface results and lookups by the input interface on traffic that came
+			// in, and lookups by the output interface on traffic that's going out
+			switch {
+			case v.ResultOIF || v.ResultOIFNAME || v.FlagIIF:
+				hooks = []*nftables.ChainHook{nftables.ChainHookPrerouting, nftables.ChainHookInput, nftables.ChainHookForward}
+			case v.FlagOIF:
+				hooks = []*nftables.ChainHook{nftables.ChainHookForward, nftables.ChainHookOutput, nftables.ChainHookPostrouting}
+			default:
+				continue
+			}
+			name, nat = "fib lookup", false
+		case *expr.Socket:
+			if v.Key != expr.SocketKeyCgroupv2 {
+				continue
+			}
+			name, hooks = "socket cgroupv2 match", []*nftables.ChainHook{nftables.ChainHookOutput}
+			nat = false
+		case *expr.Rt:
+			if v.Key != expr.RtTCPMSS {
+				continue
+			}
+			name, hooks = "mss clamping", []*nftables.ChainHook{nftables.ChainHookForward, nftables.ChainHookOutput, nftables.ChainHookPostrouting}
+			nat = false
+		default:
+			continue
+		}
+
+		if nat && chain.Type != nftables.ChainTypeNAT {
+			return fmt.Errorf("%v requires a nat chain, chain %v is type %v", name, chain.Name, chain.Type)
+		}
+
+		if !hookIn(*chain.Hooknum, hooks) {
+			return fmt.Errorf("%v isn't supported on the hook of chain %v", name, chain.Name)
+		}
+	}
+
+	return nil
+}
+
+// validateReject checks the reject type is supported by the table family
+func validateReject(table *nftables.Table, reject *expr.Reject) error {
+	if table == nil {
+		return nil
+	}
+
+	switch table.Family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6:
+		if reject.Type == unix.NFT_REJECT_ICMPX_UNREACH {
+			return fmt.Errorf("reject with icmpx isn't supported in table %v, only in inet tables", table.Name)
+		}
+	case nftables.TableFamilyINet, nftables.TableFamilyBridge, nftables.TableFamilyNetdev:
+	default:
+		return fmt.Errorf("reject isn't supported in table %v", table.Name)
+	}
+
+	return nil
+}
+
+func hookIn(hook nftables.ChainHook, hooks []*nftables.ChainHook) bool {
+	for _, h := range hooks {
+		if hook == *h {
+			return true
+		}
+	}
+	return false
+}
+
+// jumpTargets returns the chains the expressions jump or go to
+func jumpTargets(exprs []expr.Any) []string {
+	targets := []string{}
+	for _, e := range exprs {
+		if v, ok := e.(*expr.Verdict); ok && (v.Kind == expr.VerdictJump || v.Kind == expr.VerdictGoto) {
+			targets = append(targets, v.Chain)
+		}
+	}
+
+	return targets
+}
+
+// validateJumps checks that the chains a rule in chain jumps or goes to are regular chains in the list of chains that
+// exist in the table
+func validateJumps(chain *nftables.Chain, existing []*nftables.Chain, exprs []expr.Any) error {
+	for _, target := range jumpTargets(exprs) {
+		if chain != nil && target == chain.Name {
+			return fmt.Errorf("chain %v can't jump to itself", target)
+		}
+
+		i := slices.IndexFunc(existing, func(c *nftables.Chain) bool { return c.Name == target })
+		if i < 0 {
+			return fmt.Errorf("chain %v doesn't exist", target)
+		}
+
+		if existing[i].Hooknum != nil {
+			return fmt.Errorf("chain %v is a base chain, only regular chains can be jumped to", target)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,345 @@
+package rule
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/ngrok/firewall_toolkit/pkg/expressions"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuilderNAT(t *testing.T) {
+	t.Run("dnat", func(t *testing.T) {
+		exprs, err := BuildTerminal(
+			DNAT(netip.MustParseAddr("10.0.0.2"), 8080),
+
+			AddressFamily(expressions.IPv4),
+			TransportProtocol(expressions.TCP),
+
+			DestinationPort(80),
+		)
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 9)
+		assert.Equal(t, &expr.Immediate{Register: 1, Data: []byte{0xa, 0x0, 0x0, 0x2}}, exprs[6])
+		assert.Equal(t, &expr.Immediate{Register: 2, Data: []byte{0x1f, 0x90}}, exprs[7])
+		assert.IsType(t, &expr.NAT{}, exprs[8])
+	})
+
+	t.Run("masquerade", func(t *testing.T) {
+		exprs, err := BuildTerminal(Masquerade(), AddressFamily(expressions.IPv4))
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 3)
+		assert.Equal(t, &expr.Masq{}, exprs[2])
+	})
+
+	t.Run("redirect rule data", func(t *testing.T) {
+		ruleData, err := BuildTerminalRuleData([]byte{0x1}, Redirect(5353), TransportProtocol(expressions.UDP), DestinationPort(53))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x1}, ruleData.ID)
+		assert.IsType(t, &expr.Redir{}, ruleData.Expressions[len(ruleData.Expressions)-1])
+	})
+
+	t.Run("family mismatch", func(t *testing.T) {
+		_, err := BuildTerminal(SNAT(netip.MustParseAddr("2001:db8::1"), 0), AddressFamily(expressions.IPv4))
+		assert.Error(t, err)
+	})
+
+	t.Run("port without transport", func(t *testing.T) {
+		_, err := BuildTerminal(DNAT(netip.MustParseAddr("10.0.0.2"), 8080))
+		assert.Error(t, err)
+
+		_, err = BuildTerminal(Redirect(8080), TransportProtocol(expressions.ICMP))
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid address", func(t *testing.T) {
+		_, err := BuildTerminal(DNAT(netip.Addr{}, 0))
+		assert.Error(t, err)
+	})
+}
+
+func TestValidateChain(t *testing.T) {
+	dnat, err := BuildTerminal(DNAT(netip.MustParseAddr("10.0.0.2"), 0))
+	assert.NoError(t, err)
+	snat, err := BuildTerminal(SNAT(netip.MustParseAddr("10.0.0.1"), 0))
+	assert.NoError(t, err)
+	masq, err := BuildTerminal(Masquerade())
+	assert.NoError(t, err)
+	drop, err := Build(expr.VerdictDrop)
+	assert.NoError(t, err)
+
+	prerouting := &nftables.Chain{Name: "prerouting", Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+	postrouting := &nftables.Chain{Name: "postrouting", Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPostrouting}
+	input := &nftables.Chain{Name: "input", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput}
+	regular := &nftables.Chain{Name: "regular"}
+
+	assert.NoError(t, validateChain(nil, prerouting, dnat))
+	assert.NoError(t, validateChain(nil, postrouting, snat))
+	assert.NoError(t, validateChain(nil, postrouting, masq))
+	assert.NoError(t, validateChain(nil, prerouting, drop))
+	assert.NoError(t, validateChain(nil, input, drop))
+	// regular chains depend on the chains that jump to them
+	assert.NoError(t, validateChain(nil, regular, dnat))
+
+	assert.Error(t, validateChain(nil, postrouting, dnat))
+	assert.Error(t, validateChain(nil, prerouting, snat))
+	assert.Error(t, validateChain(nil, prerouting, masq))
+	assert.Error(t, validateChain(nil, input, dnat))
+}
+
+func TestNATChain(t *testing.T) {
+	c, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		return req, nil
+	}))
+	assert.NoError(t, err)
+
+	table := &nftables.Table{Name: "nat", Family: nftables.TableFamilyINet}
+
+	chain, err := NATChain(c, table, "prerouting", nftables.ChainHookPrerouting)
+	assert.NoError(t, err)
+	assert.Equal(t, nftables.ChainTypeNAT, chain.Type)
+	assert.Equal(t, nftables.ChainPriorityNATDest, chain.Priority)
+
+	chain, err = NATChain(c, table, "postrouting", nftables.ChainHookPostrouting)
+	assert.NoError(t, err)
+	assert.Equal(t, nftables.ChainPriorityNATSource, chain.Priority)
+
+	_, err = NATChain(c, table, "forward", nftables.ChainHookForward)
+	assert.Error(t, err)
+
+	_, err = NATChain(c, &nftables.Table{Name: "netdev", Family: nftables.TableFamilyNetdev}, "ingress", nftables.ChainHookIngress)
+	assert.Error(t, err)
+}
+
+func TestBuilderJump(t *testing.T) {
+	exprs, err := BuildTerminal(Jump("ssh"), TransportProtocol(expressions.TCP), DestinationPort(22))
+	assert.NoError(t, err)
+	assert.Equal(t, &expr.Verdict{Kind: expr.VerdictJump, Chain: "ssh"}, exprs[len(exprs)-1])
+
+	exprs, err = BuildTerminal(Goto("ssh"))
+	assert.NoError(t, err)
+	assert.Equal(t, []expr.Any{&expr.Verdict{Kind: expr.VerdictGoto, Chain: "ssh"}}, exprs)
+
+	_, err = BuildTerminal(Jump(""))
+	assert.Error(t, err)
+
+	_, err = BuildTerminal(Goto(strings.Repeat("a", 256)))
+	assert.Error(t, err)
+}
+
+func TestValidateJumps(t *testing.T) {
+	input := &nftables.Chain{Name: "input", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput}
+	ssh := &nftables.Chain{Name: "ssh"}
+	existing := []*nftables.Chain{input, ssh}
+
+	jumpSSH, err := BuildTerminal(Jump("ssh"))
+	assert.NoError(t, err)
+	gotoInput, err := BuildTerminal(Goto("input"))
+	assert.NoError(t, err)
+	jumpMissing, err := BuildTerminal(Jump("missing"))
+	assert.NoError(t, err)
+	drop, err := Build(expr.VerdictDrop)
+	assert.NoError(t, err)
+
+	assert.NoError(t, validateJumps(input, existing, jumpSSH))
+	assert.NoError(t, validateJumps(input, existing, drop))
+	assert.Error(t, validateJumps(input, existing, jumpMissing))
+	// base chains can't be jumped to
+	assert.Error(t, validateJumps(ssh, existing, gotoInput))
+	assert.Error(t, validateJumps(ssh, existing, jumpSSH))
+
+	assert.Equal(t, []string{"ssh"}, jumpTargets(jumpSSH))
+	assert.Equal(t, []string{}, jumpTargets(drop))
+}
+
+func TestRegularChain(t *testing.T) {
+	c, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		return req, nil
+	}))
+	assert.NoError(t, err)
+
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	chain := RegularChain(c, table, "ssh")
+	assert.Equal(t, &nftables.Chain{Name: "ssh", Table: table}, chain)
+}
+
+func TestBuilderReject(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		exprs, err := BuildTerminal(Reject(), AddressFamily(expressions.IPv4))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: expressions.ICMPPortUnreachable}, exprs[len(exprs)-1])
+
+		exprs, err = BuildTerminal(Reject(), AddressFamily(expressions.IPv6))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: expressions.ICMPv6PortUnreachable}, exprs[len(exprs)-1])
+
+		exprs, err = BuildTerminal(Reject())
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{&expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: expressions.ICMPxPortUnreachable}}, exprs)
+	})
+
+	t.Run("tcp reset", func(t *testing.T) {
+		exprs, err := BuildTerminal(RejectTCPReset(), TransportProtocol(expressions.TCP), DestinationPort(443))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_TCP_RST}, exprs[len(exprs)-1])
+
+		_, err = BuildTerminal(RejectTCPReset(), TransportProtocol(expressions.UDP))
+		assert.Error(t, err)
+	})
+
+	t.Run("icmp", func(t *testing.T) {
+		exprs, err := BuildTerminal(RejectICMP(expressions.ICMPAdminProhibited), AddressFamily(expressions.IPv4))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 13}, exprs[len(exprs)-1])
+
+		_, err = BuildTerminal(RejectICMP(expressions.ICMPAdminProhibited), AddressFamily(expressions.IPv6))
+		assert.Error(t, err)
+
+		_, err = BuildTerminal(RejectICMP(expressions.ICMPAdminProhibited))
+		assert.Error(t, err)
+
+		_, err = BuildTerminal(RejectICMP(16), AddressFamily(expressions.IPv4))
+		assert.Error(t, err)
+	})
+
+	t.Run("icmpv6", func(t *testing.T) {
+		exprs, err := BuildTerminal(RejectICMPv6(expressions.ICMPv6AdminProhibited), AddressFamily(expressions.IPv6))
+		assert.NoError(t, err)
+		assert.Equal(t, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 1}, exprs[len(exprs)-1])
+
+		_, err = BuildTerminal(RejectICMPv6(expressions.ICMPv6AdminProhibited), AddressFamily(expressions.IPv4))
+		assert.Error(t, err)
+
+		_, err = BuildTerminal(RejectICMPv6(7), AddressFamily(expressions.IPv6))
+		assert.Error(t, err)
+	})
+
+	t.Run("icmpx", func(t *testing.T) {
+		exprs, err := BuildTerminal(RejectICMPx(expressions.ICMPxAdminProhibited))
+		assert.NoError(t, err)
+		assert.Equal(t, []expr.Any{&expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: 3}}, exprs)
+
+		_, err = BuildTerminal(RejectICMPx(4))
+		assert.Error(t, err)
+	})
+}
+
+func TestBuilderQueue(t *testing.T) {
+	exprs, err := BuildTerminal(Queue(1, expr.QueueFlagBypass), TransportProtocol(expressions.TCP), DestinationPort(443))
+	assert.NoError(t, err)
+	assert.Equal(t, &expr.Queue{Num: 1, Total: 1, Flag: expr.QueueFlagBypass}, exprs[len(exprs)-1])
+
+	exprs, err = BuildTerminal(QueueRange(2, 5, expr.QueueFlagFanout))
+	assert.NoError(t, err)
+	assert.Equal(t, []expr.Any{&expr.Queue{Num: 2, Total: 4, Flag: expr.QueueFlagFanout}}, exprs)
+
+	_, err = BuildTerminal(QueueRange(5, 2, 0))
+	assert.Error(t, err)
+
+	_, err = BuildTerminal(Queue(1, expr.QueueFlagFanout))
+	assert.Error(t, err)
+}
+
+func TestValidateChainReject(t *testing.T) {
+	ip := &nftables.Table{Name: "ip", Family: nftables.TableFamilyIPv4}
+	inet := &nftables.Table{Name: "inet", Family: nftables.TableFamilyINet}
+	arp := &nftables.Table{Name: "arp", Family: nftables.TableFamilyARP}
+
+	input := &nftables.Chain{Name: "input", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput}
+	postrouting := &nftables.Chain{Name: "postrouting", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPostrouting}
+
+	icmp, err := BuildTerminal(RejectICMP(expressions.ICMPPortUnreachable), AddressFamily(expressions.IPv4))
+	assert.NoError(t, err)
+	icmpx, err := BuildTerminal(RejectICMPx(expressions.ICMPxPortUnreachable))
+	assert.NoError(t, err)
+
+	assert.NoError(t, validateChain(ip, input, icmp))
+	assert.NoError(t, validateChain(inet, input, icmp))
+	assert.NoError(t, validateChain(inet, input, icmpx))
+	assert.NoError(t, validateChain(inet, &nftables.Chain{Name: "regular"}, icmpx))
+
+	assert.Error(t, validateChain(ip, input, icmpx))
+	assert.Error(t, validateChain(arp, input, icmp))
+	assert.Error(t, validateChain(inet, postrouting, icmpx))
+}
+
+func TestValidateChainSocket(t *testing.T) {
+	output := &nftables.Chain{Name: "output", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookOutput}
+	postrouting := &nftables.Chain{Name: "postrouting", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPostrouting}
+	input := &nftables.Chain{Name: "input", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput}
+	prerouting := &nftables.Chain{Name: "prerouting", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPrerouting}
+
+	uid, err := Build(expr.VerdictAccept, SocketUID(1000))
+	assert.NoError(t, err)
+	cgroup, err := Build(expr.VerdictAccept, Any(&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: 1, Register: 1}))
+	assert.NoError(t, err)
+	// setting the mark isn't a socket match
+	mark, err := Build(expr.VerdictAccept, SetMark(0x1, 0x1))
+	assert.NoError(t, err)
+
+	assert.NoError(t, validateChain(nil, output, uid))
+	assert.NoError(t, validateChain(nil, postrouting, uid))
+	assert.NoError(t, validateChain(nil, output, cgroup))
+	assert.NoError(t, validateChain(nil, input, mark))
+	assert.NoError(t, validateChain(nil, &nftables.Chain{Name: "regular"}, uid))
+
+	assert.Error(t, validateChain(nil, input, uid))
+	assert.Error(t, validateChain(nil, prerouting, uid))
+	assert.Error(t, validateChain(nil, postrouting, cgroup))
+	assert.Error(t, validateChain(nil, input, cgroup))
+}
+
+func TestValidateChainFib(t *testing.T) {
+	prerouting := &nftables.Chain{Name: "prerouting", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPrerouting}
+	forward := &nftables.Chain{Name: "forward", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward}
+	output := &nftables.Chain{Name: "output", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookOutput}
+	postrouting := &nftables.Chain{Name: "postrouting", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPostrouting}
+
+	rpf, err := Build(expr.VerdictDrop, ReversePathFilter())
+	assert.NoError(t, err)
+	outputType, err := expressions.CompareFibAddressType(expressions.FibDestinationAddress|expressions.FibOutputInterface, expressions.FibAddressTypeLocal)
+	assert.NoError(t, err)
+	outputLocal, err := Build(expr.VerdictDrop, Any(outputType...))
+	assert.NoError(t, err)
+	addrType, err := expressions.CompareFibAddressType(expressions.FibDestinationAddress, expressions.FibAddressTypeLocal)
+	assert.NoError(t, err)
+	local, err := Build(expr.VerdictAccept, Any(addrType...))
+	assert.NoError(t, err)
+
+	assert.NoError(t, validateChain(nil, prerouting, rpf))
+	assert.NoError(t, validateChain(nil, forward, rpf))
+	assert.NoError(t, validateChain(nil, output, outputLocal))
+	assert.NoError(t, validateChain(nil, postrouting, outputLocal))
+	// address type lookups without an interface work anywhere
+	assert.NoError(t, validateChain(nil, prerouting, local))
+	assert.NoError(t, validateChain(nil, output, local))
+
+	assert.Error(t, validateChain(nil, output, rpf))
+	assert.Error(t, validateChain(nil, postrouting, rpf))
+	assert.Error(t, validateChain(nil, prerouting, outputLocal))
+}
+
+func TestValidateChainMSS(t *testing.T) {
+	forward := &nftables.Chain{Name: "forward", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward}
+	output := &nftables.Chain{Name: "output", Type: nftables.ChainTypeRoute, Hooknum: nftables.ChainHookOutput}
+	prerouting := &nftables.Chain{Name: "prerouting", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPrerouting}
+	input := &nftables.Chain{Name: "input", Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput}
+
+	clamp, err := Build(expr.VerdictAccept, TransportProtocol(expressions.TCP), ClampMSSToPMTU())
+	assert.NoError(t, err)
+	mss, err := Build(expr.VerdictAccept, TransportProtocol(expressions.TCP), SetMSS(1400))
+	assert.NoError(t, err)
+
+	assert.NoError(t, validateChain(nil, forward, clamp))
+	assert.NoError(t, validateChain(nil, output, clamp))
+	// a fixed MSS doesn't need the route
+	assert.NoError(t, validateChain(nil, prerouting, mss))
+
+	assert.Error(t, validateChain(nil, prerouting, clamp))
+	assert.Error(t, validateChain(nil, input, clamp))
+}
@@ -7,6 +7,8 @@ package set
 
 import (
 	"fmt"
+	"net/netip"
+	"time"
 
 	"github.com/gaissmai/extnetip"
 	"github.com/google/nftables"
@@ -29,8 +31,28 @@ type Set struct {
 	set *nftables.Set
 }
 
+// Defines an optional setting for a new set
+type SetOption func(*Set)
+
+// WithDynamic creates a set that rules can add elements to from the packet path, see rule.SourceAddressMeter and
+// rule.SourceAddressConnLimit. Each element is removed after timeout without traffic, 0 keeps elements until they are
+// deleted.
+//
+// Dynamic sets hold single addresses or ports rather than ranges and have no set level counter since the kernel only
+// allows the expressions of the rule that adds an element, like a limit or counter, to be attached to it.
+func WithDynamic(timeout time.Duration) SetOption {
+	return func(s *Set) {
+		s.set.Dynamic = true
+		s.set.Interval = false
+		s.set.Counter = false
+		s.set.HasTimeout = timeout > 0
+		s.set.Timeout = timeout
+		s.set.KeyByteOrder = binaryutil.BigEndian
+	}
+}
+
 // Create a new set on a table with a given key type
-func New(c *nftables.Conn, table *nftables.Table, name string, keyType nftables.SetDatatype) (Set, error) {
+func New(c *nftables.Conn, table *nftables.Table, name string, keyType nftables.SetDatatype, opts ...SetOption) (Set, error) {
 	// we've seen problems where sets need to be initialized with a value otherwise nftables seems to default to the
 	// native endianness, likely little endian, which is always incorrect for network stuff resulting in backwards ips, etc.
 	// we set everything to documentation values and then immediately delete them leaving empty, correctly created sets.
@@ -70,12 +92,23 @@ func New(c *nftables.Conn, table *nftables.Table, name string, keyType nftables.
 		return Set{}, fmt.Errorf("unsupported set key type: %v", keyType)
 	}
 
-	set := &nftables.Set{
-		Name:     name,
-		Table:    table,
-		KeyType:  keyType,
-		Interval: true,
-		Counter:  true,
+	s := Set{
+		set: &nftables.Set{
+			Name:     name,
+			Table:    table,
+			KeyType:  keyType,
+			Interval: true,
+			Counter:  true,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(&s)
+	}
+
+	set := s.set
+	if !set.Interval {
+		initElems = singleElements(initElems)
 	}
 
 	if err := c.AddSet(set, initElems); err != nil {
@@ -92,9 +125,7 @@ func New(c *nftables.Conn, table *nftables.Table, name string, keyType nftables.
 		return Set{}, fmt.Errorf("error flushing set %v: %v", name, err)
 	}
 
-	return Set{
-		set: set,
-	}, nil
+	return s, nil
 }
 
 // Compares incoming set elements with existing set elements and adds/removes the differences.
@@ -119,7 +150,7 @@ func (s *Set) update(c *nftables.Conn, add []SetData, remove []SetData) (bool, i
 	if len(remove) > 0 {
 		modified = true
 
-		removeElems, err := generateElements(s.set.KeyType, remove)
+		removeElems, err := s.generateElements(remove)
 		if err != nil {
 			return false, 0, 0, fmt.Errorf("generating set elements failed for %v: %v", s.set.Name, err)
 		}
@@ -132,7 +163,7 @@ func (s *Set) update(c *nftables.Conn, add []SetData, remove []SetData) (bool, i
 	if len(add) > 0 {
 		modified = true
 
-		addElems, err := generateElements(s.set.KeyType, add)
+		addElems, err := s.generateElements(add)
 		if err != nil {
 			return false, 0, 0, fmt.Errorf("generating set elements failed for %v: %v", s.set.Name, err)
 		}
@@ -149,7 +180,7 @@ func (s *Set) update(c *nftables.Conn, add []SetData, remove []SetData) (bool, i
 func (s *Set) ClearAndAddElements(c *nftables.Conn, newSetData []SetData) error {
 	c.FlushSet(s.set)
 
-	newElems, err := generateElements(s.set.KeyType, newSetData)
+	newElems, err := s.generateElements(newSetData)
 	if err != nil {
 		return fmt.Errorf("generating set elements failed for %v: %v", s.set.Name, err)
 	}
@@ -174,6 +205,10 @@ func (s *Set) Elements(c *nftables.Conn) ([]SetData, error) {
 		return nil, err
 	}
 
+	if !s.set.Interval {
+		return singleSetData(s.set.KeyType, elements)
+	}
+
 	switch s.set.KeyType {
 	case nftables.TypeIPAddr:
 		fallthrough
@@ -244,6 +279,40 @@ func addrSetData(elements []nftables.SetElement) ([]SetData, error) {
 	return setDataList, nil
 }
 
+// singleSetData converts the elements of a set without intervals, like a dynamic set, each element is one address or port
+func singleSetData(keyType nftables.SetDatatype, elements []nftables.SetElement) ([]SetData, error) {
+	setDataList := []SetData{}
+
+	for _, element := range elements {
+		var setData SetData
+		switch keyType {
+		case nftables.TypeIPAddr, nftables.TypeIP6Addr:
+			addr, ok := netip.AddrFromSlice(element.Key)
+			if !ok {
+				return nil, fmt.Errorf("invalid byte array for address: %+v", element.Key)
+			}
+			setData = SetData{Address: addr}
+		case nftables.TypeInetService:
+			if len(element.Key) != 2 {
+				return nil, fmt.Errorf("invalid byte array for port: %+v", element.Key)
+			}
+			setData = SetData{Port: binaryutil.BigEndian.Uint16(element.Key)}
+		default:
+			return nil, fmt.Errorf("unexpected set key type: %v", keyType)
+		}
+
+		if element.Counter != nil {
+			setData.counter.bytes = element.Counter.Bytes
+			setData.counter.packets = element.Counter.Packets
+			setData.counter.exists = true
+		}
+
+		setDataList = append(setDataList, setData)
+	}
+
+	return setDataList, nil
+}
+
 func nextRangeElements(elements []nftables.SetElement, i *int) (start nftables.SetElement, end nftables.SetElement, err error) {
 	if (*i + 1) >= (len(elements)) {
 		return nftables.SetElement{}, nftables.SetElement{}, fmt.Errorf("index out of bounds getting range elements")
@@ -263,6 +332,49 @@ func nextRangeElements(elements []nftables.SetElement, i *int) (start nftables.S
 	return startElement, endElement, nil
 }
 
+// Convert a list of SetData to the interval set elements for a given key type, overlapping or adjacent entries are
+// merged since the kernel rejects overlapping intervals
+func SetDataToElements(keyType nftables.SetDatatype, list []SetData) ([]nftables.SetElement, error) {
+	aggregated, _, _, err := Aggregate(list)
+	if err != nil {
+		return []nftables.SetElement{}, err
+	}
+
+	return generateElements(keyType, aggregated)
+}
+
+// generateElements generates the elements for a list of SetData in the form this set needs
+func (s *Set) generateElements(list []SetData) ([]nftables.SetElement, error) {
+	if s.set.Interval {
+		return generateElements(s.set.KeyType, list)
+	}
+
+	for _, e := range list {
+		if e.AddressRangeStart.IsValid() || e.Prefix.IsValid() || e.PortRangeStart != 0 {
+			return []nftables.SetElement{}, fmt.Errorf("set %v doesn't support ranges or prefixes: %v", s.set.Name, e)
+		}
+	}
+
+	elements, err := generateElements(s.set.KeyType, list)
+	if err != nil {
+		return []nftables.SetElement{}, err
+	}
+
+	return singleElements(elements), nil
+}
+
+// singleElements drops the interval ends from the elements of single addresses or ports
+func singleElements(elements []nftables.SetElement) []nftables.SetElement {
+	single := []nftables.SetElement{}
+	for _, element := range elements {
+		if !element.IntervalEnd {
+			single = append(single, element)
+		}
+	}
+
+	return single
+}
+
 func generateElements(keyType nftables.SetDatatype, list []SetData) ([]nftables.SetElement, error) {
 	// we use interval sets for everything so we have a common set to build on top of
 	// due to this for each set type we need to generate start and ends of each interval even for single IPs
@@ -0,0 +1,162 @@
+package set
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+
+	"github.com/gaissmai/extnetip"
+)
+
+type addrInterval struct {
+	start netip.Addr
+	end   netip.Addr
+}
+
+type portInterval struct {
+	start uint16
+	end   uint16
+}
+
+// Aggregate a list of SetData into the minimal list of addresses, prefixes, ranges, ports and port ranges that cover
+// exactly the same values. Overlapping and adjacent entries are merged, IPv4 and IPv6 addresses are merged separately.
+//
+// Each SetData becomes a single interval in the kernel so fewer entries means less memory and cheaper updates. The
+// second and third return values are the number of entries before and after aggregation, respectively.
+func Aggregate(list []SetData) ([]SetData, int, int, error) {
+	v4 := []addrInterval{}
+	v6 := []addrInterval{}
+	ports := []portInterval{}
+
+	for _, d := range list {
+		if d.Port != 0 || d.PortRangeStart != 0 || d.PortRangeEnd != 0 {
+			if d.Address.IsValid() || d.AddressRangeStart.IsValid() || d.AddressRangeEnd.IsValid() || d.Prefix.IsValid() {
+				return nil, len(list), 0, fmt.Errorf("port and address can't be set at the same time: %v", d)
+			}
+
+			if err := validateSetDataPorts(d); err != nil {
+				return nil, len(list), 0, err
+			}
+
+			if d.Port != 0 {
+				ports = append(ports, portInterval{start: d.Port, end: d.Port})
+			} else {
+				ports = append(ports, portInterval{start: d.PortRangeStart, end: d.PortRangeEnd})
+			}
+			continue
+		}
+
+		if err := validateSetDataAddresses(d); err != nil {
+			return nil, len(list), 0, err
+		}
+
+		var interval addrInterval
+		switch {
+		case d.Address.IsValid():
+			interval = addrInterval{start: d.Address, end: d.Address}
+		case d.Prefix.IsValid():
+			start, end := extnetip.Range(d.Prefix.Masked())
+			interval = addrInterval{start: start, end: end}
+		default:
+			if d.AddressRangeStart.Is4() != d.AddressRangeEnd.Is4() {
+				return nil, len(list), 0, fmt.Errorf("address range start and end must be the same family: %v", d)
+			}
+			interval = addrInterval{start: d.AddressRangeStart, end: d.AddressRangeEnd}
+		}
+
+		if interval.start.Is4() {
+			v4 = append(v4, interval)
+		} else {
+			v6 = append(v6, interval)
+		}
+	}
+
+	aggregated := []SetData{}
+	aggregated = append(aggregated, mergeAddrIntervals(v4)...)
+	aggregated = append(aggregated, mergeAddrIntervals(v6)...)
+	aggregated = append(aggregated, mergePortIntervals(ports)...)
+
+	return aggregated, len(list), len(aggregated), nil
+}
+
+func mergeAddrIntervals(intervals []addrInterval) []SetData {
+	if len(intervals) == 0 {
+		return nil
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start.Less(intervals[j].start)
+	})
+
+	merged := []addrInterval{intervals[0]}
+	for _, next := range intervals[1:] {
+		current := &merged[len(merged)-1]
+
+		// the end of the current interval being the last address of the family means nothing can come after it
+		adjacent := current.end.Next()
+		if !adjacent.IsValid() || !adjacent.Less(next.start) {
+			if current.end.Less(next.end) {
+				current.end = next.end
+			}
+			continue
+		}
+
+		merged = append(merged, next)
+	}
+
+	data := make([]SetData, 0, len(merged))
+	for _, interval := range merged {
+		data = append(data, addrIntervalToSetData(interval))
+	}
+
+	return data
+}
+
+func mergePortIntervals(intervals []portInterval) []SetData {
+	if len(intervals) == 0 {
+		return nil
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start < intervals[j].start
+	})
+
+	merged := []portInterval{intervals[0]}
+	for _, next := range intervals[1:] {
+		current := &merged[len(merged)-1]
+
+		// widen to int so the comparison doesn't overflow at port 65535
+		if int(next.start) <= int(current.end)+1 {
+			if next.end > current.end {
+				current.end = next.end
+			}
+			continue
+		}
+
+		merged = append(merged, next)
+	}
+
+	data := make([]SetData, 0, len(merged))
+	for _, interval := range merged {
+		if interval.start == interval.end {
+			data = append(data, SetData{Port: interval.start})
+		} else {
+			data = append(data, SetData{PortRangeStart: interval.start, PortRangeEnd: interval.end})
+		}
+	}
+
+	return data
+}
+
+// this mirrors AddressBytesToSetData so aggregated data compares equal to what is read back from the kernel
+func addrIntervalToSetData(interval addrInterval) SetData {
+	if interval.start == interval.end {
+		return SetData{Address: interval.start}
+	}
+
+	if prefix, ok := extnetip.Prefix(interval.start, interval.end); ok {
+		return SetData{Prefix: prefix}
+	}
+
+	return SetData{AddressRangeStart: interval.start, AddressRangeEnd: interval.end}
+}
@@ -0,0 +1,118 @@
+package set
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateAdjacentAddressesV4(t *testing.T) {
+	list, err := AddressStringsToSetData([]string{"198.51.100.0", "198.51.100.1", "198.51.100.2", "198.51.100.3"})
+	assert.Nil(t, err)
+
+	res, before, after, err := Aggregate(list)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, before)
+	assert.Equal(t, 1, after)
+	assert.Equal(t, []SetData{{Prefix: netip.MustParsePrefix("198.51.100.0/30")}}, res)
+}
+
+func TestAggregateAdjacentAddressesRangeV4(t *testing.T) {
+	list, err := AddressStringsToSetData([]string{"198.51.100.1", "198.51.100.2", "198.51.100.3"})
+	assert.Nil(t, err)
+
+	res, before, after, err := Aggregate(list)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, before)
+	assert.Equal(t, 1, after)
+	assert.Equal(t, []SetData{{AddressRangeStart: netip.MustParseAddr("198.51.100.1"), AddressRangeEnd: netip.MustParseAddr("198.51.100.3")}}, res)
+}
+
+func TestAggregateOverlappingV4(t *testing.T) {
+	list, err := AddressStringsToSetData([]string{"198.51.100.0/24", "198.51.100.200", "198.51.100.250-198.51.101.255", "203.0.113.5"})
+	assert.Nil(t, err)
+
+	res, before, after, err := Aggregate(list)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, before)
+	assert.Equal(t, 2, after)
+	assert.Equal(t, []SetData{
+		{Prefix: netip.MustParsePrefix("198.51.100.0/23")},
+		{Address: netip.MustParseAddr("203.0.113.5")},
+	}, res)
+}
+
+func TestAggregateMixedFamilies(t *testing.T) {
+	list, err := AddressStringsToSetData([]string{"2001:db8::1", "198.51.100.1", "2001:db8::/127", "198.51.100.0"})
+	assert.Nil(t, err)
+
+	res, before, after, err := Aggregate(list)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, before)
+	assert.Equal(t, 2, after)
+	assert.Equal(t, []SetData{
+		{Prefix: netip.MustParsePrefix("198.51.100.0/31")},
+		{Prefix: netip.MustParsePrefix("2001:db8::/127")},
+	}, res)
+}
+
+func TestAggregateLastAddress(t *testing.T) {
+	list, err := AddressStringsToSetData([]string{"255.255.255.255", "255.255.255.254", "255.255.255.255"})
+	assert.Nil(t, err)
+
+	res, _, after, err := Aggregate(list)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, after)
+	assert.Equal(t, []SetData{{Prefix: netip.MustParsePrefix("255.255.255.254/31")}}, res)
+}
+
+func TestAggregatePorts(t *testing.T) {
+	list, err := PortStringsToSetData([]string{"80", "81", "82", "443", "1000-2000", "1500-3000", "65535", "65534"})
+	assert.Nil(t, err)
+
+	res, before, after, err := Aggregate(list)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, before)
+	assert.Equal(t, 4, after)
+	assert.Equal(t, []SetData{
+		{PortRangeStart: 80, PortRangeEnd: 82},
+		{Port: 443},
+		{PortRangeStart: 1000, PortRangeEnd: 3000},
+		{PortRangeStart: 65534, PortRangeEnd: 65535},
+	}, res)
+}
+
+func TestAggregateEmpty(t *testing.T) {
+	res, before, after, err := Aggregate([]SetData{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, before)
+	assert.Equal(t, 0, after)
+	assert.Equal(t, []SetData{}, res)
+}
+
+func TestAggregateInvalid(t *testing.T) {
+	_, _, _, err := Aggregate([]SetData{{}})
+	assert.Error(t, err)
+
+	_, _, _, err = Aggregate([]SetData{{Port: 80, Address: netip.MustParseAddr("198.51.100.1")}})
+	assert.Error(t, err)
+
+	_, _, _, err = Aggregate([]SetData{{AddressRangeStart: netip.MustParseAddr("198.51.100.1"), AddressRangeEnd: netip.MustParseAddr("2001:db8::1")}})
+	assert.Error(t, err)
+}
+
+func TestAggregateRoundTrip(t *testing.T) {
+	list, err := AddressStringsToSetData([]string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4"})
+	assert.Nil(t, err)
+
+	res, _, _, err := Aggregate(list)
+	assert.Nil(t, err)
+	assert.Len(t, res, 1)
+
+	// aggregated data should look exactly like what we read back from the kernel
+	end := netip.MustParseAddr("198.51.100.4").Next()
+	readBack, err := AddressBytesToSetData(netip.MustParseAddr("198.51.100.1").AsSlice(), end.AsSlice())
+	assert.Nil(t, err)
+	assert.Equal(t, readBack, res[0])
+}
@@ -20,6 +20,9 @@ import (
 
 type SetUpdateFunc func() ([]SetData, error)
 
+// Defines an optional setting for a set manager
+type ManagerOption func(*ManagedSet)
+
 // Represents a set managed by the manager goroutine
 type ManagedSet struct {
 	conn          *nftables.Conn
@@ -28,11 +31,12 @@ type ManagedSet struct {
 	interval      time.Duration
 	logger        logger.Logger
 	metrics       m.Metrics
+	aggregate     bool
 }
 
 // Create a set manager.
 // Passing a nil metrics object is safe and will result in the "NoOp" client being used.
-func ManagerInit(set Set, f SetUpdateFunc, interval time.Duration, logger logger.Logger, metrics m.Metrics) (ManagedSet, error) {
+func ManagerInit(set Set, f SetUpdateFunc, interval time.Duration, logger logger.Logger, metrics m.Metrics, opts ...ManagerOption) (ManagedSet, error) {
 	c, err := nftables.New()
 	if err != nil {
 		return ManagedSet{}, err
@@ -42,14 +46,27 @@ func ManagerInit(set Set, f SetUpdateFunc, interval time.Duration, logger logger
 		metrics = &statsd.NoOpClient{}
 	}
 
-	return ManagedSet{
+	managedSet := ManagedSet{
 		conn:          c,
 		set:           set,
 		setUpdateFunc: f,
 		interval:      interval,
 		logger:        logger,
 		metrics:       metrics,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(&managedSet)
+	}
+
+	return managedSet, nil
+}
+
+// WithAggregation makes the manager run Aggregate on the output of the set update function before updating the set
+func WithAggregation() ManagerOption {
+	return func(s *ManagedSet) {
+		s.aggregate = true
+	}
 }
 
 // Start the set manager goroutine
@@ -90,6 +107,32 @@ func (s *ManagedSet) Start(ctx context.Context) error {
 				s.logger.Warnf("error sending manager_loop_update_func metric: %v", err)
 			}
 
+			if s.aggregate {
+				aggregated, before, after, err := Aggregate(data)
+				if err != nil {
+					s.logger.Errorf("error aggregating set data for table/set %v/%v: %v", s.set.set.Table.Name, s.set.set.Name, err)
+					err = s.metrics.Count(m.Prefix("manager_loop_aggregate"), 1, s.genTags([]string{"success:false"}), 1)
+					if err != nil {
+						s.logger.Warnf("error sending manager_loop_aggregate metric: %v", err)
+					}
+					continue
+				}
+				s.logger.Debugf("aggregated set data for table/set %v/%v from %v to %v entries", s.set.set.Table.Name, s.set.set.Name, before, after)
+				err = s.metrics.Count(m.Prefix("manager_loop_aggregate"), 1, s.genTags([]string{"success:true"}), 1)
+				if err != nil {
+					s.logger.Warnf("error sending manager_loop_aggregate metric: %v", err)
+				}
+				err = s.metrics.Gauge(m.Prefix("manager_loop_aggregate_before"), float64(before), s.genTags([]string{}), 1)
+				if err != nil {
+					s.logger.Warnf("error sending manager_loop_aggregate_before metric: %v", err)
+				}
+				err = s.metrics.Gauge(m.Prefix("manager_loop_aggregate_after"), float64(after), s.genTags([]string{}), 1)
+				if err != nil {
+					s.logger.Warnf("error sending manager_loop_aggregate_after metric: %v", err)
+				}
+				data = aggregated
+			}
+
 			flush, added, deleted, err := s.set.UpdateElements(s.conn, data)
 			if err != nil {
 				s.logger.Errorf("error updating table/set %v/%v: %v", s.set.set.Table.Name, s.set.set.Name, err)
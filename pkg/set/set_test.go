@@ -6,12 +6,14 @@ import (
 	"bytes"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 	"github.com/mdlayher/netlink"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func TestNewSetBadType(t *testing.T) {
@@ -682,3 +684,111 @@ func TestNoCounterPortSetData(t *testing.T) {
 	assert.Equal(t, 1, len(res))
 	assert.Equal(t, SetData{PortRangeStart: 1000, PortRangeEnd: 1001}, res[0])
 }
+
+func TestSetDataToElements(t *testing.T) {
+	setData, err := AddressStringsToSetData([]string{"198.51.100.0/25", "198.51.100.128/25", "198.51.100.7"})
+	assert.Nil(t, err)
+
+	res, err := SetDataToElements(nftables.TypeIPAddr, setData)
+	assert.Nil(t, err)
+	assert.Equal(t, []nftables.SetElement{
+		{Key: []byte{198, 51, 100, 0}},
+		{Key: []byte{198, 51, 101, 0}, IntervalEnd: true},
+	}, res)
+}
+
+func TestNewDynamicSet(t *testing.T) {
+	var setFlags, setTimeout []byte
+	var elements [][]byte
+
+	c, err := nftables.New(nftables.WithTestDial(
+		func(req []netlink.Message) ([]netlink.Message, error) {
+			for _, msg := range req {
+				if len(msg.Data) < 4 {
+					continue
+				}
+
+				ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+				assert.Nil(t, err)
+
+				switch msg.Header.Type {
+				case netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWSET):
+					for ad.Next() {
+						switch ad.Type() {
+						case unix.NFTA_SET_FLAGS:
+							setFlags = ad.Bytes()
+						case unix.NFTA_SET_TIMEOUT:
+							setTimeout = ad.Bytes()
+						}
+					}
+				case netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWSETELEM):
+					for ad.Next() {
+						if ad.Type() == unix.NFTA_SET_ELEM_LIST_ELEMENTS {
+							elements = append(elements, ad.Bytes())
+						}
+					}
+				}
+			}
+			return req, nil
+		}))
+	assert.Nil(t, err)
+
+	table := c.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   "testtable",
+	})
+
+	res, err := New(c, table, "testset", nftables.TypeIPAddr, WithDynamic(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, res.Set().Dynamic)
+	assert.False(t, res.Set().Interval)
+
+	// dynamic with a timeout and without interval
+	assert.Equal(t, binaryutil.BigEndian.PutUint32(unix.NFT_SET_TIMEOUT|unix.NFT_SET_EVAL), setFlags)
+	assert.Equal(t, binaryutil.BigEndian.PutUint64(60000), setTimeout)
+
+	// a single init element without an interval end
+	assert.Len(t, elements, 1)
+	ad, err := netlink.NewAttributeDecoder(elements[0])
+	assert.Nil(t, err)
+	count := 0
+	for ad.Next() {
+		count++
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestDynamicSetElements(t *testing.T) {
+	s := Set{set: &nftables.Set{Name: "testset", KeyType: nftables.TypeIPAddr, Dynamic: true}}
+
+	setData, err := AddressStringsToSetData([]string{"192.0.2.1", "198.51.100.7"})
+	assert.Nil(t, err)
+
+	elements, err := s.generateElements(setData)
+	assert.Nil(t, err)
+	assert.Equal(t, []nftables.SetElement{{Key: []byte{192, 0, 2, 1}}, {Key: []byte{198, 51, 100, 7}}}, elements)
+
+	elements[0].Counter = &expr.Counter{Bytes: 100, Packets: 1}
+	res, err := singleSetData(nftables.TypeIPAddr, elements)
+	assert.Nil(t, err)
+	assert.Equal(t, setData[0].Address, res[0].Address)
+	assert.Equal(t, setData[1].Address, res[1].Address)
+	bytes, packets, err := res[0].Counters()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 100, *bytes)
+	assert.EqualValues(t, 1, *packets)
+
+	ranges, err := AddressStringsToSetData([]string{"192.0.2.0/24"})
+	assert.Nil(t, err)
+	_, err = s.generateElements(ranges)
+	assert.Error(t, err)
+
+	ports := Set{set: &nftables.Set{Name: "testset", KeyType: nftables.TypeInetService, Dynamic: true}}
+	portData, err := PortStringsToSetData([]string{"22"})
+	assert.Nil(t, err)
+	elements, err = ports.generateElements(portData)
+	assert.Nil(t, err)
+	res, err = singleSetData(nftables.TypeInetService, elements)
+	assert.Nil(t, err)
+	assert.Equal(t, portData, res)
+}
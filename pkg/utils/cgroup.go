@@ -0,0 +1,48 @@
+//go:build linux
+
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Where the cgroup v2 hierarchy is usually mounted
+const CgroupV2Root = "/sys/fs/cgroup"
+
+// Resolves a cgroup v2 path to the ID the kernel uses for it, the inode number of its directory, and its level, the
+// number of cgroups between it and the root. The path can be absolute under CgroupV2Root or relative to it.
+func ResolveCgroupV2(path string) (uint64, uint32, error) {
+	return resolveCgroupV2(CgroupV2Root, path)
+}
+
+func resolveCgroupV2(root string, path string) (uint64, uint32, error) {
+	rel := filepath.Clean(path)
+	if filepath.IsAbs(rel) {
+		var err error
+		rel, err = filepath.Rel(root, rel)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return 0, 0, fmt.Errorf("cgroup path %v is not under %v", path, root)
+		}
+	} else if rel == ".." || strings.HasPrefix(rel, "../") {
+		return 0, 0, fmt.Errorf("cgroup path %v is not under %v", path, root)
+	}
+
+	if rel == "." {
+		return 0, 0, fmt.Errorf("cgroup path %v is the root cgroup", path)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join(root, rel), &st); err != nil {
+		return 0, 0, fmt.Errorf("error resolving cgroup path %v: %v", path, err)
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return 0, 0, fmt.Errorf("cgroup path %v is not a directory", path)
+	}
+
+	return st.Ino, uint32(strings.Count(rel, "/") + 1), nil
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestResolveCgroupV2(t *testing.T) {
+	root := t.TempDir()
+	service := filepath.Join(root, "system.slice", "sshd.service")
+	assert.Nil(t, os.MkdirAll(service, 0o755))
+
+	var st unix.Stat_t
+	assert.Nil(t, unix.Stat(service, &st))
+
+	id, level, err := resolveCgroupV2(root, "system.slice/sshd.service")
+	assert.Nil(t, err)
+	assert.Equal(t, st.Ino, id)
+	assert.Equal(t, uint32(2), level)
+
+	id, level, err = resolveCgroupV2(root, service+"/")
+	assert.Nil(t, err)
+	assert.Equal(t, st.Ino, id)
+	assert.Equal(t, uint32(2), level)
+
+	_, level, err = resolveCgroupV2(root, "/system.slice")
+	assert.Error(t, err)
+	assert.Equal(t, uint32(0), level)
+
+	_, level, err = resolveCgroupV2(root, filepath.Join(root, "system.slice"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), level)
+}
+
+func TestResolveCgroupV2Invalid(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "cgroup.procs"), []byte{}, 0o644))
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"root", root},
+		{"relative root", "."},
+		{"outside root", "../etc"},
+		{"missing", "system.slice"},
+		{"not a directory", "cgroup.procs"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := resolveCgroupV2(root, test.path)
+			assert.Error(t, err)
+		})
+	}
+}
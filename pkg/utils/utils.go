@@ -6,8 +6,13 @@ package utils
 import (
 	"fmt"
 	"net/netip"
+	"strings"
+	"unicode"
 )
 
+// IFNAMSIZ, the size of an interface name including the NUL terminator
+const InterfaceNameSize = 16
+
 // Validates start and end port numbers
 func ValidatePortRange(start uint16, end uint16) error {
 	if err := ValidatePort(start); err != nil {
@@ -72,3 +77,33 @@ func ValidatePrefix(prefix netip.Prefix) error {
 
 	return nil
 }
+
+// Validates an interface name using the same rules as the kernel
+func ValidateInterfaceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("interface name is empty")
+	}
+
+	if name == "." || name == ".." {
+		return fmt.Errorf("interface name (%v) is invalid", name)
+	}
+
+	return ValidateInterfacePrefix(name)
+}
+
+// Validates the start of an interface name, used for wildcard matches like eth*
+func ValidateInterfacePrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("interface prefix is empty")
+	}
+
+	if len(prefix) >= InterfaceNameSize {
+		return fmt.Errorf("interface name (%v) is too long, %v >= %v", prefix, len(prefix), InterfaceNameSize)
+	}
+
+	if strings.ContainsFunc(prefix, func(r rune) bool { return r == '/' || r == ':' || r == 0 || unicode.IsSpace(r) }) {
+		return fmt.Errorf("interface name (%v) contains invalid characters", prefix)
+	}
+
+	return nil
+}
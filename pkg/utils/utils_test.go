@@ -82,3 +82,20 @@ func TestValidateBadPrefix(t *testing.T) {
 	err := ValidatePrefix(netip.Prefix{})
 	assert.Error(t, err)
 }
+
+func TestValidateInterfaceName(t *testing.T) {
+	assert.Nil(t, ValidateInterfaceName("eth0"))
+	assert.Nil(t, ValidateInterfaceName("abcdefghijklmno"))
+	assert.Error(t, ValidateInterfaceName(""))
+	assert.Error(t, ValidateInterfaceName(".."))
+	assert.Error(t, ValidateInterfaceName("abcdefghijklmnop"))
+	assert.Error(t, ValidateInterfaceName("eth0:1"))
+	assert.Error(t, ValidateInterfaceName("eth 0"))
+}
+
+func TestValidateInterfacePrefix(t *testing.T) {
+	assert.Nil(t, ValidateInterfacePrefix("e"))
+	assert.Nil(t, ValidateInterfacePrefix("."))
+	assert.Error(t, ValidateInterfacePrefix(""))
+	assert.Error(t, ValidateInterfacePrefix("eth/"))
+}